@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/dryack/GoCeannaithe/pkg/bloom"
 	"github.com/dryack/GoCeannaithe/pkg/common"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
 	"log"
 	"math/rand/v2"
 )
@@ -63,8 +64,9 @@ func main() {
 
 	size := uint64(10_000_000)
 	// errorRate := 0.015
-	// bf5, _ := bloom.NewBloomFilter[int]().WithPersistence(bloom.NewFilePersistence[int]("bf_data.dat")).WithAutoConfigure(size, errorRate)
-	bf5, _ := bloom.NewBloomFilter[int]().WithHashFunctions(5, common.XXhash).WithPersistence(bloom.NewFilePersistence[int](".", "bf_data.dat")).WithStorage(bloom.NewBitPackingStorage[int](size, nil))
+	fp := persist.NewFilePersistence(".", "bf_data.dat")
+	// bf5, _ := bloom.New[int](bloom.WithPersistence(bloom.NewGenericPersistence[int](fp)), bloom.WithAutoConfigure(size, errorRate))
+	bf5, _ := bloom.New[int](bloom.WithHashFunctions(5, common.XXhash), bloom.WithPersistence(bloom.NewGenericPersistence[int](fp)), bloom.WithStorage(bloom.NewBitPackingStorage[int](size, nil)))
 	for i := 0; i < 100; i++ {
 		bf5.Storage.SetBit(i)
 	}
@@ -73,7 +75,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	bf6 := bloom.NewBloomFilter[int]().WithPersistence(bloom.NewFilePersistence[int](".", "bf_data.dat"))
+	bf6 := bloom.NewBloomFilter[int]().WithPersistence(bloom.NewGenericPersistence[int](fp))
 	err = bf6.LoadPersistence()
 	if err != nil {
 		fmt.Println("error loading Bloom filter:", err)
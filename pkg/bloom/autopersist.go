@@ -0,0 +1,240 @@
+package bloom
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// AutoPersistOptions controls when an AutoPersist saves its filter
+type AutoPersistOptions struct {
+	// Interval saves the filter this often, if it has changed since the last save; zero disables timed saves
+	Interval time.Duration
+	// Inserts saves the filter once this many keys have been added since the last save; zero disables it
+	Inserts int
+	// OnError is called with the error from any failed background save.  It may be nil.
+	OnError func(error)
+}
+
+// AutoPersist wraps a BloomFilter, making it safe for concurrent use and saving it with the filter's Persistence in
+// the background.  Each save updates a copy of the filter while briefly holding the lock, and serializes the copy
+// without it, so writers are only blocked for the copy.  The copy is kept between saves, and with BitPackingStorage
+// only the pages changed since the last save are copied into it.  Changes made since the last successful save are
+// retried at the next save.
+//
+// The wrapped filter must not be used directly while the AutoPersist is open.
+type AutoPersist[T any] struct {
+	mu      sync.RWMutex
+	bf      *BloomFilter[T]
+	pending int // keys added since the last save
+	closed  bool
+
+	saveMu   sync.Mutex      // serializes saves, so that a newer snapshot is never overwritten by an older one
+	snapshot *BloomFilter[T] // the copy of bf which is saved, reused by every save
+	source   Storage[T]      // the storage of bf which snapshot was copied from
+	dirty    *dirtyTracker   // the pages of source changed since they were copied, for BitPackingStorage
+	opts     AutoPersistOptions
+	trigger  chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewAutoPersist starts saving bf, which must have been given a Persistence with WithPersistence, according to opts.
+// Close must be called to stop the background saves and flush any remaining changes.
+func NewAutoPersist[T any](bf *BloomFilter[T], opts AutoPersistOptions) (*AutoPersist[T], error) {
+	if bf.persistence == nil {
+		return nil, ErrNoPersistence
+	}
+	if bf.Storage == nil {
+		return nil, ErrNoStorage
+	}
+	if _, ok := bf.persistence.(insertLogger[T]); ok {
+		// saving a copy would truncate the log of inserts made after the copy was taken
+		return nil, errors.New("persistence already logs every insert, and can't be saved in the background")
+	}
+	if opts.Interval < 0 || opts.Inserts < 0 {
+		return nil, errors.New("auto-persist interval and inserts must not be negative")
+	}
+
+	ap := &AutoPersist[T]{
+		bf:      bf,
+		opts:    opts,
+		trigger: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go ap.run()
+	return ap, nil
+}
+
+// Add adds key to the filter
+func (ap *AutoPersist[T]) Add(key T) error {
+	ap.mu.Lock()
+	if ap.closed {
+		ap.mu.Unlock()
+		return errors.New("auto-persist is closed")
+	}
+	if err := ap.bf.Add(key); err != nil {
+		ap.mu.Unlock()
+		return err
+	}
+	ap.addedLocked()
+	ap.mu.Unlock()
+	return nil
+}
+
+// AddHash adds a pre-hashed key to the filter, see BloomFilter.AddHash
+func (ap *AutoPersist[T]) AddHash(h1, h2 uint64) error {
+	ap.mu.Lock()
+	if ap.closed {
+		ap.mu.Unlock()
+		return errors.New("auto-persist is closed")
+	}
+	if err := ap.bf.AddHash(h1, h2); err != nil {
+		ap.mu.Unlock()
+		return err
+	}
+	ap.addedLocked()
+	ap.mu.Unlock()
+	return nil
+}
+
+// Contains reports whether key may be present in the filter
+func (ap *AutoPersist[T]) Contains(key T) bool {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+	return ap.bf.Contains(key)
+}
+
+// ContainsHash reports whether a pre-hashed key may be present in the filter, see BloomFilter.ContainsHash
+func (ap *AutoPersist[T]) ContainsHash(h1, h2 uint64) bool {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+	return ap.bf.ContainsHash(h1, h2)
+}
+
+// addedLocked counts an added key, and wakes the background saver once enough have been added
+func (ap *AutoPersist[T]) addedLocked() {
+	ap.pending++
+	if ap.opts.Inserts > 0 && ap.pending >= ap.opts.Inserts {
+		select {
+		case ap.trigger <- struct{}{}:
+		default:
+			// a save is already due
+		}
+	}
+}
+
+// Save saves the filter immediately, if it has changed since the last save
+func (ap *AutoPersist[T]) Save() error {
+	ap.saveMu.Lock()
+	defer ap.saveMu.Unlock()
+
+	ap.mu.Lock()
+	pending := ap.pending
+	if pending == 0 {
+		ap.mu.Unlock()
+		return nil
+	}
+	snapshot := ap.snapshotLocked()
+	ap.pending = 0
+	ap.mu.Unlock()
+
+	if err := snapshot.persistence.Save(snapshot); err != nil {
+		ap.mu.Lock()
+		ap.pending += pending
+		ap.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// snapshotLocked brings the copy of the filter which is saved up to date, and returns it.  The copy is only made afresh
+// for the first save, or once the filter's storage has been replaced.
+func (ap *AutoPersist[T]) snapshotLocked() *BloomFilter[T] {
+	if ap.snapshot != nil && ap.source == ap.bf.Storage {
+		switch storage := ap.bf.Storage.(type) {
+		case *BitPackingStorage[T]:
+			if storage.tracksDirty(ap.dirty) {
+				ap.snapshot.Storage.(*BitPackingStorage[T]).copyPages(storage, ap.dirty.pages())
+				ap.dirty.reset()
+				return ap.snapshot
+			}
+		case *ConventionalStorage[T]:
+			copy(ap.snapshot.Storage.(*ConventionalStorage[T]).bits, storage.bits)
+			return ap.snapshot
+		}
+	}
+
+	if source, ok := ap.source.(*BitPackingStorage[T]); ok {
+		source.untrackDirty(ap.dirty)
+	}
+	ap.snapshot, ap.source, ap.dirty = ap.bf.clone(), ap.bf.Storage, nil
+	if storage, ok := ap.bf.Storage.(*BitPackingStorage[T]); ok {
+		ap.dirty = storage.trackDirty()
+	}
+	return ap.snapshot
+}
+
+// copyPages copies pages from src, which has the same size, marking them changed so that persistence tracking the
+// storage's changes, such as CheckpointPersistence, saves them
+func (b *BitPackingStorage[T]) copyPages(src *BitPackingStorage[T], pages []uint64) {
+	for _, page := range pages {
+		start := page * dirtyPageWords
+		end := min(start+dirtyPageWords, uint64(len(b.bits)))
+		copy(b.bits[start:end], src.bits[start:end])
+		b.markDirty(start)
+	}
+}
+
+// Close stops the background saves, and saves any changes not yet persisted.  Once closed, Add and AddHash return an
+// error.  If ctx is done before the final save completes, Close returns ctx.Err() while the save continues in the
+// background.
+func (ap *AutoPersist[T]) Close(ctx context.Context) error {
+	ap.mu.Lock()
+	if ap.closed {
+		ap.mu.Unlock()
+		return nil
+	}
+	ap.closed = true
+	ap.mu.Unlock()
+
+	close(ap.done)
+	result := make(chan error, 1)
+	go func() {
+		<-ap.stopped
+		result <- ap.Save()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run saves the filter in the background until Close is called
+func (ap *AutoPersist[T]) run() {
+	defer close(ap.stopped)
+
+	var tick <-chan time.Time
+	if ap.opts.Interval > 0 {
+		ticker := time.NewTicker(ap.opts.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+		case <-ap.trigger:
+		case <-ap.done:
+			return
+		}
+		if err := ap.Save(); err != nil && ap.opts.OnError != nil {
+			ap.opts.OnError(err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package bloom
+
+import (
+	"context"
+	"errors"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryPersistence keeps the last saved filter in memory, failing while err is set
+type memoryPersistence[T any] struct {
+	mu    sync.Mutex
+	data  []byte
+	saves int
+	err   error
+}
+
+func (mp *memoryPersistence[T]) Save(bf *BloomFilter[T]) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.err != nil {
+		return mp.err
+	}
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	mp.data = data
+	mp.saves++
+	return nil
+}
+
+func (mp *memoryPersistence[T]) Load(bf *BloomFilter[T]) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return bf.UnmarshalBinary(mp.data)
+}
+
+func (mp *memoryPersistence[T]) saveCount() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.saves
+}
+
+func newAutoPersistFilter(t *testing.T, mp *memoryPersistence[string]) *BloomFilter[string] {
+	t.Helper()
+	return newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](1<<16, nil)).WithPersistence(mp)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAutoPersist_Inserts(t *testing.T) {
+	mp := &memoryPersistence[string]{}
+	ap, err := NewAutoPersist(newAutoPersistFilter(t, mp), AutoPersistOptions{Inserts: 10})
+	if err != nil {
+		t.Fatalf("NewAutoPersist() error = %v", err)
+	}
+
+	for i := 0; i < 9; i++ {
+		_ = ap.Add(strconv.Itoa(i))
+	}
+	time.Sleep(20 * time.Millisecond)
+	if mp.saveCount() != 0 {
+		t.Errorf("saved after 9 inserts, want no save until 10")
+	}
+	_ = ap.Add("9")
+	waitFor(t, "a save after 10 inserts", func() bool { return mp.saveCount() == 1 })
+
+	if err := ap.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if mp.saveCount() != 1 {
+		t.Errorf("Close() saved an unchanged filter")
+	}
+	if err := ap.Add("closed"); err == nil {
+		t.Errorf("Add() after Close() succeeded, want error")
+	}
+}
+
+func TestAutoPersist_IntervalAndFlush(t *testing.T) {
+	mp := &memoryPersistence[string]{}
+	ap, _ := NewAutoPersist(newAutoPersistFilter(t, mp), AutoPersistOptions{Interval: 5 * time.Millisecond})
+
+	_ = ap.Add("timed")
+	waitFor(t, "a timed save", func() bool { return mp.saveCount() == 1 })
+
+	_ = ap.Add("flushed")
+	if err := ap.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	loaded := NewBloomFilter[string]()
+	if err := mp.Load(loaded); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !loaded.Storage.CheckBit("timed") || !loaded.Storage.CheckBit("flushed") {
+		t.Errorf("saved filter is missing keys added before Close()")
+	}
+}
+
+func TestAutoPersist_Errors(t *testing.T) {
+	mp := &memoryPersistence[string]{err: errInjected}
+	reported := make(chan error, 10)
+	ap, _ := NewAutoPersist(newAutoPersistFilter(t, mp), AutoPersistOptions{
+		Inserts: 1,
+		OnError: func(err error) { reported <- err },
+	})
+
+	_ = ap.Add("lost?")
+	select {
+	case err := <-reported:
+		if !errors.Is(err, errInjected) {
+			t.Errorf("OnError() called with %v, want the injected failure", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("OnError() was not called")
+	}
+
+	// the failed save's changes are retried when closing
+	mp.mu.Lock()
+	mp.err = nil
+	mp.mu.Unlock()
+	if err := ap.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if mp.saveCount() != 1 {
+		t.Errorf("Close() made %d saves, want 1", mp.saveCount())
+	}
+}
+
+func TestAutoPersist_Concurrent(t *testing.T) {
+	mp := &memoryPersistence[string]{}
+	ap, _ := NewAutoPersist(newAutoPersistFilter(t, mp), AutoPersistOptions{Inserts: 50, Interval: time.Millisecond})
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				_ = ap.Add(key)
+				if !ap.Contains(key) {
+					t.Errorf("Contains(%q) = false after Add()", key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := ap.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	loaded := NewBloomFilter[string]()
+	_ = mp.Load(loaded)
+	if !loaded.Storage.CheckBit("3-499") {
+		t.Errorf("saved filter is missing the last key added")
+	}
+}
+
+func TestAutoPersist_ReusesSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.ckpt")
+	cp := NewCheckpointPersistence[string](path)
+	defer cp.Close()
+	bf := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](1<<24, nil)).WithPersistence(cp)
+	ap, _ := NewAutoPersist(bf, AutoPersistOptions{})
+	_ = ap.Add("spam")
+	if err := ap.Save(); err != nil || cp.lastPages != 512 {
+		t.Fatalf("first Save() wrote %d pages (error %v), want all 512", cp.lastPages, err)
+	}
+	snapshot := ap.snapshot
+
+	// later saves copy only the changed pages into the same copy, so the checkpoint is incremental too
+	for _, key := range []string{"eggs", "ham"} {
+		_ = ap.Add(key)
+	}
+	if err := ap.Save(); err != nil || cp.lastPages == 0 || cp.lastPages > 10 {
+		t.Errorf("second Save() wrote %d pages (error %v), want between 1 and 10 for 2 keys", cp.lastPages, err)
+	}
+	if ap.snapshot != snapshot {
+		t.Errorf("second Save() copied the whole filter again, want the copy reused")
+	}
+	_ = ap.Add("parrot")
+	if err := ap.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	loaded := NewBloomFilter[string]().WithPersistence(NewCheckpointPersistence[string](path))
+	if err := loaded.LoadPersistence(); err != nil {
+		t.Fatalf("LoadPersistence() error = %v", err)
+	}
+	for _, key := range []string{"spam", "eggs", "ham", "parrot"} {
+		if !loaded.Contains(key) {
+			t.Errorf("Contains(%q) = false after loading", key)
+		}
+	}
+}
+
+func TestAutoPersist_ReusesConventionalSnapshot(t *testing.T) {
+	mp := &memoryPersistence[string]{}
+	bf := newTestFilter(t, 5, common.Murmur3, NewConventionalStorage[string](1<<10, nil)).WithPersistence(mp)
+	ap, _ := NewAutoPersist(bf, AutoPersistOptions{})
+	_ = ap.Add("spam")
+	_ = ap.Save()
+	bits := &ap.snapshot.Storage.(*ConventionalStorage[string]).bits[0]
+	_ = ap.Add("eggs")
+	if err := ap.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if &ap.snapshot.Storage.(*ConventionalStorage[string]).bits[0] != bits {
+		t.Errorf("Save() allocated new storage for the copy, want it reused")
+	}
+
+	loaded := NewBloomFilter[string]()
+	if err := mp.Load(loaded); err != nil || !loaded.Contains("spam") || !loaded.Contains("eggs") {
+		t.Errorf("saved filter is missing keys (error %v)", err)
+	}
+}
+
+func TestNewAutoPersist_RequiresPersistence(t *testing.T) {
+	bf := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](64, nil))
+	if _, err := NewAutoPersist(bf, AutoPersistOptions{Inserts: 1}); err == nil {
+		t.Errorf("NewAutoPersist() without a Persistence succeeded, want error")
+	}
+}
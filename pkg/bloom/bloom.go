@@ -1,6 +1,7 @@
 package bloom
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"github.com/dryack/GoCeannaithe/pkg/common"
@@ -9,21 +10,22 @@ import (
 )
 
 // Storage defines the interface for bit storage operations
-type Storage[T common.Hashable] interface {
+type Storage[T any] interface {
 	SetBit(key T) error
 	CheckBit(key T) bool
 }
 
 // BitPackingStorage uses a slice of uint64 for efficient bit storage
-type BitPackingStorage[T common.Hashable] struct {
+type BitPackingStorage[T any] struct {
 	bits        []uint64
 	seeds       []uint32 // TODO: We may want to just make these uint64, and avoid casting them when hashing
 	bitsLength  uint64
 	bloomFilter *BloomFilter[T]
+	dirty       []*dirtyTracker // the trackers of changed pages, one for each persistence tracking them
 }
 
 // ConventionalStorage uses a slice of bool
-type ConventionalStorage[T common.Hashable] struct {
+type ConventionalStorage[T any] struct {
 	bits        []bool
 	seeds       []uint32 // TODO: We may want to just make these uint64, and avoid casting them when hashing
 	sliceLength uint64
@@ -33,7 +35,7 @@ type ConventionalStorage[T common.Hashable] struct {
 // NewBitPackingStorage creates a new BitPackingStorage with the given number of bits
 //
 // Size here indicates the number of bits, and not the number of keys we wish to store.
-func NewBitPackingStorage[T common.Hashable](size uint64, seeds []uint32) *BitPackingStorage[T] {
+func NewBitPackingStorage[T any](size uint64, seeds []uint32) *BitPackingStorage[T] {
 	roundedSize := roundUpToNextPowerOfTwo(size)
 	numUint64s := (roundedSize + 63) / 64 // Calculate number of uint64s needed
 	return &BitPackingStorage[T]{bits: make([]uint64, numUint64s), seeds: seeds, bitsLength: numUint64s}
@@ -43,12 +45,15 @@ func NewBitPackingStorage[T common.Hashable](size uint64, seeds []uint32) *BitPa
 //
 // Size here indicates the number of bits - or here, being ConventionalStorage) - the number of cells in the slice, and
 // not the number of keys we wish to store.
-func NewConventionalStorage[T common.Hashable](size uint64, seeds []uint32) *ConventionalStorage[T] {
+func NewConventionalStorage[T any](size uint64, seeds []uint32) *ConventionalStorage[T] {
 	return &ConventionalStorage[T]{bits: make([]bool, size), seeds: seeds, sliceLength: size}
 }
 
 // calculateBitIndex calculates the bit index for a given key
 func (b *BitPackingStorage[T]) calculateBitIndex(key T, seed uint32) (uint64, error) {
+	if b.bitsLength == 0 {
+		return 0, ErrEmptyStorage
+	}
 	index, err := b.bloomFilter.hashFunction(key, seed)
 	if err != nil {
 		return 0, err
@@ -69,6 +74,7 @@ func (b *BitPackingStorage[T]) SetBit(key T) error {
 			return err
 		}
 		b.bits[index/64] |= 1 << (index % 64)
+		b.markDirty(index / 64)
 	}
 	return nil
 }
@@ -79,8 +85,8 @@ func (b *BitPackingStorage[T]) SetBit(key T) error {
 // Otherwise, it returns true.
 func (b *BitPackingStorage[T]) CheckBit(key T) bool {
 	for _, seed := range b.seeds {
-		index, _ := b.calculateBitIndex(key, seed)
-		if (b.bits[index/64] & (1 << (index % 64))) == 0 {
+		index, err := b.calculateBitIndex(key, seed)
+		if err != nil || (b.bits[index/64]&(1<<(index%64))) == 0 {
 			return false // the bit for this hash/seed is not set
 		}
 	}
@@ -89,6 +95,9 @@ func (b *BitPackingStorage[T]) CheckBit(key T) bool {
 
 // calculateBitIndex calculates the bit index for a given key in ConventionalStorage
 func (c *ConventionalStorage[T]) calculateBitIndex(key T, seed uint32) (uint64, error) {
+	if c.sliceLength == 0 {
+		return 0, ErrEmptyStorage
+	}
 	index, err := c.bloomFilter.hashFunction(key, seed)
 	if err != nil {
 		return 0, err
@@ -105,10 +114,8 @@ func (c *ConventionalStorage[T]) SetBit(key T) error {
 	for _, seed := range c.seeds {
 		index, err := c.calculateBitIndex(key, seed)
 		if err != nil {
-			fmt.Println(err) // DEBUG
 			return err
 		}
-		// fmt.Printf("Setting bit at index %d for key %v using seed %d\n", index, key, seed) // DEBUG
 		c.bits[index] = true
 	}
 	return nil
@@ -122,7 +129,6 @@ func (c *ConventionalStorage[T]) CheckBit(key T) bool {
 	for _, seed := range c.seeds {
 		index, err := c.calculateBitIndex(key, seed)
 		if err != nil || !c.bits[index] {
-			// fmt.Printf("Bit at index %d for key %v using seed %d is not set\n", index, key, seed) // DEBUG
 			return false
 		}
 	}
@@ -130,17 +136,26 @@ func (c *ConventionalStorage[T]) CheckBit(key T) bool {
 }
 
 // BloomFilter holds the bit storage and hash functions
-type BloomFilter[T common.Hashable] struct {
+type BloomFilter[T any] struct {
 	Storage          Storage[T]
 	numHashFunctions int
 	seeds            []uint32
 	hashFunction     func(T, uint32) (uint64, error)
 	hashEnum         uint8
+	secretKey        *[common.SecretKeySize]byte
+	seedStrategy     SeedStrategy
+	keyEncoder       common.KeyEncoder[T]
+	codec            Codec
+	codecLevel       int
+	codecSet         bool
 	persistence      Persistence[T]
+	signingKey       ed25519.PrivateKey
+	trustedKeys      []ed25519.PublicKey
+	maxLoadBits      uint64
 }
 
 // NewBloomFilter creates a new BloomFilter, initially with no storage
-func NewBloomFilter[T common.Hashable]() *BloomFilter[T] {
+func NewBloomFilter[T any]() *BloomFilter[T] {
 	return &BloomFilter[T]{}
 }
 
@@ -155,8 +170,10 @@ func (bf *BloomFilter[T]) WithStorage(storage Storage[T]) (*BloomFilter[T], erro
 		s.seeds = bf.seeds
 		s.bloomFilter = bf
 	default:
-		err := errors.New("unsupported storage type")
-		return nil, err
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedStorage, storage)
+	}
+	if storage.(indexStorage).numBits() == 0 {
+		return nil, ErrEmptyStorage
 	}
 	bf.Storage = storage
 	return bf, nil
@@ -175,15 +192,36 @@ func (bf *BloomFilter[T]) WithStorage(storage Storage[T]) (*BloomFilter[T], erro
 // It picks the most memory efficient Storage option (which will almost always be BitPackingStorage unless an
 // tiny number of elements are expected to be stored in the Bloom Filter
 //
-// Finally, it selects Murmur3 as the hash function to be used
+// Finally, it selects Murmur3 as the hash function to be used, or SipHash if a secret key has been supplied with
+// WithSecretKey
+//
+// Any storage or hash functions already set are replaced; New rejects WithAutoConfigure combined with either.  Filters
+// needing more bits than WithMaxLoadBits allows (2^32 bits by default), so that they couldn't be loaded again, are
+// rejected with ErrTooLarge.
 func (bf *BloomFilter[T]) WithAutoConfigure(elements uint64, requestedErrorRate float64) (*BloomFilter[T], error) {
-	m := int(math.Ceil(-float64(elements) * math.Log(requestedErrorRate) / (math.Ln2 * math.Ln2)))
+	if elements == 0 {
+		return nil, errors.New("number of elements must be positive")
+	}
+	if !(requestedErrorRate > 0 && requestedErrorRate < 1) {
+		return nil, fmt.Errorf("error rate must be between 0 and 1, not %v", requestedErrorRate)
+	}
+	bits := math.Ceil(-float64(elements) * math.Log(requestedErrorRate) / (math.Ln2 * math.Ln2))
+	limit := min(bf.loadLimit(), maxConfigureBits)
+	if bits > float64(limit) {
+		return nil, fmt.Errorf("%w: %d elements at an error rate of %v need %.0f bits, more than the limit of %d",
+			ErrTooLarge, elements, requestedErrorRate, bits, limit)
+	}
+	m := int(bits)
 	k := int(math.Ceil((float64(m) / float64(elements)) * math.Ln2))
+	if m >= 64 && roundUpToNextPowerOfTwo(uint64(m)) > limit {
+		return nil, fmt.Errorf("%w: %d elements at an error rate of %v need %d bits of BitPackingStorage, more than "+
+			"the limit of %d", ErrTooLarge, elements, requestedErrorRate, roundUpToNextPowerOfTwo(uint64(m)), limit)
+	}
 
 	// Initialize the seeds array for hash functions
-	seeds := make([]uint32, k)
-	for i := range seeds {
-		seeds[i] = uint32(i + 1) // TODO: break this out to allow different methods of creating seed values
+	seeds, err := bf.getSeedStrategy().Seeds(k)
+	if err != nil {
+		return nil, err
 	}
 
 	var storage Storage[T]
@@ -209,45 +247,184 @@ func (bf *BloomFilter[T]) WithAutoConfigure(elements uint64, requestedErrorRate
 	bf.Storage = storage
 	bf.numHashFunctions = k
 	bf.seeds = seeds
-	bf.hashFunction = common.HashKeyMurmur3[T]
+	bf.hashEnum = common.Murmur3
+	if bf.secretKey != nil {
+		bf.hashEnum = common.SipHash
+	}
+	bf.hashFunction, _ = bf.hashFunctionFor(bf.hashEnum)
 
 	return bf, nil
 }
 
-// WithHashFunctions sets the number of hash functions to use and initializes the seeds
-func (bf *BloomFilter[T]) WithHashFunctions(num int, hashFunc uint8) *BloomFilter[T] {
-	bf.numHashFunctions = num
-	bf.seeds = make([]uint32, num)
-	for i := range bf.seeds {
-		bf.seeds[i] = uint32(i) // TODO: break this out to allow different methods of creating seed values
-	}
-
-	switch hashFunc {
-	case common.Murmur3:
-		bf.hashFunction = common.HashKeyMurmur3[T]
-	case common.Sha256:
-		bf.hashFunction = common.HashKeySha256[T]
-	case common.Sha512:
-		bf.hashFunction = common.HashKeySha512[T]
-	case common.SipHash:
-		bf.hashFunction = common.HashKeySipHash[T]
-	case common.XXhash:
-		bf.hashFunction = common.HashKeyXXhash[T]
-	default:
-		panic("invalid hash function, this is probably a bug") // BUG
+// WithHashFunctions sets the number of hash functions to use and initializes the seeds using the filter's SeedStrategy.
+// It returns an error if the number or hash function is invalid, or the seeds can't be generated.
+func (bf *BloomFilter[T]) WithHashFunctions(num int, hashFunc uint8) (*BloomFilter[T], error) {
+	if err := bf.setHashFunctions(num, hashFunc); err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
 
+// setHashFunctions sets the number of hash functions and the hash function, leaving the filter unchanged on error
+func (bf *BloomFilter[T]) setHashFunctions(num int, hashFunc uint8) error {
+	if num <= 0 || num > maxHashFunctions {
+		return fmt.Errorf("invalid number of hash functions: %d", num)
+	}
+	if bf.secretKey != nil && !common.SupportsSecretKey(hashFunc) {
+		return errors.New("hash function doesn't support a secret key, use SipHash, Sha256 or Sha512")
+	}
+	hashFunction, ok := bf.hashFunctionFor(hashFunc)
+	if !ok {
+		return fmt.Errorf("unsupported hash function %d", hashFunc)
 	}
+	seeds, err := bf.getSeedStrategy().Seeds(num)
+	if err != nil {
+		return fmt.Errorf("unable to generate seeds: %w", err)
+	}
+
+	bf.numHashFunctions = num
+	bf.seeds = seeds
+	bf.hashFunction = hashFunction
 	bf.hashEnum = hashFunc
+	bf.updateStorageSeeds()
+	return nil
+}
+
+// WithSeedStrategy sets the SeedStrategy used to generate the seeds for each hash function; by default sequential
+// seeds starting at 0 are used.  If the number of hash functions is already known the seeds are regenerated
+// immediately, otherwise they are generated by WithHashFunctions or WithAutoConfigure.
+//
+// When loading a persisted filter, the stored seeds are checked against the strategy with SeedStrategy.Verify.
+func (bf *BloomFilter[T]) WithSeedStrategy(strategy SeedStrategy) (*BloomFilter[T], error) {
+	if err := checkSeedStrategy(strategy); err != nil {
+		return nil, err
+	}
+	if bf.numHashFunctions == 0 {
+		bf.seedStrategy = strategy
+		return bf, nil
+	}
+
+	seeds, err := strategy.Seeds(bf.numHashFunctions)
+	if err != nil {
+		return nil, err
+	}
+	bf.seedStrategy = strategy
+	bf.seeds = seeds
+	bf.updateStorageSeeds()
+	return bf, nil
+}
 
+// getSeedStrategy returns the SeedStrategy chosen with WithSeedStrategy, or the default
+func (bf *BloomFilter[T]) getSeedStrategy() SeedStrategy {
+	if bf.seedStrategy == nil {
+		return defaultSeedStrategy
+	}
+	return bf.seedStrategy
+}
+
+// updateStorageSeeds shares the filter's seeds with its storage
+func (bf *BloomFilter[T]) updateStorageSeeds() {
 	switch storage := bf.Storage.(type) {
 	case *BitPackingStorage[T]:
 		storage.seeds = bf.seeds
 	case *ConventionalStorage[T]:
 		storage.seeds = bf.seeds
 	}
+}
+
+// WithSecretKey enables keyed hashing: the secret is mixed into every hash, so that an attacker who controls the keys
+// being added can't predict which bits they will set.  Only SipHash, Sha256 (as HMAC-SHA-256) and Sha512 (as
+// HMAC-SHA-512) support a secret key.
+//
+// The secret is never persisted.  A filter saved with a secret key can only be loaded by a BloomFilter which has been
+// given the same key.
+func (bf *BloomFilter[T]) WithSecretKey(secret [common.SecretKeySize]byte) (*BloomFilter[T], error) {
+	bf.secretKey = &secret
+	if bf.hashFunction == nil {
+		return bf, nil
+	}
+	if !common.SupportsSecretKey(bf.hashEnum) {
+		return nil, errors.New("hash function doesn't support a secret key, use SipHash, Sha256 or Sha512")
+	}
+	bf.hashFunction, _ = bf.hashFunctionFor(bf.hashEnum)
+	return bf, nil
+}
+
+// WithKeyEncoder sets the KeyEncoder used to turn keys into the bytes which are hashed.  Without one, keys are encoded
+// with common.EncodeKey, which handles the types in common.Hashable (and types derived from them) as well as keys
+// implementing common.KeyAppender or encoding.BinaryMarshaler.  Composite keys can use one of the tuple encoders in the
+// common package.
+func (bf *BloomFilter[T]) WithKeyEncoder(encoder common.KeyEncoder[T]) *BloomFilter[T] {
+	bf.keyEncoder = encoder
+	if bf.hashFunction != nil {
+		bf.hashFunction, _ = bf.hashFunctionFor(bf.hashEnum)
+	}
 	return bf
 }
 
+// hashFunctionFor returns a function which encodes a key with the filter's KeyEncoder and hashes it with the hash
+// function matching one of the hash enums found in the common package, or its keyed variant if the filter has a secret
+// key
+func (bf *BloomFilter[T]) hashFunctionFor(hashFunc uint8) (func(T, uint32) (uint64, error), bool) {
+	var hashBytes common.HashFunc
+	var ok bool
+	if bf.secretKey != nil {
+		hashBytes, ok = common.KeyedHashFuncFor(hashFunc, *bf.secretKey)
+	} else {
+		hashBytes, ok = common.HashFuncFor(hashFunc)
+	}
+	if !ok {
+		return nil, false
+	}
+
+	encoder := bf.keyEncoder
+	if encoder == nil {
+		encoder = common.DefaultKeyEncoder[T]()
+	}
+	return func(key T, seed uint32) (uint64, error) {
+		keyBytes, err := encoder.AppendKey(nil, key)
+		if err != nil {
+			return 0, err
+		}
+		return hashBytes(keyBytes, seed), nil
+	}, true
+}
+
+// Add adds key to the filter.  It is equivalent to Storage.SetBit, except that when the filter's persistence logs
+// inserts, as WALPersistence does, the insert is logged before it is applied.
+func (bf *BloomFilter[T]) Add(key T) error {
+	if bf.Storage == nil {
+		return ErrNoStorage
+	}
+	logger, ok := bf.persistence.(insertLogger[T])
+	if !ok {
+		return bf.Storage.SetBit(key)
+	}
+
+	storage, err := bf.indexStorage()
+	if err != nil {
+		return err
+	}
+	m := storage.numBits()
+	indexes := make([]uint64, 0, len(bf.seeds))
+	for _, seed := range bf.seeds {
+		hash, err := bf.hashFunction(key, seed)
+		if err != nil {
+			return err
+		}
+		indexes = append(indexes, hash%m)
+	}
+	return bf.logInsert(logger, storage, indexes)
+}
+
+// Contains reports whether key may be present in the filter; it is equivalent to Storage.CheckBit
+func (bf *BloomFilter[T]) Contains(key T) bool {
+	if bf.Storage == nil {
+		return false
+	}
+	return bf.Storage.CheckBit(key)
+}
+
 // WithPersistence sets the persistence mechanism for the BloomFilter
 func (bf *BloomFilter[T]) WithPersistence(persistence Persistence[T]) *BloomFilter[T] {
 	bf.persistence = persistence
@@ -259,7 +436,7 @@ func (bf *BloomFilter[T]) WithPersistence(persistence Persistence[T]) *BloomFilt
 // SavePersistence saves the BloomFilter data using the selected persistence mechanism
 func (bf *BloomFilter[T]) SavePersistence() error {
 	if bf.persistence == nil {
-		return errors.New("persistence mechanism not set")
+		return ErrNoPersistence
 	}
 	return bf.persistence.Save(bf)
 }
@@ -267,11 +444,30 @@ func (bf *BloomFilter[T]) SavePersistence() error {
 // LoadPersistence loads the BloomFilter data using the selected persistence mechanism
 func (bf *BloomFilter[T]) LoadPersistence() error {
 	if bf.persistence == nil {
-		return errors.New("persistence mechanism not set")
+		return ErrNoPersistence
 	}
 	return bf.persistence.Load(bf)
 }
 
+// clone returns a copy of the filter whose storage can be modified independently of the original
+func (bf *BloomFilter[T]) clone() *BloomFilter[T] {
+	c := *bf
+	switch storage := bf.Storage.(type) {
+	case *BitPackingStorage[T]:
+		cs := *storage
+		cs.bits = append([]uint64(nil), storage.bits...)
+		cs.bloomFilter = &c
+		cs.dirty = nil
+		c.Storage = &cs
+	case *ConventionalStorage[T]:
+		cs := *storage
+		cs.bits = append([]bool(nil), storage.bits...)
+		cs.bloomFilter = &c
+		c.Storage = &cs
+	}
+	return &c
+}
+
 // roundUpToNextPowerOfTwo finds the next power of two value for a given number
 func roundUpToNextPowerOfTwo(x uint64) uint64 {
 	if x < 1 {
@@ -0,0 +1,94 @@
+package bloom
+
+import (
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newTestFilter returns a filter with numHashes hash functions of hashFunc and the given storage
+func newTestFilter[T any](tb testing.TB, numHashes int, hashFunc uint8, storage Storage[T]) *BloomFilter[T] {
+	tb.Helper()
+	bf, err := NewBloomFilter[T]().WithHashFunctions(numHashes, hashFunc)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if bf, err = bf.WithStorage(storage); err != nil {
+		tb.Fatal(err)
+	}
+	return bf
+}
+
+var benchmarkHashFunctions = []struct {
+	name     string
+	hashFunc uint8
+}{
+	{"Murmur3", common.Murmur3},
+	{"Sha256", common.Sha256},
+	{"Sha512", common.Sha512},
+	{"SipHash", common.SipHash},
+	{"XXhash", common.XXhash},
+	{"WyHash", common.WyHash},
+	{"FNV1a", common.FNV1a},
+	{"CRC32C", common.CRC32C},
+	{"MapHash", common.MapHash},
+}
+
+func BenchmarkBitPackingStorage_SetBit(b *testing.B) {
+	for _, bb := range benchmarkHashFunctions {
+		b.Run(bb.name, func(b *testing.B) {
+			bf := newTestFilter(b, 10, bb.hashFunc, NewBitPackingStorage[int](1_000_000, nil))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = bf.Storage.SetBit(i)
+			}
+		})
+	}
+}
+
+func BenchmarkBitPackingStorage_CheckBit(b *testing.B) {
+	for _, bb := range benchmarkHashFunctions {
+		b.Run(bb.name, func(b *testing.B) {
+			bf := newTestFilter(b, 10, bb.hashFunc, NewBitPackingStorage[int](1_000_000, nil))
+			for i := 0; i < 1000; i++ {
+				_ = bf.Storage.SetBit(i)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bf.Storage.CheckBit(i)
+			}
+		})
+	}
+}
+
+func TestBloomFilter_CompositeKeys(t *testing.T) {
+	type key = common.Tuple3[string, uint64, time.Time]
+	encoder := common.Tuple3KeyEncoder(common.DefaultKeyEncoder[string](), common.DefaultKeyEncoder[uint64](),
+		common.TimeKeyEncoder())
+
+	bf := newTestFilter(t, 5, common.XXhash, NewBitPackingStorage[key](4096, nil)).WithKeyEncoder(encoder)
+
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	if err := bf.Storage.SetBit(key{First: "tenant", Second: 42, Third: day}); err != nil {
+		t.Fatalf("SetBit() error = %v", err)
+	}
+	if !bf.Storage.CheckBit(key{First: "tenant", Second: 42, Third: day}) {
+		t.Error("CheckBit() of an added key = false, want true")
+	}
+	if bf.Storage.CheckBit(key{First: "tenant", Second: 42, Third: day.AddDate(0, 0, 1)}) {
+		t.Error("CheckBit() of a key that wasn't added = true, want false")
+	}
+}
+
+func TestBloomFilter_BinaryMarshalerKeys(t *testing.T) {
+	bf, _ := NewBloomFilter[netip.Addr]().WithAutoConfigure(100, 0.01)
+	if err := bf.Storage.SetBit(netip.MustParseAddr("2001:db8::1")); err != nil {
+		t.Fatalf("SetBit() error = %v", err)
+	}
+	if !bf.Storage.CheckBit(netip.MustParseAddr("2001:db8::1")) {
+		t.Error("CheckBit() of an added address = false, want true")
+	}
+}
@@ -0,0 +1,438 @@
+package bloom
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// The file written by CheckpointPersistence is laid out as follows.  All integers are big-endian.
+//
+//	magic       4 bytes   "GCBC"
+//	version     uint8     currently 1
+//	flags       uint8     bit 0 set while a checkpoint is being written
+//	page size   uint32    bytes per page, currently 4096
+//	metadata    uint32    length, followed by the filter's header as described in format.go, and a uint32 CRC-32C of
+//	                      the header
+//	page table  uint32    CRC-32C of each page
+//	pages       the filter's payload as described in format.go, uncompressed, starting at the first multiple of the
+//	            page size after the page table; the last page may be short
+//
+// A checkpoint overwrites only the pages changed since the previous one, followed by their page table entries.  The
+// in-progress flag is set and synced before the pages are written, and cleared once they and the page table have been
+// synced.  A filter's bits are only ever set, so any mixture of a page's old and new contents left by an interrupted
+// checkpoint is still a valid filter; when the flag is found set, pages failing their checksum are accepted and their
+// page table entries repaired.  Without the flag, a page failing its checksum means the file is corrupt.
+
+const (
+	checkpointMagic          = "GCBC"
+	checkpointVersion        = uint8(1)
+	checkpointFlagInProgress = uint8(1 << 0)
+	checkpointFixedSize      = 4 + 1 + 1 + 4 + 4
+	checkpointFlagsOffset    = 5
+
+	// dirtyPageWords is the number of BitPackingStorage words in each page whose changes are tracked
+	dirtyPageWords = persist.PageSize / 8
+	// checkpointPageSize is the size of each page in bytes, 4 KiB
+	checkpointPageSize = 8 * dirtyPageWords
+
+	// maxCheckpointMetadata bounds the filter header accepted from a checkpoint file
+	maxCheckpointMetadata = 1 << 20
+)
+
+// dirtyTracker is a bitmap of the pages of a BitPackingStorage changed since it was created or last reset.  Each
+// consumer of the changes, such as a CheckpointPersistence, has its own, so that one resetting it doesn't hide changes
+// from the others.
+type dirtyTracker []uint64
+
+// trackDirty starts tracking the pages changed in the storage, with none yet changed, for one consumer
+func (b *BitPackingStorage[T]) trackDirty() *dirtyTracker {
+	pages := (b.bitsLength + dirtyPageWords - 1) / dirtyPageWords
+	dirty := make(dirtyTracker, (pages+63)/64)
+	b.dirty = append(b.dirty, &dirty)
+	return &dirty
+}
+
+// untrackDirty stops updating dirty, if it is tracking the storage
+func (b *BitPackingStorage[T]) untrackDirty(dirty *dirtyTracker) {
+	b.dirty = slices.DeleteFunc(b.dirty, func(d *dirtyTracker) bool { return d == dirty })
+}
+
+// tracksDirty reports whether dirty is tracking the storage
+func (b *BitPackingStorage[T]) tracksDirty(dirty *dirtyTracker) bool {
+	return dirty != nil && slices.Contains(b.dirty, dirty)
+}
+
+// markDirty records that the page holding word has changed, if changes are being tracked
+func (b *BitPackingStorage[T]) markDirty(word uint64) {
+	page := word / dirtyPageWords
+	for _, dirty := range b.dirty {
+		(*dirty)[page/64] |= 1 << (page % 64)
+	}
+}
+
+// pages returns the pages changed since tracking started or was last reset, in ascending order
+func (d *dirtyTracker) pages() []uint64 {
+	var pages []uint64
+	for i, word := range *d {
+		for word != 0 {
+			pages = append(pages, uint64(i)*64+uint64(bits.TrailingZeros64(word)))
+			word &= word - 1
+		}
+	}
+	return pages
+}
+
+// reset forgets the pages changed so far
+func (d *dirtyTracker) reset() {
+	clear(*d)
+}
+
+// CheckpointPersistence saves BitPackingStorage filters to a file which is updated in place: after the first save,
+// each save writes only the 4 KiB pages of the filter changed since the previous one, so its cost scales with the
+// number of changes rather than the size of the filter.  The file format is described at the top of checkpoint.go.
+//
+// Changes are tracked for the storage last saved or loaded, and the file is kept open between saves; Close closes
+// it.  Saving a filter with different storage, or one not loaded by this CheckpointPersistence, rewrites the whole
+// file.  AutoPersist saves the same copy of a filter each time, so its saves are also incremental.
+type CheckpointPersistence[T any] struct {
+	path     string
+	fileMode os.FileMode
+
+	file      *os.File
+	storage   *BitPackingStorage[T] // the storage whose changes are tracked against file
+	dirty     *dirtyTracker         // the pages of storage changed since they were last written to file
+	layout    checkpointLayout
+	lastPages int // pages written by the last save
+}
+
+// checkpointLayout locates the parts of a checkpoint file
+type checkpointLayout struct {
+	payloadSize uint64
+	numPages    uint64
+	tableOffset int64
+	pagesOffset int64
+}
+
+// NewCheckpointPersistence creates a CheckpointPersistence keeping the filter in the file at path
+func NewCheckpointPersistence[T any](path string) *CheckpointPersistence[T] {
+	return &CheckpointPersistence[T]{path: path, fileMode: DefaultFileMode}
+}
+
+// WithFileMode sets the permissions given to the file when it is written in full
+func (cp *CheckpointPersistence[T]) WithFileMode(mode os.FileMode) *CheckpointPersistence[T] {
+	cp.fileMode = mode
+	return cp
+}
+
+// Save writes the pages changed since the last save or load, or the whole filter if its changes aren't being tracked
+func (cp *CheckpointPersistence[T]) Save(bf *BloomFilter[T]) error {
+	if err := bf.checkUnwrapped(); err != nil {
+		return fmt.Errorf("error saving bloom filter: %w", err)
+	}
+	storage, ok := bf.Storage.(*BitPackingStorage[T])
+	if !ok {
+		return fmt.Errorf("%w: checkpoints require BitPackingStorage", ErrUnsupportedStorage)
+	}
+	if cp.file == nil || cp.storage != storage || !storage.tracksDirty(cp.dirty) {
+		if err := cp.writeFull(bf, storage); err != nil {
+			return fmt.Errorf("error saving bloom filter: %w", err)
+		}
+		return nil
+	}
+	if err := cp.writeDirty(storage); err != nil {
+		return fmt.Errorf("error saving bloom filter: %w", err)
+	}
+	return nil
+}
+
+// Load reads the filter from the file, and starts tracking its changes
+func (cp *CheckpointPersistence[T]) Load(bf *BloomFilter[T]) error {
+	if err := bf.checkUnwrapped(); err != nil {
+		return fmt.Errorf("error loading bloom filter: %w", err)
+	}
+	f, err := os.OpenFile(cp.path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("error loading bloom filter: %w", err)
+	}
+	if err := cp.read(bf, f); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error loading bloom filter: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file, ending the tracking of changes
+func (cp *CheckpointPersistence[T]) Close() error {
+	if cp.file == nil {
+		return nil
+	}
+	err := cp.file.Close()
+	cp.file = nil
+	cp.track(nil)
+	return err
+}
+
+// writeFull writes the whole filter to a temporary file which then replaces the file, and keeps it open
+func (cp *CheckpointPersistence[T]) writeFull(bf *BloomFilter[T], storage *BitPackingStorage[T]) (err error) {
+	header, _, err := bf.fileHeader()
+	if err != nil {
+		return err
+	}
+	var metadata bytes.Buffer
+	if err := writeHeader(&metadata, header); err != nil {
+		return err
+	}
+	layout := newCheckpointLayout(metadata.Len(), storage.payloadSize())
+
+	dir, name := filepath.Split(cp.path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if err = f.Chmod(cp.fileMode); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	prefix := make([]byte, 0, layout.tableOffset)
+	prefix = append(prefix, checkpointMagic...)
+	prefix = append(prefix, checkpointVersion, 0)
+	prefix = binary.BigEndian.AppendUint32(prefix, checkpointPageSize)
+	prefix = binary.BigEndian.AppendUint32(prefix, uint32(metadata.Len()))
+	prefix = append(prefix, metadata.Bytes()...)
+	prefix = binary.BigEndian.AppendUint32(prefix, crc32.Checksum(metadata.Bytes(), castagnoli))
+	if _, err = w.Write(prefix); err != nil {
+		return err
+	}
+	// the page table is filled in once the pages have been written
+	if _, err = w.Write(make([]byte, layout.pagesOffset-layout.tableOffset)); err != nil {
+		return err
+	}
+
+	table := make([]byte, 4*layout.numPages)
+	page := make([]byte, checkpointPageSize)
+	for i := uint64(0); i < layout.numPages; i++ {
+		p := page[:layout.pageLen(i)]
+		storage.readPayload(p, i*checkpointPageSize)
+		binary.BigEndian.PutUint32(table[4*i:], crc32.Checksum(p, castagnoli))
+		if _, err = w.Write(p); err != nil {
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(table, layout.tableOffset); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), cp.path); err != nil {
+		return err
+	}
+	if err = persist.SyncDirectory(dir); err != nil {
+		return err
+	}
+
+	if cp.file != nil {
+		_ = cp.file.Close()
+	}
+	cp.file = f
+	cp.track(storage)
+	cp.layout = layout
+	cp.lastPages = int(layout.numPages)
+	return nil
+}
+
+// writeDirty overwrites the pages changed since the last checkpoint, and their page table entries
+func (cp *CheckpointPersistence[T]) writeDirty(storage *BitPackingStorage[T]) error {
+	pages := cp.dirty.pages()
+	cp.lastPages = 0
+	if len(pages) == 0 {
+		return nil
+	}
+
+	if err := cp.setFlags(checkpointFlagInProgress); err != nil {
+		return err
+	}
+	page := make([]byte, checkpointPageSize)
+	entries := make([]byte, 0, 4*len(pages))
+	for i, n := range pages {
+		p := page[:cp.layout.pageLen(n)]
+		storage.readPayload(p, n*checkpointPageSize)
+		if _, err := cp.file.WriteAt(p, cp.layout.pagesOffset+int64(n)*checkpointPageSize); err != nil {
+			return err
+		}
+
+		// consecutive page table entries are written together
+		entries = binary.BigEndian.AppendUint32(entries, crc32.Checksum(p, castagnoli))
+		if i+1 == len(pages) || pages[i+1] != n+1 {
+			first := n + 1 - uint64(len(entries)/4)
+			if _, err := cp.file.WriteAt(entries, cp.layout.tableOffset+4*int64(first)); err != nil {
+				return err
+			}
+			entries = entries[:0]
+		}
+	}
+	if err := cp.file.Sync(); err != nil {
+		return err
+	}
+	if err := cp.setFlags(0); err != nil {
+		return err
+	}
+
+	cp.dirty.reset()
+	cp.lastPages = len(pages)
+	return nil
+}
+
+// track starts tracking the changes to storage, if it isn't nil, and stops tracking the storage tracked before
+func (cp *CheckpointPersistence[T]) track(storage *BitPackingStorage[T]) {
+	if cp.storage != nil {
+		cp.storage.untrackDirty(cp.dirty)
+	}
+	cp.storage, cp.dirty = storage, nil
+	if storage != nil {
+		cp.dirty = storage.trackDirty()
+	}
+}
+
+// setFlags writes and syncs the file's flags
+func (cp *CheckpointPersistence[T]) setFlags(flags uint8) error {
+	if _, err := cp.file.WriteAt([]byte{flags}, checkpointFlagsOffset); err != nil {
+		return err
+	}
+	return cp.file.Sync()
+}
+
+// read loads the filter from f into bf, repairing the page table after an interrupted checkpoint
+func (cp *CheckpointPersistence[T]) read(bf *BloomFilter[T], f *os.File) error {
+	r := bufio.NewReader(f)
+	var fixed [checkpointFixedSize]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return readError("checkpoint header", err)
+	}
+	if string(fixed[:4]) != checkpointMagic {
+		return corruptf("not a checkpoint file: bad magic bytes")
+	}
+	if fixed[4] != checkpointVersion {
+		return incompatiblef("unsupported checkpoint format version %d", fixed[4])
+	}
+	flags := fixed[checkpointFlagsOffset]
+	if pageSize := binary.BigEndian.Uint32(fixed[6:]); pageSize != checkpointPageSize {
+		return incompatiblef("unsupported checkpoint page size %d", pageSize)
+	}
+	metadataLen := binary.BigEndian.Uint32(fixed[10:])
+	if metadataLen > maxCheckpointMetadata {
+		return corruptf("checkpoint metadata is too large (%d bytes)", metadataLen)
+	}
+
+	metadata := make([]byte, metadataLen+4)
+	if _, err := io.ReadFull(r, metadata); err != nil {
+		return readError("checkpoint metadata", err)
+	}
+	metadata, checksum := metadata[:metadataLen], binary.BigEndian.Uint32(metadata[metadataLen:])
+	if crc32.Checksum(metadata, castagnoli) != checksum {
+		return corruptf("checkpoint metadata checksum mismatch")
+	}
+	header, err := readHeader(bytes.NewReader(metadata))
+	if err != nil {
+		return err
+	}
+	if header.storageType != storageTypeBitPacking {
+		return corruptf("checkpoint holds a filter without BitPackingStorage")
+	}
+	s, hashFunction, err := bf.storageFor(header)
+	if err != nil {
+		return err
+	}
+	storage := s.(*BitPackingStorage[T])
+	layout := newCheckpointLayout(int(metadataLen), storage.payloadSize())
+
+	table := make([]byte, 4*layout.numPages)
+	if _, err := io.ReadFull(r, table); err != nil {
+		return readError("checkpoint page table", err)
+	}
+	if _, err := io.CopyN(io.Discard, r, layout.pagesOffset-layout.tableOffset-int64(len(table))); err != nil {
+		return readError("checkpoint pages", err)
+	}
+
+	var repaired []uint64
+	page := make([]byte, checkpointPageSize)
+	for i := uint64(0); i < layout.numPages; i++ {
+		p := page[:layout.pageLen(i)]
+		if _, err := io.ReadFull(r, p); err != nil {
+			return readError("checkpoint pages", err)
+		}
+		if sum := crc32.Checksum(p, castagnoli); sum != binary.BigEndian.Uint32(table[4*i:]) {
+			if flags&checkpointFlagInProgress == 0 {
+				return corruptf("checkpoint page %d checksum mismatch", i)
+			}
+			binary.BigEndian.PutUint32(table[4*i:], sum)
+			repaired = append(repaired, i)
+		}
+		storage.writePayload(p, i*checkpointPageSize)
+	}
+
+	if flags&checkpointFlagInProgress != 0 {
+		for _, i := range repaired {
+			if _, err := f.WriteAt(table[4*i:4*i+4], layout.tableOffset+4*int64(i)); err != nil {
+				return err
+			}
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt([]byte{0}, checkpointFlagsOffset); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if cp.file != nil {
+		_ = cp.file.Close()
+	}
+	cp.file = f
+	cp.track(storage)
+	cp.layout = layout
+	bf.commitLoad(header, storage, hashFunction)
+	return nil
+}
+
+func newCheckpointLayout(metadataLen int, payloadSize uint64) checkpointLayout {
+	numPages := (payloadSize + checkpointPageSize - 1) / checkpointPageSize
+	tableOffset := int64(checkpointFixedSize + metadataLen + 4)
+	tableEnd := tableOffset + 4*int64(numPages)
+	return checkpointLayout{
+		payloadSize: payloadSize,
+		numPages:    numPages,
+		tableOffset: tableOffset,
+		pagesOffset: (tableEnd + checkpointPageSize - 1) / checkpointPageSize * checkpointPageSize,
+	}
+}
+
+// pageLen returns the number of bytes in page n
+func (l checkpointLayout) pageLen(n uint64) int {
+	return int(min(checkpointPageSize, l.payloadSize-n*checkpointPageSize))
+}
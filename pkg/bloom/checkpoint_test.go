@@ -0,0 +1,104 @@
+package bloom
+
+import (
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestCheckpointPersistence_Incremental(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.ckpt")
+	cp := NewCheckpointPersistence[string](path)
+	defer cp.Close()
+	bf := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](1<<24, nil)).WithPersistence(cp)
+
+	if err := bf.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+	if cp.lastPages != 512 {
+		t.Errorf("first save wrote %d pages, want all 512", cp.lastPages)
+	}
+	info, _ := os.Stat(path)
+
+	for _, key := range []string{"spam", "eggs", "ham"} {
+		_ = bf.Add(key)
+	}
+	if err := bf.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+	if cp.lastPages == 0 || cp.lastPages > 15 {
+		t.Errorf("checkpoint wrote %d pages, want between 1 and 15 for 3 keys", cp.lastPages)
+	}
+	if err := bf.SavePersistence(); err != nil || cp.lastPages != 0 {
+		t.Errorf("unchanged checkpoint wrote %d pages (error %v), want 0", cp.lastPages, err)
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Errorf("checkpoint changed the file size from %d to %d", info.Size(), after.Size())
+	}
+
+	other := NewCheckpointPersistence[string](path)
+	defer other.Close()
+	loaded := NewBloomFilter[string]().WithPersistence(other)
+	if err := loaded.LoadPersistence(); err != nil {
+		t.Fatalf("LoadPersistence() error = %v", err)
+	}
+	for _, key := range []string{"spam", "eggs", "ham"} {
+		if !loaded.Contains(key) {
+			t.Errorf("Contains(%q) = false after loading", key)
+		}
+	}
+
+	// changes to a loaded filter are also checkpointed incrementally
+	_ = loaded.Add("spanish inquisition")
+	if err := loaded.SavePersistence(); err != nil || other.lastPages == 0 || other.lastPages > 5 {
+		t.Errorf("checkpoint after loading wrote %d pages (error %v), want between 1 and 5", other.lastPages, err)
+	}
+}
+
+func TestCheckpointPersistence_InterruptedCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.ckpt")
+	cp := NewCheckpointPersistence[string](path)
+	bf := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](1<<16, nil)).WithPersistence(cp)
+	for i := 0; i < 100; i++ {
+		_ = bf.Add(strconv.Itoa(i))
+	}
+	_ = bf.SavePersistence()
+	_ = cp.Close()
+
+	// set a bit in the last page without updating its page table entry, as a crash part way through a checkpoint would
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] |= 0x80
+	_ = os.WriteFile(path, data, 0o644)
+	if err := NewBloomFilter[string]().WithPersistence(NewCheckpointPersistence[string](path)).LoadPersistence(); err == nil {
+		t.Fatalf("LoadPersistence() of a corrupt page succeeded, want error")
+	}
+
+	data[checkpointFlagsOffset] = checkpointFlagInProgress
+	_ = os.WriteFile(path, data, 0o644)
+	repair := NewCheckpointPersistence[string](path)
+	loaded := NewBloomFilter[string]().WithPersistence(repair)
+	if err := loaded.LoadPersistence(); err != nil {
+		t.Fatalf("LoadPersistence() after an interrupted checkpoint error = %v", err)
+	}
+	_ = repair.Close()
+	for i := 0; i < 100; i++ {
+		if !loaded.Contains(strconv.Itoa(i)) {
+			t.Fatalf("Contains(%d) = false after repair", i)
+		}
+	}
+
+	// the page table was repaired and the flag cleared
+	if err := NewBloomFilter[string]().WithPersistence(NewCheckpointPersistence[string](path)).LoadPersistence(); err != nil {
+		t.Errorf("LoadPersistence() after repair error = %v", err)
+	}
+}
+
+func TestCheckpointPersistence_ConventionalStorage(t *testing.T) {
+	cp := NewCheckpointPersistence[string](filepath.Join(t.TempDir(), "filter.ckpt"))
+	bf := newTestFilter(t, 5, common.Murmur3, NewConventionalStorage[string](64, nil))
+	if err := cp.Save(bf); err == nil {
+		t.Errorf("Save() of ConventionalStorage succeeded, want error")
+	}
+}
@@ -0,0 +1,298 @@
+package bloom
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"math/bits"
+)
+
+// Codec selects the compression applied to a filter's bits when it is persisted.  The codec is recorded in the file
+// header, so loading a filter never requires knowing which codec it was saved with.
+type Codec uint8
+
+const (
+	// CodecNone stores the bits uncompressed; the fastest choice for filters which are close to half full, as their
+	// bits are effectively random
+	CodecNone Codec = 0
+	// CodecGzip uses compress/gzip.  It is the default, and was the only codec before codecs became selectable.
+	CodecGzip Codec = 1
+	// CodecZstd uses Zstandard, which compresses better than gzip in a fraction of the time
+	CodecZstd Codec = 2
+	// CodecS2 uses S2, an extension of Snappy trading compression ratio for speed
+	CodecS2 Codec = 3
+	// CodecSparse run-length encodes the gaps between set bits, which suits filters holding far fewer keys than they
+	// were sized for.  Blocks which wouldn't shrink are stored as they are.
+	CodecSparse Codec = 4
+)
+
+// DefaultCompressionLevel selects the default level of whichever codec is in use
+const DefaultCompressionLevel = 0
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecZstd:
+		return "zstd"
+	case CodecS2:
+		return "s2"
+	case CodecSparse:
+		return "sparse"
+	default:
+		return fmt.Sprintf("Codec(%d)", uint8(c))
+	}
+}
+
+// WithCodec sets the codec, and its compression level, used when the filter is persisted.  The level is interpreted by
+// the codec: 1 (fastest) to 9 (smallest) for gzip, 1 to 22 as for the zstd command for zstd, and 1 (better) or 2
+// (best) for S2.  DefaultCompressionLevel selects the codec's default, and levels are ignored by CodecNone and
+// CodecSparse.
+func (bf *BloomFilter[T]) WithCodec(codec Codec, level int) *BloomFilter[T] {
+	bf.codec = codec
+	bf.codecLevel = level
+	bf.codecSet = true
+	return bf
+}
+
+// sparse block modes, stored as the first byte of each CodecSparse block
+const (
+	sparseModeRaw  = uint8(0)
+	sparseModeGaps = uint8(1)
+)
+
+// blockEncoder compresses payload blocks, reusing its buffer and compressor between blocks
+type blockEncoder struct {
+	codec       Codec
+	level       int
+	buf         bytes.Buffer
+	gzipWriter  *gzip.Writer
+	zstdEncoder *zstd.Encoder
+	scratch     []byte
+}
+
+func newBlockEncoder(codec Codec, level int) (*blockEncoder, error) {
+	e := &blockEncoder{codec: codec, level: level}
+	switch codec {
+	case CodecNone, CodecS2, CodecSparse:
+	case CodecGzip:
+		if level == DefaultCompressionLevel {
+			level = gzip.DefaultCompression
+		}
+		gzipWriter, err := gzip.NewWriterLevel(&e.buf, level)
+		if err != nil {
+			return nil, err
+		}
+		e.gzipWriter = gzipWriter
+	case CodecZstd:
+		options := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != DefaultCompressionLevel {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		zstdEncoder, err := zstd.NewWriter(nil, options...)
+		if err != nil {
+			return nil, err
+		}
+		e.zstdEncoder = zstdEncoder
+	default:
+		return nil, fmt.Errorf("unsupported codec %d", uint8(codec))
+	}
+	return e, nil
+}
+
+// encode compresses raw with the encoder's codec; the result is only valid until the next call
+func (e *blockEncoder) encode(raw []byte) ([]byte, error) {
+	switch e.codec {
+	case CodecNone:
+		return raw, nil
+	case CodecGzip:
+		e.buf.Reset()
+		e.gzipWriter.Reset(&e.buf)
+		if _, err := e.gzipWriter.Write(raw); err != nil {
+			return nil, err
+		}
+		if err := e.gzipWriter.Close(); err != nil {
+			return nil, err
+		}
+		return e.buf.Bytes(), nil
+	case CodecZstd:
+		e.scratch = e.zstdEncoder.EncodeAll(raw, e.scratch[:0])
+		return e.scratch, nil
+	case CodecS2:
+		e.scratch = e.scratch[:cap(e.scratch)]
+		if len(e.scratch) < s2.MaxEncodedLen(len(raw)) {
+			e.scratch = make([]byte, s2.MaxEncodedLen(len(raw)))
+		}
+		switch e.level {
+		case 1:
+			return s2.EncodeBetter(e.scratch, raw), nil
+		case 2:
+			return s2.EncodeBest(e.scratch, raw), nil
+		default:
+			return s2.Encode(e.scratch, raw), nil
+		}
+	case CodecSparse:
+		e.scratch = encodeSparse(e.scratch[:0], raw)
+		return e.scratch, nil
+	default:
+		return nil, fmt.Errorf("unsupported codec %d", uint8(e.codec))
+	}
+}
+
+func (e *blockEncoder) close() {
+	if e.zstdEncoder != nil {
+		e.zstdEncoder.Close()
+	}
+}
+
+// blockDecoder decompresses payload blocks, reusing its decompressor between blocks
+type blockDecoder struct {
+	codec       Codec
+	gzipReader  *gzip.Reader
+	zstdDecoder *zstd.Decoder
+}
+
+func newBlockDecoder(codec Codec) (*blockDecoder, error) {
+	d := &blockDecoder{codec: codec}
+	switch codec {
+	case CodecNone, CodecGzip, CodecS2, CodecSparse:
+	case CodecZstd:
+		zstdDecoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(payloadBlockSize))
+		if err != nil {
+			return nil, err
+		}
+		d.zstdDecoder = zstdDecoder
+	default:
+		return nil, fmt.Errorf("unsupported codec %d", uint8(codec))
+	}
+	return d, nil
+}
+
+// decode decompresses block into raw, which must be exactly the expected decompressed size
+func (d *blockDecoder) decode(block []byte, raw []byte) error {
+	switch d.codec {
+	case CodecNone:
+		if len(block) != len(raw) {
+			return errors.New("payload block has the wrong length")
+		}
+		copy(raw, block)
+		return nil
+	case CodecGzip:
+		var err error
+		if d.gzipReader == nil {
+			d.gzipReader, err = gzip.NewReader(bytes.NewReader(block))
+		} else {
+			err = d.gzipReader.Reset(bytes.NewReader(block))
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(d.gzipReader, raw); err != nil {
+			return fmt.Errorf("payload block is truncated: %w", err)
+		}
+		if n, _ := d.gzipReader.Read(make([]byte, 1)); n != 0 {
+			return errors.New("payload block is longer than expected")
+		}
+		return nil
+	case CodecZstd:
+		decoded, err := d.zstdDecoder.DecodeAll(block, raw[:0])
+		if err != nil {
+			return err
+		}
+		if len(decoded) != len(raw) || &decoded[0] != &raw[0] {
+			return errors.New("payload block has the wrong length")
+		}
+		return nil
+	case CodecS2:
+		decodedLen, err := s2.DecodedLen(block)
+		if err != nil {
+			return err
+		}
+		if decodedLen != len(raw) {
+			return errors.New("payload block has the wrong length")
+		}
+		_, err = s2.Decode(raw, block)
+		return err
+	case CodecSparse:
+		return decodeSparse(block, raw)
+	default:
+		return fmt.Errorf("unsupported codec %d", uint8(d.codec))
+	}
+}
+
+func (d *blockDecoder) close() {
+	if d.zstdDecoder != nil {
+		d.zstdDecoder.Close()
+	}
+}
+
+// encodeSparse appends the sparse encoding of raw to dst: a mode byte followed either by uvarint gaps between set bits
+// (the first gap counting from bit -1) or, if that would be no smaller, by raw itself
+func encodeSparse(dst []byte, raw []byte) []byte {
+	// every gap takes at least a byte, so a block with more set bits than bytes can't shrink
+	setBits := 0
+	for _, b := range raw {
+		setBits += bits.OnesCount8(b)
+	}
+	if setBits >= len(raw) {
+		dst = append(dst, sparseModeRaw)
+		return append(dst, raw...)
+	}
+
+	dst = append(dst, sparseModeGaps)
+	last := -1
+	for i, b := range raw {
+		for b != 0 {
+			position := i*8 + bits.TrailingZeros8(b)
+			dst = binary.AppendUvarint(dst, uint64(position-last))
+			last = position
+			b &= b - 1
+			if len(dst) > len(raw) {
+				dst = append(dst[:0], sparseModeRaw)
+				return append(dst, raw...)
+			}
+		}
+	}
+	return dst
+}
+
+// decodeSparse reverses encodeSparse into raw
+func decodeSparse(block []byte, raw []byte) error {
+	if len(block) == 0 {
+		return errors.New("sparse payload block is empty")
+	}
+	switch block[0] {
+	case sparseModeRaw:
+		if len(block)-1 != len(raw) {
+			return errors.New("payload block has the wrong length")
+		}
+		copy(raw, block[1:])
+		return nil
+	case sparseModeGaps:
+		clear(raw)
+		position := int64(-1)
+		for rest := block[1:]; len(rest) > 0; {
+			gap, n := binary.Uvarint(rest)
+			if n <= 0 || gap == 0 || gap > uint64(len(raw))*8 {
+				return errors.New("sparse payload block is corrupt")
+			}
+			rest = rest[n:]
+			position += int64(gap)
+			if position >= int64(len(raw))*8 {
+				return errors.New("sparse payload block sets a bit outside the block")
+			}
+			raw[position/8] |= 1 << (position % 8)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown sparse block mode %d", block[0])
+	}
+}
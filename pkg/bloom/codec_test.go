@@ -0,0 +1,127 @@
+package bloom
+
+import (
+	"bytes"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+var allCodecs = []Codec{CodecNone, CodecGzip, CodecZstd, CodecS2, CodecSparse}
+
+// filledFilter returns a filter of numBits bits with, on average, a fraction of them set at random
+func filledFilter(tb testing.TB, numBits uint64, fraction float64) *BloomFilter[int] {
+	bf := newTestFilter(tb, 7, common.XXhash, NewBitPackingStorage[int](numBits, nil))
+	storage := bf.Storage.(*BitPackingStorage[int])
+	rng := rand.New(rand.NewPCG(1, 2))
+	// setting n random bits of m leaves 1 - e^(-n/m) of them set
+	sets := uint64(-math.Log(1-fraction) * float64(numBits))
+	for i := uint64(0); i < sets; i++ {
+		storage.setIndex(rng.Uint64N(numBits))
+	}
+	return bf
+}
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	for _, codec := range allCodecs {
+		for _, fraction := range []float64{0, 0.001, 0.5} {
+			bf := filledFilter(t, 1<<24, fraction).WithCodec(codec, DefaultCompressionLevel)
+			data, err := bf.MarshalBinary()
+			if err != nil {
+				t.Fatalf("%v: MarshalBinary() error = %v", codec, err)
+			}
+			if got := Codec(data[8]); got != codec {
+				t.Errorf("%v: header records codec %v", codec, got)
+			}
+
+			loaded := NewBloomFilter[int]()
+			if err := loaded.UnmarshalBinary(data); err != nil {
+				t.Fatalf("%v: UnmarshalBinary() error = %v", codec, err)
+			}
+			if !bytes.Equal(wordsToBytes(loaded), wordsToBytes(bf)) {
+				t.Errorf("%v with %v of bits set: loaded bits differ from saved bits", codec, fraction)
+			}
+		}
+	}
+}
+
+func TestCodecs_Levels(t *testing.T) {
+	for _, tt := range []struct {
+		codec Codec
+		level int
+	}{{CodecGzip, 1}, {CodecGzip, 9}, {CodecZstd, 1}, {CodecZstd, 19}, {CodecS2, 1}, {CodecS2, 2}} {
+		bf := filledFilter(t, 1<<20, 0.01).WithCodec(tt.codec, tt.level)
+		data, err := bf.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%v level %d: MarshalBinary() error = %v", tt.codec, tt.level, err)
+		}
+		if err := NewBloomFilter[int]().UnmarshalBinary(data); err != nil {
+			t.Errorf("%v level %d: UnmarshalBinary() error = %v", tt.codec, tt.level, err)
+		}
+	}
+
+	if _, err := filledFilter(t, 1<<20, 0.01).WithCodec(CodecGzip, 42).MarshalBinary(); err == nil {
+		t.Errorf("MarshalBinary() with an invalid gzip level succeeded, want error")
+	}
+}
+
+func TestDecodeSparse_Corrupt(t *testing.T) {
+	raw := make([]byte, 4)
+	for name, block := range map[string][]byte{
+		"empty":            {},
+		"unknown mode":     {7},
+		"zero gap":         {sparseModeGaps, 0},
+		"outside block":    {sparseModeGaps, 33},
+		"truncated varint": {sparseModeGaps, 0x80},
+		"short raw block":  {sparseModeRaw, 1, 2},
+	} {
+		if err := decodeSparse(block, raw); err == nil {
+			t.Errorf("decodeSparse() of %s block succeeded, want error", name)
+		}
+	}
+}
+
+// wordsToBytes returns a copy of a filter's payload
+func wordsToBytes(bf *BloomFilter[int]) []byte {
+	storage := bf.Storage.(*BitPackingStorage[int])
+	raw := make([]byte, storage.payloadSize())
+	storage.readPayload(raw, 0)
+	return raw
+}
+
+// BenchmarkCodecs reports the time taken to save and load a 16 MiB filter with each codec, and its saved size, for a
+// sparsely populated filter (0.1% of bits set) and one which is as full as an optimally configured filter should get
+// (50% of bits set)
+func BenchmarkCodecs(b *testing.B) {
+	for _, fill := range []struct {
+		name     string
+		fraction float64
+	}{{"sparse", 0.001}, {"half-full", 0.5}} {
+		for _, codec := range allCodecs {
+			bf := filledFilter(b, 1<<27, fill.fraction).WithCodec(codec, DefaultCompressionLevel)
+			data, err := bf.MarshalBinary()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.Run(fill.name+"/"+codec.String()+"/save", func(b *testing.B) {
+				b.SetBytes(int64(len(wordsToBytes(bf))))
+				for i := 0; i < b.N; i++ {
+					if _, err := bf.MarshalBinary(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(data)), "saved-bytes")
+			})
+			b.Run(fill.name+"/"+codec.String()+"/load", func(b *testing.B) {
+				b.SetBytes(int64(len(wordsToBytes(bf))))
+				for i := 0; i < b.N; i++ {
+					if err := NewBloomFilter[int]().UnmarshalBinary(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
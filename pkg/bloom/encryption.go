@@ -0,0 +1,341 @@
+package bloom
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Filters saved by EncryptedPersistence wrap the binary format described in format.go as follows.  All integers are
+// big-endian.
+//
+//	magic         4 bytes   "GCBE"
+//	version       uint8     currently 1
+//	cipher        uint8     1 = AES-256-GCM
+//	segment size  uint32    maximum plaintext bytes in each segment
+//	key ID        uint8     length, followed by the ID of the key, as given by the KeyProvider
+//	nonce prefix  7 bytes   random, chosen for each file
+//	segments      each a uint32 length, with the top bit set on the last segment, followed by that many bytes of
+//	              ciphertext and tag
+//
+// Each segment is sealed separately (the STREAM construction), with a nonce of the nonce prefix, a uint32 segment
+// counter and a byte which is 1 for the last segment and 0 otherwise, and with everything up to the first segment as
+// additional authenticated data.  Reordered, truncated or modified segments, or a modified header, fail to decrypt.
+
+const (
+	encryptedMagic   = "GCBE"
+	encryptedVersion = uint8(1)
+	cipherAES256GCM  = uint8(1)
+
+	encryptedSegmentSize = 64 << 10
+	encryptedLastSegment = uint32(1 << 31)
+	noncePrefixSize      = 7
+
+	// EncryptionKeySize is the size of the keys used by EncryptedPersistence, for AES-256
+	EncryptionKeySize = 32
+)
+
+// KeyProvider supplies the keys used by EncryptedPersistence, identified by IDs which are stored in each file so that
+// keys can be rotated: new files are encrypted with the current key, and older files can still be decrypted with the key
+// they were written with.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt with, and its ID; the ID may be up to 255 bytes long
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID
+	Key(id string) ([]byte, error)
+}
+
+// staticKey is a KeyProvider with a single key
+type staticKey struct {
+	id  string
+	key [EncryptionKeySize]byte
+}
+
+// NewStaticKey returns a KeyProvider which always uses key, identified by id
+func NewStaticKey(id string, key [EncryptionKeySize]byte) KeyProvider {
+	return &staticKey{id: id, key: key}
+}
+
+func (s *staticKey) CurrentKey() (string, []byte, error) {
+	return s.id, s.key[:], nil
+}
+
+func (s *staticKey) Key(id string) ([]byte, error) {
+	if id != s.id {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	return s.key[:], nil
+}
+
+// EncryptedPersistence encrypts filters with AES-256-GCM before they are saved by another Persistence, and decrypts
+// them when loading.  The key ID and the encryption parameters are stored in the clear, but are authenticated.  Loading
+// with the wrong key, or a file which has been modified, fails with an error.
+//
+// The wrapped Persistence must be a GenericPersistence, or another EncryptedPersistence.  The filter itself is left
+// untouched, so it may be serialized concurrently, for example by AutoPersist, without being encrypted.
+type EncryptedPersistence[T any] struct {
+	inner envelopedPersistence[T]
+	keys  KeyProvider
+}
+
+// envelopedPersistence is persistence which can save and load a filter's serialized form wrapped in envelopes besides
+// the filter's own, innermost first
+type envelopedPersistence[T any] interface {
+	Persistence[T]
+	saveEnveloped(bf *BloomFilter[T], envelopes []envelope) error
+	loadEnveloped(bf *BloomFilter[T], envelopes []envelope) error
+}
+
+// NewEncryptedPersistence creates an EncryptedPersistence saving filters with inner, using keys from keys
+func NewEncryptedPersistence[T any](inner Persistence[T], keys KeyProvider) (*EncryptedPersistence[T], error) {
+	enveloped, ok := inner.(envelopedPersistence[T])
+	if !ok {
+		return nil, fmt.Errorf("%T can't be encrypted: only GenericPersistence can", inner)
+	}
+	return &EncryptedPersistence[T]{inner: enveloped, keys: keys}, nil
+}
+
+// Save encrypts the filter as the wrapped Persistence saves it
+func (ep *EncryptedPersistence[T]) Save(bf *BloomFilter[T]) error {
+	return ep.saveEnveloped(bf, nil)
+}
+
+// Load decrypts the filter as the wrapped Persistence loads it
+func (ep *EncryptedPersistence[T]) Load(bf *BloomFilter[T]) error {
+	return ep.loadEnveloped(bf, nil)
+}
+
+func (ep *EncryptedPersistence[T]) saveEnveloped(bf *BloomFilter[T], envelopes []envelope) error {
+	env := &encryptionEnvelope{keys: ep.keys}
+	if err := ep.inner.saveEnveloped(bf, append([]envelope{env}, envelopes...)); err != nil {
+		return err
+	}
+	if !env.used {
+		return errors.New("persistence didn't serialize the filter with WriteTo or MarshalBinary, so it wasn't encrypted")
+	}
+	return nil
+}
+
+func (ep *EncryptedPersistence[T]) loadEnveloped(bf *BloomFilter[T], envelopes []envelope) error {
+	return ep.inner.loadEnveloped(bf, append([]envelope{&encryptionEnvelope{keys: ep.keys}}, envelopes...))
+}
+
+// envelope wraps the serialized form of a filter, for example to encrypt it
+type envelope interface {
+	// wrap returns a writer which writes the wrapped form of what is written to it to w; closing it finishes the
+	// wrapped form, without closing w
+	wrap(w io.Writer) (io.WriteCloser, error)
+	// unwrap returns a reader of what was wrapped in the data read from r.  Reads fail, rather than returning data,
+	// if it can't be verified.
+	unwrap(r io.Reader) (io.Reader, error)
+}
+
+// encryptionEnvelope encrypts with keys from a KeyProvider, in the format described above
+type encryptionEnvelope struct {
+	keys KeyProvider
+	used bool
+}
+
+func (e *encryptionEnvelope) wrap(w io.Writer) (io.WriteCloser, error) {
+	e.used = true
+	id, key, err := e.keys.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("getting encryption key: %w", err)
+	}
+	if len(id) > 1<<8-1 {
+		return nil, errors.New("encryption key ID is too long")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, 4+1+1+4+1+len(id)+noncePrefixSize)
+	header = append(header, encryptedMagic...)
+	header = append(header, encryptedVersion, cipherAES256GCM)
+	header = binary.BigEndian.AppendUint32(header, encryptedSegmentSize)
+	header = append(header, uint8(len(id)))
+	header = append(header, id...)
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &sealWriter{w: w, aead: aead, aad: header, prefix: prefix}, nil
+}
+
+func (e *encryptionEnvelope) unwrap(r io.Reader) (io.Reader, error) {
+	e.used = true
+	var fixed [4 + 1 + 1 + 4 + 1]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, readError("encryption header", err)
+	}
+	if string(fixed[:4]) != encryptedMagic {
+		return nil, incompatiblef("filter isn't encrypted")
+	}
+	if fixed[4] != encryptedVersion {
+		return nil, incompatiblef("unsupported encryption format version %d", fixed[4])
+	}
+	if fixed[5] != cipherAES256GCM {
+		return nil, incompatiblef("unsupported cipher %d", fixed[5])
+	}
+	segmentSize := binary.BigEndian.Uint32(fixed[6:])
+	if segmentSize == 0 || segmentSize > payloadBlockSize {
+		return nil, corruptf("invalid encryption segment size %d", segmentSize)
+	}
+
+	rest := make([]byte, int(fixed[10])+noncePrefixSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, readError("encryption header", err)
+	}
+	id := string(rest[:fixed[10]])
+	key, err := e.keys.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("getting decryption key: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &openReader{
+		r:           r,
+		aead:        aead,
+		aad:         append(fixed[:], rest...),
+		prefix:      rest[fixed[10]:],
+		segmentSize: segmentSize,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, not %d", EncryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns the nonce for a segment
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// sealWriter encrypts what is written to it in segments
+type sealWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	aad     []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	sealed  []byte
+}
+
+func (sw *sealWriter) Write(p []byte) (int, error) {
+	sw.buf = append(sw.buf, p...)
+	// the last segment is sealed by Close, so a full segment is only sealed once more data follows it
+	for len(sw.buf) > encryptedSegmentSize {
+		if err := sw.seal(sw.buf[:encryptedSegmentSize], false); err != nil {
+			return 0, err
+		}
+		sw.buf = append(sw.buf[:0], sw.buf[encryptedSegmentSize:]...)
+	}
+	return len(p), nil
+}
+
+func (sw *sealWriter) Close() error {
+	return sw.seal(sw.buf, true)
+}
+
+func (sw *sealWriter) seal(plaintext []byte, last bool) error {
+	if sw.counter == 1<<32-1 {
+		return errors.New("filter is too large to encrypt")
+	}
+	sw.sealed = sw.aead.Seal(sw.sealed[:0], segmentNonce(sw.prefix, sw.counter, last), plaintext, sw.aad)
+	sw.counter++
+
+	length := uint32(len(sw.sealed))
+	if last {
+		length |= encryptedLastSegment
+	}
+	if err := binary.Write(sw.w, binary.BigEndian, length); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(sw.sealed)
+	return err
+}
+
+// openReader decrypts segments written by sealWriter
+type openReader struct {
+	r           io.Reader
+	aead        cipher.AEAD
+	aad         []byte
+	prefix      []byte
+	segmentSize uint32
+	counter     uint32
+	sealed      []byte
+	plaintext   []byte
+	remaining   []byte
+	done        bool
+}
+
+func (or *openReader) Read(p []byte) (int, error) {
+	for len(or.remaining) == 0 {
+		if or.done {
+			return 0, io.EOF
+		}
+		if err := or.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, or.remaining)
+	or.remaining = or.remaining[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next segment
+func (or *openReader) open() error {
+	var length uint32
+	if err := binary.Read(or.r, binary.BigEndian, &length); err != nil {
+		return readError("encrypted filter", err)
+	}
+	last := length&encryptedLastSegment != 0
+	length &^= encryptedLastSegment
+	if length > or.segmentSize+uint32(or.aead.Overhead()) {
+		return corruptf("encrypted segment is too large (%d bytes)", length)
+	}
+
+	if cap(or.sealed) < int(length) {
+		or.sealed = make([]byte, length)
+	}
+	or.sealed = or.sealed[:length]
+	if _, err := io.ReadFull(or.r, or.sealed); err != nil {
+		return readError("encrypted filter", err)
+	}
+	plaintext, err := or.aead.Open(or.plaintext[:0], segmentNonce(or.prefix, or.counter, last), or.sealed, or.aad)
+	if err != nil {
+		return corruptf("decrypting filter failed: wrong key, or the file has been modified")
+	}
+	or.counter++
+	or.plaintext = plaintext
+	or.remaining = plaintext
+	or.done = last
+	return nil
+}
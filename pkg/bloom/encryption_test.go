@@ -0,0 +1,189 @@
+package bloom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// rotatingKeys is a KeyProvider holding several keys, encrypting with current
+type rotatingKeys struct {
+	current string
+	keys    map[string][EncryptionKeySize]byte
+}
+
+func (rk *rotatingKeys) CurrentKey() (string, []byte, error) {
+	key := rk.keys[rk.current]
+	return rk.current, key[:], nil
+}
+
+func (rk *rotatingKeys) Key(id string) ([]byte, error) {
+	key, ok := rk.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key[:], nil
+}
+
+func newEncryptedFilter(t *testing.T, dir string, keys KeyProvider, bits uint64) *BloomFilter[string] {
+	t.Helper()
+	ep, err := NewEncryptedPersistence[string](filePersistence[string](dir, "filter.enc"), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](bits, nil)).WithPersistence(ep)
+	return bf
+}
+
+func loadEncrypted(dir string, keys KeyProvider) (*BloomFilter[string], error) {
+	ep, err := NewEncryptedPersistence[string](filePersistence[string](dir, "filter.enc"), keys)
+	if err != nil {
+		return nil, err
+	}
+	bf := NewBloomFilter[string]().WithPersistence(ep)
+	return bf, bf.LoadPersistence()
+}
+
+func TestEncryptedPersistence_RoundTrip(t *testing.T) {
+	// a filter of several segments, and one of less than a segment
+	for _, bits := range []uint64{1 << 22, 1 << 10} {
+		dir := t.TempDir()
+		keys := NewStaticKey("primary", [EncryptionKeySize]byte{1, 2, 3})
+		bf := newEncryptedFilter(t, dir, keys, bits)
+		for i := 0; i < 100; i++ {
+			_ = bf.Add(strconv.Itoa(i))
+		}
+		if err := bf.SavePersistence(); err != nil {
+			t.Fatalf("SavePersistence() error = %v", err)
+		}
+
+		data, _ := os.ReadFile(filepath.Join(dir, "filter.enc"))
+		data = withoutTypeID(t, data)
+		if !bytes.HasPrefix(data, []byte(encryptedMagic)) || bytes.Contains(data, []byte(formatMagic)) {
+			t.Errorf("saved filter isn't encrypted")
+		}
+
+		loaded, err := loadEncrypted(dir, keys)
+		if err != nil {
+			t.Fatalf("LoadPersistence() error = %v", err)
+		}
+		for i := 0; i < 100; i++ {
+			if !loaded.Contains(strconv.Itoa(i)) {
+				t.Fatalf("Contains(%d) = false after decrypting", i)
+			}
+		}
+	}
+}
+
+func TestEncryptedPersistence_Failures(t *testing.T) {
+	dir := t.TempDir()
+	keys := NewStaticKey("primary", [EncryptionKeySize]byte{1, 2, 3})
+	bf := newEncryptedFilter(t, dir, keys, 1<<20)
+	_ = bf.Add("secret")
+	_ = bf.SavePersistence()
+	path := filepath.Join(dir, "filter.enc")
+	file, _ := os.ReadFile(path)
+	data := withoutTypeID(t, file)
+	typeIDHeader := file[:len(file)-len(data)]
+
+	if _, err := loadEncrypted(dir, NewStaticKey("primary", [EncryptionKeySize]byte{3, 2, 1})); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("LoadPersistence() with the wrong key error = %v, want ErrCorrupt", err)
+	}
+	if _, err := loadEncrypted(dir, NewStaticKey("other", [EncryptionKeySize]byte{1, 2, 3})); err == nil {
+		t.Errorf("LoadPersistence() with an unknown key ID succeeded, want error")
+	}
+	if err := NewBloomFilter[string]().UnmarshalBinary(data); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("UnmarshalBinary() of an encrypted filter without a key error = %v, want ErrIncompatible", err)
+	}
+
+	flipped := func(i int) []byte {
+		modified := append([]byte{}, data...)
+		modified[i] ^= 1
+		return modified
+	}
+	tampered := map[string][]byte{
+		// the segment size is authenticated, so a larger one fails to decrypt
+		"header":    flipped(8),
+		"segment":   flipped(len(data) - 20),
+		"truncated": data[:len(data)-100],
+	}
+	for name, modified := range tampered {
+		_ = os.WriteFile(path, append(typeIDHeader[:len(typeIDHeader):len(typeIDHeader)], modified...), 0o644)
+		if _, err := loadEncrypted(dir, keys); err == nil {
+			t.Errorf("LoadPersistence() of a %s modified file succeeded, want error", name)
+		}
+	}
+
+	plain := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](1024, nil))
+	plainData, _ := persist.Marshal(plain)
+	_ = os.WriteFile(path, plainData, 0o644)
+	if _, err := loadEncrypted(dir, keys); err == nil {
+		t.Errorf("LoadPersistence() of an unencrypted file succeeded, want error")
+	}
+}
+
+func TestEncryptedPersistence_KeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	keys := &rotatingKeys{current: "2023", keys: map[string][EncryptionKeySize]byte{"2023": {1}, "2024": {2}}}
+	bf := newEncryptedFilter(t, dir, keys, 1<<12)
+	_ = bf.Add("old")
+	_ = bf.SavePersistence()
+
+	keys.current = "2024"
+	loaded, err := loadEncrypted(dir, keys)
+	if err != nil || !loaded.Contains("old") {
+		t.Fatalf("LoadPersistence() with a rotated key error = %v", err)
+	}
+	if err := loaded.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+	delete(keys.keys, "2023")
+	if _, err := loadEncrypted(dir, keys); err != nil {
+		t.Errorf("LoadPersistence() after re-encrypting with the current key error = %v", err)
+	}
+}
+
+func TestEncryptedPersistence_ConcurrentMarshal(t *testing.T) {
+	keys := NewStaticKey("primary", [EncryptionKeySize]byte{1, 2, 3})
+	bf := newEncryptedFilter(t, t.TempDir(), keys, 1<<12)
+	_ = bf.Add("secret")
+
+	// the filter serialized by others while it is being saved encrypted, as by AutoPersist, is left unencrypted
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			data, err := bf.MarshalBinary()
+			if err != nil || !bytes.HasPrefix(data, []byte(formatMagic)) {
+				t.Errorf("MarshalBinary() during an encrypted save = %.4q, %v, want an unencrypted filter", data, err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if err := bf.SavePersistence(); err != nil {
+			t.Errorf("SavePersistence() error = %v", err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestNewEncryptedPersistence_Unsupported(t *testing.T) {
+	keys := NewStaticKey("primary", [EncryptionKeySize]byte{})
+	if _, err := NewEncryptedPersistence[string](NewCheckpointPersistence[string]("filter.ckpt"), keys); err == nil {
+		t.Errorf("NewEncryptedPersistence() of a CheckpointPersistence succeeded, want error")
+	}
+	wal := NewWALPersistence[string](filePersistence[string](t.TempDir(), "filter"), filepath.Join(t.TempDir(), "wal"),
+		WALOptions{})
+	if _, err := NewEncryptedPersistence[string](wal, keys); err == nil {
+		t.Errorf("NewEncryptedPersistence() of a WALPersistence succeeded, want error")
+	}
+}
@@ -0,0 +1,60 @@
+package bloom
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"io"
+)
+
+var (
+	// ErrCorrupt is wrapped by the errors returned when a serialized filter is truncated, malformed or fails its
+	// checksum; it is the same error as persist.ErrCorrupt
+	ErrCorrupt = persist.ErrCorrupt
+	// ErrTooLarge is wrapped by the errors returned when a serialized filter is larger than the limit set by
+	// WithMaxLoadBits
+	ErrTooLarge = errors.New("filter is too large to load")
+	// ErrIncompatible is wrapped by the errors returned when a valid serialized filter can't be loaded into a
+	// BloomFilter as configured: it was saved by a newer version of the format, or with another secret key or seed
+	// strategy; it is the same error as persist.ErrIncompatible
+	ErrIncompatible = persist.ErrIncompatible
+	// ErrTypeMismatch is matched by every TypeMismatchError; it is the same error as persist.ErrTypeMismatch
+	ErrTypeMismatch = persist.ErrTypeMismatch
+	// ErrUnsupportedKey is wrapped by the errors returned for keys which can't be encoded, and by Open for filters
+	// whose key type it doesn't know; it is the same error as common.ErrUnsupportedKey
+	ErrUnsupportedKey = common.ErrUnsupportedKey
+	// ErrUnsupportedStorage is wrapped by the errors returned for storage other than BitPackingStorage and
+	// ConventionalStorage, or storage which a persistence mechanism can't use
+	ErrUnsupportedStorage = errors.New("unsupported storage type")
+	// ErrNoStorage is returned when a filter is used before its storage has been set
+	ErrNoStorage = errors.New("storage not set")
+	// ErrEmptyStorage is returned when a filter's storage has no bits, such as storage which wasn't made with
+	// NewBitPackingStorage or NewConventionalStorage
+	ErrEmptyStorage = errors.New("storage has no bits")
+	// ErrNoPersistence is returned by SavePersistence and LoadPersistence when no persistence mechanism has been set
+	ErrNoPersistence = errors.New("persistence mechanism not set")
+)
+
+// TypeMismatchError is returned when a filter, or a value given for one, isn't of the type required, for example when
+// loading a filter saved as a BloomFilter[string] into a BloomFilter[int].  It matches ErrTypeMismatch, and is the same
+// type as persist.TypeMismatchError.
+type TypeMismatchError = persist.TypeMismatchError
+
+// corruptf returns an error wrapping ErrCorrupt
+func corruptf(format string, args ...any) error {
+	return fmt.Errorf("%w: "+format, append([]any{ErrCorrupt}, args...)...)
+}
+
+// incompatiblef returns an error wrapping ErrIncompatible
+func incompatiblef(format string, args ...any) error {
+	return fmt.Errorf("%w: "+format, append([]any{ErrIncompatible}, args...)...)
+}
+
+// readError describes an error reading what from a serialized filter; running out of data means the filter is truncated
+func readError(what string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return corruptf("reading %s: %w", what, io.ErrUnexpectedEOF)
+	}
+	return fmt.Errorf("reading %s: %w", what, err)
+}
@@ -0,0 +1,71 @@
+package bloom
+
+import (
+	"errors"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"testing"
+)
+
+// mapStorage is storage of a kind the package doesn't support
+type mapStorage[T comparable] map[T]bool
+
+func (m mapStorage[T]) SetBit(key T) error  { m[key] = true; return nil }
+func (m mapStorage[T]) CheckBit(key T) bool { return m[key] }
+
+func TestErrors(t *testing.T) {
+	var secret [common.SecretKeySize]byte
+	bf := newTestFilter(t, 3, common.Murmur3, NewBitPackingStorage[string](1024, nil))
+	data, _ := bf.MarshalBinary()
+
+	var mismatch *TypeMismatchError
+	err := NewBloomFilter[int]().UnmarshalBinary(data)
+	if !errors.Is(err, ErrTypeMismatch) || !errors.As(err, &mismatch) ||
+		mismatch.Expected != "*bloom.BloomFilter[int]" || mismatch.Actual != "*bloom.BloomFilter[string]" {
+		t.Errorf("UnmarshalBinary() into another key type error = %v, want a TypeMismatchError", err)
+	}
+
+	keyed, _ := NewBloomFilter[string]().WithSecretKey(secret)
+	if err := keyed.UnmarshalBinary(data); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("UnmarshalBinary() with an unexpected secret key error = %v, want ErrIncompatible", err)
+	}
+	future := append([]byte(nil), data...)
+	future[4]++
+	if err := NewBloomFilter[string]().UnmarshalBinary(future); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("UnmarshalBinary() of a newer format error = %v, want ErrIncompatible", err)
+	}
+	if err := NewBloomFilter[string]().UnmarshalBinary(data[:len(data)-3]); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("UnmarshalBinary() of a truncated filter error = %v, want ErrCorrupt", err)
+	}
+
+	if err := bf.SavePersistence(); !errors.Is(err, ErrNoPersistence) {
+		t.Errorf("SavePersistence() without persistence error = %v, want ErrNoPersistence", err)
+	}
+	if err := NewBloomFilter[string]().Add("key"); !errors.Is(err, ErrNoStorage) {
+		t.Errorf("Add() without storage error = %v, want ErrNoStorage", err)
+	}
+	if _, err := NewBloomFilter[string]().WithStorage(&BitPackingStorage[string]{}); !errors.Is(err, ErrEmptyStorage) {
+		t.Errorf("WithStorage() of storage without bits error = %v, want ErrEmptyStorage", err)
+	}
+	empty := &BitPackingStorage[string]{seeds: bf.seeds, bloomFilter: bf}
+	if err := empty.SetBit("key"); !errors.Is(err, ErrEmptyStorage) {
+		t.Errorf("SetBit() on storage without bits error = %v, want ErrEmptyStorage", err)
+	}
+	if _, err := NewBloomFilter[string]().WithStorage(mapStorage[string]{}); !errors.Is(err, ErrUnsupportedStorage) {
+		t.Errorf("WithStorage() of unsupported storage error = %v, want ErrUnsupportedStorage", err)
+	}
+
+	type point struct{ x, y int }
+	points := newTestFilter(t, 3, common.Murmur3, NewBitPackingStorage[point](1024, nil))
+	if err := points.Add(point{1, 2}); !errors.Is(err, ErrUnsupportedKey) || !errors.Is(err, common.ErrUnsupportedKey) {
+		t.Errorf("Add() of an unsupported key error = %v, want ErrUnsupportedKey", err)
+	}
+
+	h := &Handle{filter: typedFilter[string]{bf: bf}}
+	if _, err := h.Contains(3); !errors.As(err, &mismatch) || mismatch.Expected != "string" || mismatch.Actual != "int" {
+		t.Errorf("Contains(3) on a string filter error = %v, want a TypeMismatchError", err)
+	}
+	if _, err := New[string](WithHashFunctions(3, common.Murmur3),
+		WithStorage(NewBitPackingStorage[int](1024, nil))); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("New() with storage of another key type error = %v, want ErrTypeMismatch", err)
+	}
+}
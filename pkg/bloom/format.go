@@ -0,0 +1,349 @@
+package bloom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// The binary format written by MarshalBinary is laid out as follows.  All integers in the header are big-endian.
+//
+//	magic          4 bytes   "GCBF"
+//	version        uint8     currently 1
+//	hash function  uint8     one of the hash enums in the common package
+//	storage type   uint8     1 = BitPackingStorage, 2 = ConventionalStorage
+//	index strategy uint8     1 = each seeded hash of the key, modulo the number of bits
+//	codec          uint8     Codec applied to each payload block; 0 = none, 1 = gzip, 2 = zstd, 3 = S2, 4 = sparse
+//	flags          uint8     bit 0 set if the filter uses a secret key
+//	bits           uint64    number of bits (m)
+//	hash functions uint32    number of hash functions (k), followed by k uint32 seeds
+//	filter type    uint16    length, followed by the Go type of the filter, e.g. "*bloom.BloomFilter[string]"
+//	key check      uint8     length, followed by common.SecretKeyCheck of the secret key (if any)
+//	payload        blocks of uint32 encoded length followed by that many bytes, ending with a zero length block
+//	checksum       uint32    CRC-32C (Castagnoli) of everything preceding it
+//
+// The payload is the filter's bits, with each block holding up to payloadBlockSize bytes before compression.
+// BitPackingStorage writes each uint64 word as 8 little-endian bytes; ConventionalStorage packs 8 cells per byte,
+// least significant bit first.
+//
+// Filters saved before the format was introduced (gzip compressed gob of BloomFilterData) are still read by
+// UnmarshalBinary, but are always written back in this format.
+
+const (
+	formatMagic   = "GCBF"
+	formatVersion = uint8(1)
+
+	storageTypeBitPacking   = uint8(1)
+	storageTypeConventional = uint8(2)
+
+	indexStrategySeeded = uint8(1)
+
+	flagSecretKey = uint8(1 << 0)
+
+	// payloadBlockSize is the number of payload bytes compressed together; it must be a multiple of 8
+	payloadBlockSize = 1 << 20
+)
+
+// castagnoli is used for the file checksum
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// fileHeader holds the parameters written ahead of a filter's payload
+type fileHeader struct {
+	hashFunction  uint8
+	storageType   uint8
+	indexStrategy uint8
+	codec         Codec
+	flags         uint8
+	numBits       uint64
+	seeds         []uint32
+	filterType    string
+	keyCheck      []byte
+
+	// codecLevel is only used when writing; the level doesn't need to be known to decompress
+	codecLevel int
+}
+
+// payloadStorage is implemented by storage which can be serialized as a sequence of bytes
+type payloadStorage interface {
+	// payloadSize returns the number of bytes in the serialized payload
+	payloadSize() uint64
+	// readPayload fills dst with the payload starting at offset
+	readPayload(dst []byte, offset uint64)
+	// writePayload sets the storage from the payload bytes in src, which start at offset
+	writePayload(src []byte, offset uint64)
+}
+
+func (b *BitPackingStorage[T]) payloadSize() uint64 {
+	return b.bitsLength * 8
+}
+
+func (b *BitPackingStorage[T]) readPayload(dst []byte, offset uint64) {
+	words := b.bits[offset/8:]
+	for i := 0; i+8 <= len(dst); i += 8 {
+		binary.LittleEndian.PutUint64(dst[i:], words[i/8])
+	}
+}
+
+func (b *BitPackingStorage[T]) writePayload(src []byte, offset uint64) {
+	b.bits = growTo(b.bits, (offset+uint64(len(src)))/8, b.bitsLength)
+	words := b.bits[offset/8:]
+	for i := 0; i+8 <= len(src); i += 8 {
+		words[i/8] = binary.LittleEndian.Uint64(src[i:])
+	}
+}
+
+func (c *ConventionalStorage[T]) payloadSize() uint64 {
+	return (c.sliceLength + 7) / 8
+}
+
+func (c *ConventionalStorage[T]) readPayload(dst []byte, offset uint64) {
+	clear(dst)
+	start := offset * 8
+	for i := range dst {
+		for bit := uint64(0); bit < 8 && start+uint64(i)*8+bit < c.sliceLength; bit++ {
+			if c.bits[start+uint64(i)*8+bit] {
+				dst[i] |= 1 << bit
+			}
+		}
+	}
+}
+
+func (c *ConventionalStorage[T]) writePayload(src []byte, offset uint64) {
+	c.bits = growTo(c.bits, min((offset+uint64(len(src)))*8, c.sliceLength), c.sliceLength)
+	start := offset * 8
+	for i := range src {
+		for bit := uint64(0); bit < 8 && start+uint64(i)*8+bit < c.sliceLength; bit++ {
+			c.bits[start+uint64(i)*8+bit] = src[i]&(1<<bit) != 0
+		}
+	}
+}
+
+// growTo returns s extended to n elements, growing its capacity no further than limit.  Storage being loaded starts
+// empty and grows as its payload is written, so that a header claiming a huge filter can only make a loader allocate
+// as much memory as the payload which follows it fills.
+func growTo[E any](s []E, n, limit uint64) []E {
+	if uint64(len(s)) >= n {
+		return s
+	}
+	if uint64(cap(s)) < n {
+		grown := make([]E, len(s), min(max(n, 2*uint64(cap(s))), limit))
+		copy(grown, s)
+		s = grown
+	}
+	return s[:n]
+}
+
+// checksumWriter passes writes through to w while accumulating their CRC-32C
+type checksumWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+}
+
+func (cw *checksumWriter) Write(p []byte) (int, error) {
+	cw.crc.Write(p)
+	return cw.w.Write(p)
+}
+
+// checksumReader passes reads through from r while accumulating their CRC-32C
+type checksumReader struct {
+	r   io.Reader
+	crc hash.Hash32
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.crc.Write(p[:n])
+	return n, err
+}
+
+// writeFilter writes the header and payload of a filter in the format described above, one block at a time
+func writeFilter(w io.Writer, header *fileHeader, storage payloadStorage) error {
+	bw := bufio.NewWriter(w)
+	cw := &checksumWriter{w: bw, crc: crc32.New(castagnoli)}
+
+	if err := writeHeader(cw, header); err != nil {
+		return err
+	}
+
+	size := storage.payloadSize()
+	raw := make([]byte, min(size, payloadBlockSize))
+	encoder, err := newBlockEncoder(header.codec, header.codecLevel)
+	if err != nil {
+		return err
+	}
+	defer encoder.close()
+	for offset := uint64(0); offset < size; offset += uint64(len(raw)) {
+		raw = raw[:min(size-offset, payloadBlockSize)]
+		storage.readPayload(raw, offset)
+
+		block, err := encoder.encode(raw)
+		if err != nil {
+			return err
+		}
+		if err := binary.Write(cw, binary.BigEndian, uint32(len(block))); err != nil {
+			return err
+		}
+		if _, err := cw.Write(block); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(cw, binary.BigEndian, uint32(0)); err != nil {
+		return err
+	}
+
+	if err := binary.Write(bw, binary.BigEndian, cw.crc.Sum32()); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func writeHeader(w io.Writer, header *fileHeader) error {
+	if len(header.filterType) > 1<<16-1 || len(header.keyCheck) > 1<<8-1 {
+		return errors.New("filter header field is too long")
+	}
+
+	buf := make([]byte, 0, 32+4*len(header.seeds)+len(header.filterType)+len(header.keyCheck))
+	buf = append(buf, formatMagic...)
+	buf = append(buf, formatVersion, header.hashFunction, header.storageType, header.indexStrategy, uint8(header.codec),
+		header.flags)
+	buf = binary.BigEndian.AppendUint64(buf, header.numBits)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(header.seeds)))
+	for _, seed := range header.seeds {
+		buf = binary.BigEndian.AppendUint32(buf, seed)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(header.filterType)))
+	buf = append(buf, header.filterType...)
+	buf = append(buf, uint8(len(header.keyCheck)))
+	buf = append(buf, header.keyCheck...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// readHeader reads a header written by writeHeader, including the magic bytes
+func readHeader(r io.Reader) (*fileHeader, error) {
+	var fixed [4 + 6 + 8 + 4]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, readError("filter header", err)
+	}
+	if string(fixed[:4]) != formatMagic {
+		return nil, corruptf("not a filter file: bad magic bytes")
+	}
+	if fixed[4] != formatVersion {
+		return nil, incompatiblef("unsupported filter format version %d", fixed[4])
+	}
+
+	header := &fileHeader{
+		hashFunction:  fixed[5],
+		storageType:   fixed[6],
+		indexStrategy: fixed[7],
+		codec:         Codec(fixed[8]),
+		flags:         fixed[9],
+		numBits:       binary.BigEndian.Uint64(fixed[10:]),
+	}
+
+	numSeeds := binary.BigEndian.Uint32(fixed[18:])
+	if numSeeds == 0 || numSeeds > maxHashFunctions {
+		return nil, corruptf("filter header has an invalid number of hash functions (%d)", numSeeds)
+	}
+	seedBytes := make([]byte, 4*numSeeds)
+	if _, err := io.ReadFull(r, seedBytes); err != nil {
+		return nil, readError("filter seeds", err)
+	}
+	header.seeds = make([]uint32, numSeeds)
+	for i := range header.seeds {
+		header.seeds[i] = binary.BigEndian.Uint32(seedBytes[i*4:])
+	}
+
+	var typeLen uint16
+	if err := binary.Read(r, binary.BigEndian, &typeLen); err != nil {
+		return nil, readError("filter type", err)
+	}
+	filterType := make([]byte, typeLen)
+	if _, err := io.ReadFull(r, filterType); err != nil {
+		return nil, readError("filter type", err)
+	}
+	header.filterType = string(filterType)
+
+	var checkLen uint8
+	if err := binary.Read(r, binary.BigEndian, &checkLen); err != nil {
+		return nil, readError("key check", err)
+	}
+	if checkLen > 0 {
+		header.keyCheck = make([]byte, checkLen)
+		if _, err := io.ReadFull(r, header.keyCheck); err != nil {
+			return nil, readError("key check", err)
+		}
+	}
+	return header, nil
+}
+
+// readPayload reads the payload blocks following a header into storage, then verifies the checksum
+func readPayload(cr *checksumReader, codec Codec, storage payloadStorage) error {
+	size := storage.payloadSize()
+	raw := make([]byte, min(size, payloadBlockSize))
+	decoder, err := newBlockDecoder(codec)
+	if err != nil {
+		return corruptf("%w", err)
+	}
+	defer decoder.close()
+	var block []byte
+	for offset := uint64(0); ; offset += uint64(len(raw)) {
+		var blockLen uint32
+		if err := binary.Read(cr, binary.BigEndian, &blockLen); err != nil {
+			return readError("payload", err)
+		}
+		if blockLen == 0 {
+			if offset != size {
+				return corruptf("payload is truncated: %d of %d bytes", offset, size)
+			}
+			break
+		}
+		if offset >= size {
+			return corruptf("payload is longer than the header describes")
+		}
+		if blockLen > maxEncodedBlockSize {
+			return corruptf("payload block is too large (%d bytes)", blockLen)
+		}
+
+		if cap(block) < int(blockLen) {
+			block = make([]byte, blockLen)
+		}
+		block = block[:blockLen]
+		if _, err := io.ReadFull(cr, block); err != nil {
+			return readError("payload", err)
+		}
+
+		raw = raw[:min(size-offset, payloadBlockSize)]
+		if err := decoder.decode(block, raw); err != nil {
+			return corruptf("decoding payload: %w", err)
+		}
+		storage.writePayload(raw, offset)
+	}
+
+	expected := cr.crc.Sum32()
+	var checksum uint32
+	if err := binary.Read(cr.r, binary.BigEndian, &checksum); err != nil {
+		return readError("checksum", err)
+	}
+	if checksum != expected {
+		return corruptf("checksum mismatch: file has %08x, computed %08x", checksum, expected)
+	}
+	return nil
+}
+
+const (
+	// maxHashFunctions bounds the number of seeds accepted from a header
+	maxHashFunctions = 1 << 10
+	// maxEncodedBlockSize bounds a single compressed payload block; compression may expand incompressible data slightly
+	maxEncodedBlockSize = 2 * payloadBlockSize
+	// defaultMaxLoadBits is the size limit for loading a filter unless WithMaxLoadBits sets another.  2^32 bits is 512
+	// MiB of BitPackingStorage (or 4 GiB of ConventionalStorage), holding hundreds of millions of keys.
+	defaultMaxLoadBits = 1 << 32
+	// maxConfigureBits bounds the storage WithAutoConfigure will create whatever the load limit, so that its size fits
+	// an int and rounds up to a power of two
+	maxConfigureBits = 1 << 62
+)
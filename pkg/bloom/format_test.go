@@ -0,0 +1,277 @@
+package bloom
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestFormat_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage Storage[string]
+		numBits uint64
+	}{
+		{name: "BitPackingStorage", storage: NewBitPackingStorage[string](4096, nil), numBits: 4096},
+		{name: "BitPackingStorage multiple blocks", storage: NewBitPackingStorage[string](3*8*payloadBlockSize, nil),
+			numBits: 4 * 8 * payloadBlockSize},
+		{name: "ConventionalStorage", storage: NewConventionalStorage[string](61, nil), numBits: 61},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bf := newTestFilter(t, 3, common.XXhash, tt.storage)
+			for i := 0; i < 20; i++ {
+				_ = bf.Storage.SetBit(strconv.Itoa(i))
+			}
+
+			data, err := bf.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() error = %v", err)
+			}
+			if !bytes.HasPrefix(data, []byte(formatMagic)) {
+				t.Fatalf("MarshalBinary() output doesn't start with the magic bytes")
+			}
+
+			loaded := NewBloomFilter[string]()
+			if err := loaded.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary() error = %v", err)
+			}
+			if got := loaded.Storage.(indexStorage).numBits(); got != tt.numBits {
+				t.Errorf("loaded filter has %d bits, want %d", got, tt.numBits)
+			}
+			switch saved := bf.Storage.(type) {
+			case *BitPackingStorage[string]:
+				if !reflect.DeepEqual(loaded.Storage.(*BitPackingStorage[string]).bits, saved.bits) {
+					t.Errorf("loaded bits differ from the saved bits")
+				}
+			case *ConventionalStorage[string]:
+				if !reflect.DeepEqual(loaded.Storage.(*ConventionalStorage[string]).bits, saved.bits) {
+					t.Errorf("loaded bits differ from the saved bits")
+				}
+			}
+			for i := 0; i < 20; i++ {
+				if !loaded.Storage.CheckBit(strconv.Itoa(i)) {
+					t.Errorf("CheckBit(%d) = false after reload, want true", i)
+				}
+			}
+		})
+	}
+}
+
+func TestFormat_Corruption(t *testing.T) {
+	bf := newTestFilter(t, 3, common.XXhash, NewBitPackingStorage[string](4096, nil))
+	_ = bf.Storage.SetBit("key")
+	data, _ := bf.MarshalBinary()
+
+	corrupt := func(f func([]byte)) []byte {
+		c := bytes.Clone(data)
+		f(c)
+		return c
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "flipped payload bit", data: corrupt(func(c []byte) { c[len(c)-10] ^= 1 })},
+		{name: "flipped checksum bit", data: corrupt(func(c []byte) { c[len(c)-1] ^= 1 })},
+		{name: "future version", data: corrupt(func(c []byte) { c[4] = formatVersion + 1 })},
+		{name: "unknown index strategy", data: corrupt(func(c []byte) { c[7] = 99 })},
+		{name: "truncated", data: data[:len(data)-5]},
+		{name: "header only", data: data[:20]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded := NewBloomFilter[string]()
+			if err := loaded.UnmarshalBinary(tt.data); err == nil {
+				t.Errorf("UnmarshalBinary() succeeded, want error")
+			}
+			if loaded.Storage != nil {
+				t.Errorf("UnmarshalBinary() modified the filter despite failing")
+			}
+		})
+	}
+}
+
+// marshalGob produces a filter in the format written before the current binary format was introduced
+func marshalGob[T any](bf *BloomFilter[T]) []byte {
+	storage := bf.Storage.(*BitPackingStorage[T])
+	bits := make([]byte, len(storage.bits)*8)
+	for i, v := range storage.bits {
+		binary.LittleEndian.PutUint64(bits[i*8:], v)
+	}
+	data := &BloomFilterData[T]{
+		NumHashFunctions: bf.numHashFunctions,
+		Seeds:            bf.seeds,
+		HashFunctionEnum: bf.hashEnum,
+		StorageData:      bits,
+		StorageType:      "BitPackingStorage",
+		FilterType:       reflect.TypeOf(bf).String(),
+	}
+	return encodeGob(data)
+}
+
+func encodeGob[T any](data *BloomFilterData[T]) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	_ = gob.NewEncoder(gzipWriter).Encode(data)
+	_ = gzipWriter.Close()
+	return buf.Bytes()
+}
+
+func TestFormat_ReadsLegacyGob(t *testing.T) {
+	bf := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[int](1024, nil))
+	for i := 0; i < 50; i++ {
+		_ = bf.Storage.SetBit(i)
+	}
+
+	loaded := NewBloomFilter[int]()
+	if err := loaded.UnmarshalBinary(marshalGob(bf)); err != nil {
+		t.Fatalf("UnmarshalBinary() of a legacy gob filter error = %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if !loaded.Storage.CheckBit(i) {
+			t.Errorf("CheckBit(%d) = false after loading a legacy filter, want true", i)
+		}
+	}
+
+	// saving the legacy filter migrates it to the current format
+	data, err := loaded.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error = %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte(formatMagic)) {
+		t.Errorf("re-saved legacy filter isn't in the current format")
+	}
+}
+
+func TestFormat_RejectsHostileInput(t *testing.T) {
+	header := func(f func(*fileHeader)) []byte {
+		h := &fileHeader{hashFunction: common.Murmur3, storageType: storageTypeBitPacking,
+			indexStrategy: indexStrategySeeded, numBits: 1024, seeds: []uint32{1, 2, 3},
+			filterType: reflect.TypeOf(&BloomFilter[string]{}).String()}
+		f(h)
+		var buf bytes.Buffer
+		_ = writeHeader(&buf, h)
+		return buf.Bytes()
+	}
+	legacy := func(f func(*BloomFilterData[string])) []byte {
+		data := &BloomFilterData[string]{NumHashFunctions: 3, Seeds: []uint32{1, 2, 3}, HashFunctionEnum: common.Murmur3,
+			StorageData: make([]byte, 128), StorageType: "BitPackingStorage",
+			FilterType: reflect.TypeOf(&BloomFilter[string]{}).String()}
+		f(data)
+		return encodeGob(data)
+	}
+
+	tests := map[string][]byte{
+		"no bits":                      header(func(h *fileHeader) { h.numBits = 0 }),
+		"unaligned bits":               header(func(h *fileHeader) { h.numBits = 100 }),
+		"no hash functions":            header(func(h *fileHeader) { h.seeds = nil }),
+		"unknown hash function":        header(func(h *fileHeader) { h.hashFunction = 200 }),
+		"unpersistable hash function":  header(func(h *fileHeader) { h.hashFunction = common.MapHash }),
+		"unknown storage type":         header(func(h *fileHeader) { h.storageType = 9 }),
+		"header without payload":       header(func(*fileHeader) {}),
+		"legacy unknown hash function": legacy(func(d *BloomFilterData[string]) { d.HashFunctionEnum = 200 }),
+		"legacy seed count mismatch":   legacy(func(d *BloomFilterData[string]) { d.NumHashFunctions = 7 }),
+		"legacy no hash functions": legacy(func(d *BloomFilterData[string]) {
+			d.NumHashFunctions, d.Seeds = 0, nil
+		}),
+		"legacy no storage data":     legacy(func(d *BloomFilterData[string]) { d.StorageData = nil }),
+		"legacy unaligned storage":   legacy(func(d *BloomFilterData[string]) { d.StorageData = make([]byte, 13) }),
+		"legacy unknown storage":     legacy(func(d *BloomFilterData[string]) { d.StorageType = "Tape" }),
+		"legacy not gzip compressed": []byte("not a filter"),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			loaded := NewBloomFilter[string]()
+			if err := loaded.UnmarshalBinary(data); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("UnmarshalBinary() error = %v, want ErrCorrupt", err)
+			}
+			if loaded.Storage != nil {
+				t.Errorf("UnmarshalBinary() modified the filter despite failing")
+			}
+		})
+	}
+}
+
+func TestFormat_MaxLoadBits(t *testing.T) {
+	bf := newTestFilter(t, 3, common.Murmur3, NewBitPackingStorage[string](1<<16, nil))
+	data, _ := bf.MarshalBinary()
+	legacy := marshalGob(bf)
+
+	for _, data := range [][]byte{data, legacy} {
+		if err := NewBloomFilter[string]().WithMaxLoadBits(1 << 15).UnmarshalBinary(data); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("UnmarshalBinary() of a filter over the limit error = %v, want ErrTooLarge", err)
+		}
+		if err := NewBloomFilter[string]().WithMaxLoadBits(1 << 16).UnmarshalBinary(data); err != nil {
+			t.Errorf("UnmarshalBinary() of a filter at the limit error = %v", err)
+		}
+	}
+
+	// headers claiming more than the default limit are refused before any storage is allocated, and within a limit
+	// storage is only allocated as the payload is read, so a header without one fails as truncated
+	huge := hugeHeader(t)
+	if err := NewBloomFilter[string]().UnmarshalBinary(huge); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("UnmarshalBinary() of a huge filter error = %v, want ErrTooLarge", err)
+	}
+	if err := NewBloomFilter[string]().WithMaxLoadBits(1 << 40).UnmarshalBinary(huge); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("UnmarshalBinary() of a huge filter without its payload error = %v, want ErrCorrupt", err)
+	}
+}
+
+// hugeHeader returns the header of a filter claiming 2^40 bits of ConventionalStorage, without its payload
+func hugeHeader(tb testing.TB) []byte {
+	bf := newTestFilter(tb, 3, common.Murmur3, NewConventionalStorage[string](64, nil))
+	bf.Storage.(*ConventionalStorage[string]).sliceLength = 1 << 40
+	var buf bytes.Buffer
+	header, _, _ := bf.fileHeader()
+	_ = writeHeader(&buf, header)
+	return buf.Bytes()
+}
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecZstd, CodecS2, CodecSparse} {
+		bf := newTestFilter(f, 3, common.XXhash, NewBitPackingStorage[string](1024, nil)).WithCodec(codec, 0)
+		_ = bf.Add("key")
+		data, _ := bf.MarshalBinary()
+		f.Add(data)
+		if codec == CodecNone {
+			f.Add(marshalGob(bf))
+		}
+	}
+	conventional := newTestFilter(f, 3, common.Murmur3, NewConventionalStorage[string](100, nil))
+	_ = conventional.Add("key")
+	data, _ := conventional.MarshalBinary()
+	f.Add(data)
+	signingKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	signed := newTestFilter(f, 3, common.Murmur3, NewBitPackingStorage[string](1024, nil)).WithSigningKey(signingKey)
+	data, _ = signed.MarshalBinary()
+	f.Add(data)
+	f.Add(hugeHeader(f))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		bf := NewBloomFilter[string]()
+		if err := bf.UnmarshalBinary(data); err != nil {
+			if bf.Storage != nil {
+				t.Errorf("UnmarshalBinary() modified the filter despite failing")
+			}
+			return
+		}
+		// whatever was accepted must be a usable filter
+		if err := bf.Add("fuzz"); err != nil {
+			t.Fatalf("Add() after loading error = %v", err)
+		}
+		if !bf.Contains("fuzz") {
+			t.Errorf("Contains() = false after Add()")
+		}
+		if _, err := bf.MarshalBinary(); err != nil {
+			t.Errorf("MarshalBinary() after loading error = %v", err)
+		}
+	})
+}
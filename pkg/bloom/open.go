@@ -0,0 +1,401 @@
+package bloom
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"strings"
+)
+
+// gzipID1 and gzipID2 begin a gzip stream, and so a filter in the gob format
+const (
+	gzipID1 = 0x1f
+	gzipID2 = 0x8b
+)
+
+// Info describes a saved filter, as read by Inspect or Open
+type Info struct {
+	FilterType    string   // the Go type of the filter, such as "*bloom.BloomFilter[string]"
+	KeyType       string   // the filter's type parameter, such as "string"
+	Storage       string   // "BitPackingStorage" or "ConventionalStorage"
+	HashFunction  uint8    // one of the hash enums in the common package
+	Bits          uint64   // m
+	HashFunctions int      // k
+	Seeds         []uint32 // one per hash function
+	Codec         Codec
+	SecretKey     bool   // whether the filter uses a secret key, which must be supplied to load it
+	Signed        bool   // whether the filter is signed; the signature is only verified given WithTrustedKeys
+	SetBits       uint64 // the number of bits set
+	Elements      uint64 // an estimate of the number of keys added, from the proportion of bits set
+}
+
+func (i *Info) String() string {
+	return fmt.Sprintf("%s: %s, %d bits, %d %s hash functions, %s codec, ~%d elements (%.1f%% full)", i.FilterType,
+		i.Storage, i.Bits, i.HashFunctions, common.HashName(i.HashFunction), i.Codec, i.Elements,
+		100*float64(i.SetBits)/float64(max(i.Bits, 1)))
+}
+
+// Inspect reads a saved filter from r, returning its description without needing to know its key type.  The whole
+// filter is read, verifying its checksum and counting the bits set, but isn't kept.  Filters saved by the persist
+// package and signed filters can be inspected, but encrypted filters and filters in the gob format which preceded the
+// current one can't.  Of opts, only WithTrustedKeys is used: with it, the filter must be signed by one of the keys.
+func Inspect(r io.Reader, opts ...Option) (*Info, error) {
+	o := collectOptions(opts)
+	fr, signed, err := unwrapForOpen(r, o.trustedKeys)
+	if err != nil {
+		return nil, err
+	}
+	info, err := inspect(fr, signed)
+	if len(o.trustedKeys) > 0 {
+		err = verifyRest(fr, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// inspect describes the filter read from r, which has had its envelopes removed
+func inspect(r io.Reader, signed bool) (*Info, error) {
+	cr := &checksumReader{r: r, crc: crc32.New(castagnoli)}
+	header, err := readHeader(cr)
+	if err != nil {
+		return nil, err
+	}
+
+	counter := &bitCounter{}
+	switch header.storageType {
+	case storageTypeBitPacking:
+		if header.numBits == 0 || header.numBits%64 != 0 {
+			return nil, corruptf("invalid number of bits for BitPackingStorage: %d", header.numBits)
+		}
+		counter.size = header.numBits / 8
+	case storageTypeConventional:
+		if header.numBits == 0 {
+			return nil, corruptf("invalid number of bits for ConventionalStorage: 0")
+		}
+		counter.size = (header.numBits + 7) / 8
+	default:
+		return nil, corruptf("unsupported storage type %d", header.storageType)
+	}
+	if err := readPayload(cr, header.codec, counter); err != nil {
+		return nil, err
+	}
+	return newInfo(header, signed, counter.set), nil
+}
+
+// Handle is a filter opened by Open, whose key type is only known at run time
+type Handle struct {
+	Info   Info
+	filter untypedFilter
+}
+
+// Open loads the filter saved in the file at path, without needing to know its key type in advance.  Filters keyed by
+// strings, byte slices and the numeric types can be opened; the key type of others is reported by Inspect.  Keys are
+// encoded with the default key encoder unless WithKeyEncoder is given, as the encoder a filter was built with isn't
+// saved.  As with Inspect, encrypted and gob filters can't be opened.
+//
+// opts configure the opened filter as they do for New, so WithSecretKey must be given to open a filter using a secret
+// key, and with WithTrustedKeys the filter must be signed by one of the keys.  The hash functions and storage are those
+// of the saved filter.
+func Open(path string, opts ...Option) (*Handle, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	o := collectOptions(opts)
+	fr, signed, err := unwrapForOpen(f, o.trustedKeys)
+	if err != nil {
+		return nil, err
+	}
+	h, err := open(fr, signed, opts, o)
+	if len(o.trustedKeys) > 0 {
+		err = verifyRest(fr, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// open loads the filter read from r, which has had its envelopes removed
+func open(r io.Reader, signed bool, opts []Option, o *options) (*Handle, error) {
+	var headerBytes bytes.Buffer
+	header, err := readHeader(io.TeeReader(r, &headerBytes))
+	if err != nil {
+		return nil, err
+	}
+	keyType := keyTypeOf(header.filterType)
+	if header.flags&flagSecretKey != 0 && o.secretKey == nil {
+		return nil, incompatiblef("filter uses a secret key, which must be given with WithSecretKey")
+	}
+	openAs, ok := openers[keyType]
+	if !ok {
+		return nil, fmt.Errorf("%w: filters keyed by %s can't be opened without their type, load it with "+
+			"NewBloomFilter[%s]", ErrUnsupportedKey, keyType, keyType)
+	}
+
+	filter, err := openAs(io.MultiReader(&headerBytes, r), opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Handle{Info: *newInfo(header, signed, filter.setBits()), filter: filter}, nil
+}
+
+// Filter returns the *BloomFilter[T] which was opened, for use with a type switch or assertion
+func (h *Handle) Filter() any {
+	return h.filter.any()
+}
+
+// Contains reports whether key may be present in the filter.  It fails if key isn't of the filter's key type.
+func (h *Handle) Contains(key any) (bool, error) {
+	return h.filter.contains(key)
+}
+
+// Add adds key to the filter.  It fails if key isn't of the filter's key type.
+func (h *Handle) Add(key any) error {
+	return h.filter.add(key)
+}
+
+// ContainsHash reports whether a pre-hashed key may be present in the filter, as BloomFilter.ContainsHash does
+func (h *Handle) ContainsHash(h1, h2 uint64) bool {
+	return h.filter.containsHash(h1, h2)
+}
+
+// AddHash adds a pre-hashed key to the filter, as BloomFilter.AddHash does
+func (h *Handle) AddHash(h1, h2 uint64) error {
+	return h.filter.addHash(h1, h2)
+}
+
+// FilterAs returns the filter opened by h, if its key type is T
+func FilterAs[T any](h *Handle) (*BloomFilter[T], error) {
+	bf, ok := h.filter.any().(*BloomFilter[T])
+	if !ok {
+		return nil, &TypeMismatchError{Expected: fmt.Sprintf("%T", bf), Actual: h.Info.FilterType}
+	}
+	return bf, nil
+}
+
+// untypedFilter gives access to a *BloomFilter[T] without knowing T
+type untypedFilter interface {
+	any() any
+	contains(key any) (bool, error)
+	add(key any) error
+	containsHash(h1, h2 uint64) bool
+	addHash(h1, h2 uint64) error
+	setBits() uint64
+}
+
+type typedFilter[T any] struct {
+	bf *BloomFilter[T]
+}
+
+func (tf typedFilter[T]) any() any {
+	return tf.bf
+}
+
+func (tf typedFilter[T]) key(key any) (T, error) {
+	typed, ok := key.(T)
+	if !ok {
+		return typed, &TypeMismatchError{Expected: typeName[T](), Actual: fmt.Sprintf("%T", key)}
+	}
+	return typed, nil
+}
+
+func (tf typedFilter[T]) contains(key any) (bool, error) {
+	typed, err := tf.key(key)
+	if err != nil {
+		return false, err
+	}
+	return tf.bf.Contains(typed), nil
+}
+
+func (tf typedFilter[T]) add(key any) error {
+	typed, err := tf.key(key)
+	if err != nil {
+		return err
+	}
+	return tf.bf.Add(typed)
+}
+
+func (tf typedFilter[T]) containsHash(h1, h2 uint64) bool {
+	return tf.bf.ContainsHash(h1, h2)
+}
+
+func (tf typedFilter[T]) addHash(h1, h2 uint64) error {
+	return tf.bf.AddHash(h1, h2)
+}
+
+func (tf typedFilter[T]) setBits() uint64 {
+	counter := &bitCounter{}
+	storage := tf.bf.Storage.(payloadStorage)
+	size := storage.payloadSize()
+	buf := make([]byte, min(size, payloadBlockSize))
+	for offset := uint64(0); offset < size; offset += uint64(len(buf)) {
+		buf = buf[:min(size-offset, payloadBlockSize)]
+		storage.readPayload(buf, offset)
+		counter.writePayload(buf, offset)
+	}
+	return counter.set
+}
+
+// openAs loads a filter keyed by T, configured by opts
+func openAs[T any](r io.Reader, opts []Option) (untypedFilter, error) {
+	bf, err := New[T](opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := bf.readFrom(r); err != nil {
+		return nil, err
+	}
+	return typedFilter[T]{bf: bf}, nil
+}
+
+// openers loads filters of the key types Open supports, indexed by the name of the type
+var openers = map[string]func(io.Reader, []Option) (untypedFilter, error){
+	"string":  openAs[string],
+	"[]uint8": openAs[[]byte],
+	"int":     openAs[int],
+	"int8":    openAs[int8],
+	"int16":   openAs[int16],
+	"int32":   openAs[int32],
+	"int64":   openAs[int64],
+	"uint":    openAs[uint],
+	"uint8":   openAs[uint8],
+	"uint16":  openAs[uint16],
+	"uint32":  openAs[uint32],
+	"uint64":  openAs[uint64],
+	"float32": openAs[float32],
+	"float64": openAs[float64],
+}
+
+// keyTypeOf returns the type parameter of a filter type such as "*bloom.BloomFilter[string]"
+func keyTypeOf(filterType string) string {
+	start := strings.IndexByte(filterType, '[')
+	if start < 0 || !strings.HasSuffix(filterType, "]") {
+		return ""
+	}
+	return filterType[start+1 : len(filterType)-1]
+}
+
+// unwrapForOpen returns a reader of the filter in r, removing the persist package's type ID and any signature.  The
+// signature is only verified, once the returned reader has been read to its end, if there are trusted keys; they also
+// require the filter to be signed.
+func unwrapForOpen(r io.Reader, trusted []ed25519.PublicKey) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+	signed := false
+	for {
+		prefix, err := br.Peek(4)
+		if err != nil {
+			return nil, false, readError("filter", err)
+		}
+		switch string(prefix) {
+		case formatMagic:
+			if len(trusted) > 0 && !signed {
+				return nil, false, ErrUnsigned
+			}
+			return br, signed, nil
+		case persist.Magic:
+			id, err := persist.ReadTypeID(br)
+			if err != nil {
+				return nil, false, err
+			}
+			if id != typeID {
+				return nil, false, &TypeMismatchError{Expected: typeID, Actual: id}
+			}
+		case signedMagic:
+			unwrapped, err := (&signingEnvelope{trusted: trusted, skipVerify: len(trusted) == 0}).unwrap(br)
+			if err != nil {
+				return nil, false, err
+			}
+			br = bufio.NewReader(unwrapped)
+			signed = true
+		case encryptedMagic:
+			return nil, false, incompatiblef("filter is encrypted, load it with EncryptedPersistence")
+		default:
+			if prefix[0] == gzipID1 && prefix[1] == gzipID2 {
+				return nil, false, incompatiblef("filter is in the gob format, load it with NewBloomFilter and " +
+					"UnmarshalBinary or ReadFrom")
+			}
+			return nil, false, corruptf("not a filter file: bad magic bytes")
+		}
+	}
+}
+
+// verifyRest reads the rest of a signed filter, so that its signature is verified.  A filter which failed to load with
+// err is reported as modified, rather than corrupt, if its signature doesn't verify.
+func verifyRest(r io.Reader, err error) error {
+	if _, drainErr := io.Copy(io.Discard, r); drainErr != nil && (err == nil || errors.Is(drainErr, ErrBadSignature)) {
+		return drainErr
+	}
+	return err
+}
+
+// newInfo describes a filter from its header and the number of bits set
+func newInfo(header *fileHeader, signed bool, set uint64) *Info {
+	info := &Info{
+		FilterType:    header.filterType,
+		KeyType:       keyTypeOf(header.filterType),
+		HashFunction:  header.hashFunction,
+		Bits:          header.numBits,
+		HashFunctions: len(header.seeds),
+		Seeds:         header.seeds,
+		Codec:         header.codec,
+		SecretKey:     header.flags&flagSecretKey != 0,
+		Signed:        signed,
+		SetBits:       set,
+	}
+	switch header.storageType {
+	case storageTypeBitPacking:
+		info.Storage = "BitPackingStorage"
+	case storageTypeConventional:
+		info.Storage = "ConventionalStorage"
+	}
+
+	// the expected number of bits set by n keys is m(1 - e^(-kn/m)), so n is estimated as -(m/k) ln(1 - X/m)
+	m, k := float64(info.Bits), float64(info.HashFunctions)
+	switch {
+	case info.Bits == 0 || info.HashFunctions == 0:
+	case set >= info.Bits:
+		info.Elements = math.MaxUint64
+	default:
+		info.Elements = uint64(math.Round(-m / k * math.Log1p(-float64(set)/m)))
+	}
+	return info
+}
+
+// bitCounter is a payloadStorage which counts the bits set in a payload rather than storing it
+type bitCounter struct {
+	size uint64
+	set  uint64
+}
+
+func (bc *bitCounter) payloadSize() uint64 {
+	return bc.size
+}
+
+func (bc *bitCounter) readPayload(dst []byte, _ uint64) {
+	clear(dst)
+}
+
+func (bc *bitCounter) writePayload(src []byte, _ uint64) {
+	for len(src) >= 8 {
+		bc.set += uint64(bits.OnesCount64(binary.LittleEndian.Uint64(src)))
+		src = src[8:]
+	}
+	for _, b := range src {
+		bc.set += uint64(bits.OnesCount8(b))
+	}
+}
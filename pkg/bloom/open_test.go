@@ -0,0 +1,174 @@
+package bloom
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	bf := newTestFilter(t, 4, common.XXhash, NewBitPackingStorage[uint64](1<<16, nil)).WithCodec(CodecZstd, 0)
+	for i := uint64(0); i < 1000; i++ {
+		_ = bf.Add(i)
+	}
+	var buf bytes.Buffer
+	if _, err := bf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := Inspect(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Inspect() error = %v", err)
+	}
+	if info.KeyType != "uint64" || info.Storage != "BitPackingStorage" || info.HashFunction != common.XXhash ||
+		info.Bits != 1<<16 || info.HashFunctions != 4 || info.Codec != CodecZstd || info.SecretKey || info.Signed {
+		t.Errorf("Inspect() = %+v", info)
+	}
+	if info.SetBits == 0 || info.Elements < 950 || info.Elements > 1050 {
+		t.Errorf("Inspect() = %d bits set, ~%d elements, want about 1000 elements", info.SetBits, info.Elements)
+	}
+
+	// a signed filter, saved through the persist package, is described the same way
+	_, key, _ := ed25519.GenerateKey(nil)
+	signed, err := persist.Marshal(bf.WithSigningKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := Inspect(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatalf("Inspect() of a signed filter error = %v", err)
+	}
+	if !wrapped.Signed || wrapped.SetBits != info.SetBits {
+		t.Errorf("Inspect() of a signed filter = %+v, want %+v and signed", wrapped, info)
+	}
+
+	corrupt := bytes.Clone(buf.Bytes())
+	corrupt[len(corrupt)-8] ^= 1
+	if _, err := Inspect(bytes.NewReader(corrupt)); err == nil {
+		t.Errorf("Inspect() of a corrupt filter succeeded, want an error")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	bf := newTestFilter(t, 5, common.Murmur3, NewConventionalStorage[string](4096, nil)).
+		WithPersistence(filePersistence[string](dir, "strings.bin"))
+	for i := 0; i < 10; i++ {
+		_ = bf.Add("key-" + strconv.Itoa(i))
+	}
+	if err := bf.SavePersistence(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := Open(filepath.Join(dir, "strings.bin"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if h.Info.KeyType != "string" || h.Info.Storage != "ConventionalStorage" || h.Info.Elements != 10 {
+		t.Errorf("Open() info = %+v", h.Info)
+	}
+	if ok, err := h.Contains("key-3"); !ok || err != nil {
+		t.Errorf("Contains(key-3) = %v, %v, want true", ok, err)
+	}
+	if _, err := h.Contains(3); err == nil {
+		t.Errorf("Contains(3) on a string filter succeeded, want an error")
+	}
+	if err := h.Add("new"); err != nil {
+		t.Errorf("Add() error = %v", err)
+	}
+	typed, err := FilterAs[string](h)
+	if err != nil || !typed.Contains("new") {
+		t.Errorf("FilterAs[string]() = %v, %v", typed, err)
+	}
+	if _, err := FilterAs[int](h); err == nil {
+		t.Errorf("FilterAs[int]() of a string filter succeeded, want an error")
+	}
+
+	// filters of key types Open doesn't know are still described by Inspect
+	type userID string
+	custom := newTestFilter(t, 3, common.Murmur3, NewBitPackingStorage[userID](64, nil)).
+		WithPersistence(filePersistence[userID](dir, "custom.bin"))
+	if err := custom.SavePersistence(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(filepath.Join(dir, "custom.bin")); err == nil {
+		t.Errorf("Open() of a filter with a custom key type succeeded, want an error")
+	}
+	f, _ := os.Open(filepath.Join(dir, "custom.bin"))
+	defer f.Close()
+	if info, err := Inspect(f); err != nil || info.KeyType == "" {
+		t.Errorf("Inspect() of a filter with a custom key type = %+v, %v", info, err)
+	}
+}
+
+func TestOpen_Options(t *testing.T) {
+	dir := t.TempDir()
+	public, private := newSigningKey(t, 1)
+	other, _ := newSigningKey(t, 2)
+	signed := newSignedFilter(t, private, 4096)
+	if err := filePersistence[string](dir, "signed.bin").Save(signed); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "signed.bin"))
+	tampered := bytes.Clone(data)
+	tampered[len(tampered)/2] ^= 1
+	unsigned := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](4096, nil))
+	plain, _ := unsigned.MarshalBinary()
+
+	tests := map[string]struct {
+		data []byte
+		keys []ed25519.PublicKey
+		want error
+	}{
+		"trusted signer":   {data: data, keys: []ed25519.PublicKey{public}},
+		"untrusted signer": {data: data, keys: []ed25519.PublicKey{other}, want: ErrUntrustedSigner},
+		"modified":         {data: tampered, keys: []ed25519.PublicKey{public}, want: ErrBadSignature},
+		"unsigned":         {data: plain, keys: []ed25519.PublicKey{public}, want: ErrUnsigned},
+		"gob":              {data: marshalGob(unsigned), want: ErrIncompatible},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "filter.bin")
+			if err := os.WriteFile(path, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			opts := []Option{WithTrustedKeys(tt.keys...)}
+			if _, err := Inspect(bytes.NewReader(tt.data), opts...); !errors.Is(err, tt.want) {
+				t.Errorf("Inspect() error = %v, want %v", err, tt.want)
+			}
+			h, err := Open(path, opts...)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Open() error = %v, want %v", err, tt.want)
+			}
+			if err == nil && !h.Info.Signed {
+				t.Errorf("Open() info = %+v, want signed", h.Info)
+			}
+		})
+	}
+
+	var secret [common.SecretKeySize]byte
+	secret[0] = 1
+	keyed, _ := NewBloomFilter[string]().WithSecretKey(secret)
+	keyed, _ = keyed.WithHashFunctions(3, common.SipHash)
+	keyed, _ = keyed.WithStorage(NewBitPackingStorage[string](4096, nil))
+	_ = keyed.Add("key")
+	if err := filePersistence[string](dir, "keyed.bin").Save(keyed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(filepath.Join(dir, "keyed.bin")); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("Open() of a keyed filter without its key error = %v, want ErrIncompatible", err)
+	}
+	h, err := Open(filepath.Join(dir, "keyed.bin"), WithSecretKey(secret))
+	if err != nil {
+		t.Fatalf("Open() of a keyed filter with its key error = %v", err)
+	}
+	if ok, _ := h.Contains("key"); !ok {
+		t.Errorf("Contains() = false in a keyed filter opened with its key")
+	}
+}
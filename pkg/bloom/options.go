@@ -0,0 +1,203 @@
+package bloom
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"reflect"
+)
+
+// Option configures a filter created by New.  Each option matches the builder method of the same name; as Option isn't
+// generic, options taking a value of the filter's key type accept any, and New checks its type.
+type Option func(*options)
+
+// options collects the Options passed to New, so that they can be validated together and applied in the right order
+type options struct {
+	numHashFunctions int
+	hashFunc         uint8
+	hashSet          bool
+	storage          any // a Storage[T]
+	elements         uint64
+	errorRate        float64
+	autoConfigure    bool
+	seedStrategy     SeedStrategy
+	secretKey        *[common.SecretKeySize]byte
+	keyEncoder       any // a common.KeyEncoder[T]
+	codec            Codec
+	codecLevel       int
+	codecSet         bool
+	persistence      any // a Persistence[T]
+	signingKey       ed25519.PrivateKey
+	trustedKeys      []ed25519.PublicKey
+	maxLoadBits      uint64
+}
+
+// New creates a BloomFilter configured by opts, which may be given in any order.  The options are validated together,
+// so that conflicting or incomplete configurations are reported as errors rather than producing a filter which fails
+// later.  With neither WithHashFunctions nor WithAutoConfigure the filter has no storage, ready to be loaded.
+func New[T any](opts ...Option) (*BloomFilter[T], error) {
+	o := collectOptions(opts)
+	switch {
+	case o.autoConfigure && (o.hashSet || o.storage != nil):
+		return nil, errors.New("WithAutoConfigure chooses the hash functions and storage, and can't be combined with " +
+			"WithHashFunctions or WithStorage")
+	case o.hashSet && o.storage == nil:
+		return nil, errors.New("WithHashFunctions requires WithStorage")
+	case o.storage != nil && !o.hashSet:
+		return nil, errors.New("WithStorage requires WithHashFunctions")
+	}
+
+	// the hash function and seeds depend on the secret key, key encoder and seed strategy, so they are set first
+	bf := NewBloomFilter[T]()
+	bf.secretKey = o.secretKey
+	if o.seedStrategy != nil {
+		if err := checkSeedStrategy(o.seedStrategy); err != nil {
+			return nil, err
+		}
+		bf.seedStrategy = o.seedStrategy
+	}
+	if o.keyEncoder != nil {
+		encoder, ok := o.keyEncoder.(common.KeyEncoder[T])
+		if !ok {
+			return nil, &TypeMismatchError{Expected: fmt.Sprintf("common.KeyEncoder[%s]", typeName[T]()),
+				Actual: fmt.Sprintf("%T", o.keyEncoder)}
+		}
+		bf.keyEncoder = encoder
+	}
+	if o.persistence != nil {
+		persistence, ok := o.persistence.(Persistence[T])
+		if !ok {
+			return nil, &TypeMismatchError{Expected: fmt.Sprintf("bloom.Persistence[%s]", typeName[T]()),
+				Actual: fmt.Sprintf("%T", o.persistence)}
+		}
+		bf.persistence = persistence
+	}
+	if o.codecSet {
+		bf.WithCodec(o.codec, o.codecLevel)
+	}
+	bf.signingKey = o.signingKey
+	bf.trustedKeys = o.trustedKeys
+	bf.maxLoadBits = o.maxLoadBits
+
+	if o.autoConfigure {
+		if _, err := bf.WithAutoConfigure(o.elements, o.errorRate); err != nil {
+			return nil, err
+		}
+		return bf, nil
+	}
+	if o.hashSet {
+		storage, ok := o.storage.(Storage[T])
+		if !ok {
+			return nil, &TypeMismatchError{Expected: fmt.Sprintf("bloom.Storage[%s]", typeName[T]()),
+				Actual: fmt.Sprintf("%T", o.storage)}
+		}
+		if err := bf.setHashFunctions(o.numHashFunctions, o.hashFunc); err != nil {
+			return nil, err
+		}
+		if _, err := bf.WithStorage(storage); err != nil {
+			return nil, err
+		}
+	}
+	return bf, nil
+}
+
+// collectOptions applies opts to an empty options
+func collectOptions(opts []Option) *options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &o
+}
+
+// typeName returns the name of T, for error messages
+func typeName[T any]() string {
+	return reflect.TypeOf((*T)(nil)).Elem().String()
+}
+
+// WithHashFunctions sets the number of hash functions and the hash function, one of the hash enums in the common
+// package
+func WithHashFunctions(num int, hashFunc uint8) Option {
+	return func(o *options) {
+		o.numHashFunctions = num
+		o.hashFunc = hashFunc
+		o.hashSet = true
+	}
+}
+
+// WithStorage sets the filter's storage, which must be a Storage[T] for the T New is called with
+func WithStorage(storage any) Option {
+	return func(o *options) {
+		o.storage = storage
+	}
+}
+
+// WithAutoConfigure chooses the hash functions and storage for the number of elements and error rate, as the
+// BloomFilter method of the same name does
+func WithAutoConfigure(elements uint64, requestedErrorRate float64) Option {
+	return func(o *options) {
+		o.elements = elements
+		o.errorRate = requestedErrorRate
+		o.autoConfigure = true
+	}
+}
+
+// WithSeedStrategy sets the SeedStrategy used to generate the seeds for each hash function
+func WithSeedStrategy(strategy SeedStrategy) Option {
+	return func(o *options) {
+		o.seedStrategy = strategy
+	}
+}
+
+// WithSecretKey enables keyed hashing, as the BloomFilter method of the same name does
+func WithSecretKey(secret [common.SecretKeySize]byte) Option {
+	return func(o *options) {
+		o.secretKey = &secret
+	}
+}
+
+// WithKeyEncoder sets the encoder used to turn keys into the bytes which are hashed, which must be a
+// common.KeyEncoder[T] for the T New is called with
+func WithKeyEncoder(encoder any) Option {
+	return func(o *options) {
+		o.keyEncoder = encoder
+	}
+}
+
+// WithCodec sets the codec, and its compression level, used when the filter is persisted
+func WithCodec(codec Codec, level int) Option {
+	return func(o *options) {
+		o.codec = codec
+		o.codecLevel = level
+		o.codecSet = true
+	}
+}
+
+// WithPersistence sets the filter's persistence mechanism, which must be a Persistence[T] for the T New is called with
+func WithPersistence(persistence any) Option {
+	return func(o *options) {
+		o.persistence = persistence
+	}
+}
+
+// WithSigningKey signs the filter with key whenever it is saved or marshaled
+func WithSigningKey(key ed25519.PrivateKey) Option {
+	return func(o *options) {
+		o.signingKey = key
+	}
+}
+
+// WithTrustedKeys requires loaded filters to be signed by one of keys
+func WithTrustedKeys(keys ...ed25519.PublicKey) Option {
+	return func(o *options) {
+		o.trustedKeys = keys
+	}
+}
+
+// WithMaxLoadBits limits the size of the filters which will be loaded
+func WithMaxLoadBits(bits uint64) Option {
+	return func(o *options) {
+		o.maxLoadBits = bits
+	}
+}
@@ -0,0 +1,127 @@
+package bloom
+
+import (
+	"bytes"
+	"errors"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"math"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	var secret [common.SecretKeySize]byte
+	secret[0] = 1
+	opts := []Option{
+		WithStorage(NewBitPackingStorage[string](1024, nil)),
+		WithHashFunctions(4, common.SipHash),
+		WithSeedStrategy(NewPassphraseSeeds("correct horse")),
+		WithSecretKey(secret),
+		WithCodec(CodecZstd, 0),
+	}
+	bf, err := New[string](opts...)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	_ = bf.Add("key")
+	want, _ := bf.MarshalBinary()
+
+	// the same options in the opposite order configure the same filter
+	reversed := []Option{
+		WithCodec(CodecZstd, 0),
+		WithSecretKey(secret),
+		WithSeedStrategy(NewPassphraseSeeds("correct horse")),
+		WithHashFunctions(4, common.SipHash),
+		WithStorage(NewBitPackingStorage[string](1024, nil)),
+	}
+	other, err := New[string](reversed...)
+	if err != nil {
+		t.Fatalf("New() with reversed options error = %v", err)
+	}
+	_ = other.Add("key")
+	if got, _ := other.MarshalBinary(); !bytes.Equal(got, want) {
+		t.Errorf("New() with reversed options configured a different filter")
+	}
+
+	auto, err := New[int](WithAutoConfigure(1000, 0.01), WithPersistence(filePersistence[int](t.TempDir(), "f")))
+	if err != nil || auto.Storage == nil || auto.persistence == nil {
+		t.Errorf("New() with WithAutoConfigure = %v, %v", auto, err)
+	}
+	if empty, err := New[int](); err != nil || empty.Storage != nil {
+		t.Errorf("New() without options = %v, %v, want a filter without storage", empty, err)
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	var secret [common.SecretKeySize]byte
+	storage := func() Option { return WithStorage(NewBitPackingStorage[string](1024, nil)) }
+	tests := map[string][]Option{
+		"auto configure and storage": {WithAutoConfigure(1000, 0.01), storage()},
+		"auto configure and hash functions": {
+			WithAutoConfigure(1000, 0.01), WithHashFunctions(3, common.Murmur3), storage(),
+		},
+		"hash functions without storage": {WithHashFunctions(3, common.Murmur3)},
+		"storage without hash functions": {storage()},
+		"storage of another key type": {
+			WithHashFunctions(3, common.Murmur3), WithStorage(NewBitPackingStorage[int](1024, nil)),
+		},
+		"storage without bits": {
+			WithHashFunctions(3, common.Murmur3), WithStorage(NewConventionalStorage[string](0, nil)),
+		},
+		"unknown hash function":    {WithHashFunctions(3, 200), storage()},
+		"no hash functions":        {WithHashFunctions(0, common.Murmur3), storage()},
+		"unkeyed hash with secret": {WithHashFunctions(3, common.Murmur3), WithSecretKey(secret), storage()},
+		"persistence of another key type": {
+			WithHashFunctions(3, common.Murmur3), storage(), WithPersistence(filePersistence[int](".", "f")),
+		},
+		"key encoder of another key type": {
+			WithHashFunctions(3, common.Murmur3), storage(), WithKeyEncoder(common.DefaultKeyEncoder[int]()),
+		},
+		"no elements":        {WithAutoConfigure(0, 0.01)},
+		"invalid error rate": {WithAutoConfigure(1000, 1.5)},
+		"too many elements":  {WithAutoConfigure(1<<40, 0.01)},
+	}
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			if bf, err := New[string](opts...); err == nil {
+				t.Errorf("New() = %v, want an error", bf)
+			}
+		})
+	}
+}
+
+func TestBloomFilter_WithHashFunctionsInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		num      int
+		hashFunc uint8
+	}{{0, common.Murmur3}, {maxHashFunctions + 1, common.Murmur3}, {3, 200}} {
+		bf := NewBloomFilter[string]()
+		if _, err := bf.WithHashFunctions(tt.num, tt.hashFunc); err == nil {
+			t.Errorf("WithHashFunctions(%d, %d) succeeded, want an error", tt.num, tt.hashFunc)
+		}
+		if bf.numHashFunctions != 0 || bf.hashFunction != nil {
+			t.Errorf("failed WithHashFunctions(%d, %d) modified the filter", tt.num, tt.hashFunc)
+		}
+	}
+}
+
+func TestBloomFilter_WithAutoConfigureTooLarge(t *testing.T) {
+	for _, tt := range []struct {
+		elements  uint64
+		errorRate float64
+		maxBits   uint64
+	}{
+		{1 << 40, 0.01, 0},
+		{10_000_000, 1e-300, 0},
+		{1 << 63, 1e-300, math.MaxUint64},
+		// about 5*10^9 bits are within the limit, but are rounded up to 2^33 bits of BitPackingStorage
+		{1_500_000_000, 0.2, 1<<32 + 1<<31},
+	} {
+		bf := NewBloomFilter[string]().WithMaxLoadBits(tt.maxBits)
+		if _, err := bf.WithAutoConfigure(tt.elements, tt.errorRate); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("WithAutoConfigure(%d, %v) error = %v, want ErrTooLarge", tt.elements, tt.errorRate, err)
+		}
+		if bf.Storage != nil {
+			t.Errorf("failed WithAutoConfigure(%d, %v) set the storage", tt.elements, tt.errorRate)
+		}
+	}
+}
@@ -3,129 +3,373 @@ package bloom
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/hmac"
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"github.com/dryack/GoCeannaithe/pkg/common"
-	"os"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"hash/crc32"
+	"io"
 	"reflect"
 )
 
-type Persistence[T common.Hashable] interface {
+type Persistence[T any] interface {
 	Save(*BloomFilter[T]) error
 	Load(*BloomFilter[T]) error
 }
 
-type FilePersistence[T common.Hashable] struct {
-	directory string
-	filename  string
+// DefaultFileMode is the permission given to files written by CheckpointPersistence unless WithFileMode is used, and to
+// the logs of WALPersistence
+const DefaultFileMode = persist.DefaultFileMode
+
+// typeID identifies Bloom filters among the data structures saved by the persist package
+const typeID = "bloom"
+
+// TypeID implements persist.Persistable
+func (bf *BloomFilter[T]) TypeID() string {
+	return typeID
 }
 
-func NewFilePersistence[T common.Hashable](directory, filename string) *FilePersistence[T] {
-	return &FilePersistence[T]{directory: directory, filename: filename}
+// GenericPersistence saves filters with a persist.Persistence, such as persist.FilePersistence, persist.BlobPersistence
+// or the backends in persist's subpackages, for use with WithPersistence
+type GenericPersistence[T any] struct {
+	persistence persist.Persistence
 }
 
-type BloomFilterData[T common.Hashable] struct {
+// NewGenericPersistence creates a GenericPersistence saving filters with persistence
+func NewGenericPersistence[T any](persistence persist.Persistence) *GenericPersistence[T] {
+	return &GenericPersistence[T]{persistence: persistence}
+}
+
+// Save saves the filter with the wrapped persistence
+func (gp *GenericPersistence[T]) Save(bf *BloomFilter[T]) error {
+	return gp.saveEnveloped(bf, nil)
+}
+
+// Load loads the filter with the wrapped persistence
+func (gp *GenericPersistence[T]) Load(bf *BloomFilter[T]) error {
+	return gp.loadEnveloped(bf, nil)
+}
+
+func (gp *GenericPersistence[T]) saveEnveloped(bf *BloomFilter[T], envelopes []envelope) error {
+	return gp.persistence.Save(&persistable[T]{bf: bf, envelopes: envelopes})
+}
+
+func (gp *GenericPersistence[T]) loadEnveloped(bf *BloomFilter[T], envelopes []envelope) error {
+	return gp.persistence.Load(&persistable[T]{bf: bf, envelopes: envelopes})
+}
+
+// persistable is the persist.Persistable a GenericPersistence saves a filter as, wrapped in envelopes besides the
+// filter's own.  It is also a persist.Paged, for filters with BitPackingStorage and no envelopes.
+type persistable[T any] struct {
+	bf        *BloomFilter[T]
+	envelopes []envelope
+}
+
+func (p *persistable[T]) TypeID() string {
+	return typeID
+}
+
+func (p *persistable[T]) MarshalBinary() ([]byte, error) {
+	return p.bf.marshalEnveloped(p.envelopes)
+}
+
+func (p *persistable[T]) UnmarshalBinary(data []byte) error {
+	return p.bf.unmarshalEnveloped(data, p.envelopes)
+}
+
+func (p *persistable[T]) WriteTo(w io.Writer) (int64, error) {
+	return p.bf.writeEnveloped(w, p.envelopes)
+}
+
+func (p *persistable[T]) ReadFrom(r io.Reader) (int64, error) {
+	return p.bf.readEnveloped(r, p.envelopes)
+}
+
+// BloomFilterData is the gob encoded representation of a filter used before the current binary format; it is kept so
+// that older files can still be loaded
+type BloomFilterData[T any] struct {
 	NumHashFunctions int
 	Seeds            []uint32
 	HashFunctionEnum uint8
 	StorageData      []byte
 	StorageType      string
 	FilterType       string
+	KeyCheck         []byte // set only when the filter uses a secret key, which is itself never stored
 }
 
+// MarshalBinary serializes the filter in the binary format described in format.go
 func (bf *BloomFilter[T]) MarshalBinary() ([]byte, error) {
-	gob.Register(&BloomFilterData[T]{})
-	data := &BloomFilterData[T]{
-		NumHashFunctions: bf.numHashFunctions,
-		Seeds:            bf.seeds,
-		HashFunctionEnum: bf.hashEnum,
-		FilterType:       reflect.TypeOf(bf).String(),
+	return bf.marshalEnveloped(nil)
+}
+
+// marshalEnveloped serializes the filter as MarshalBinary does, wrapped in envelopes outside any of its own
+func (bf *BloomFilter[T]) marshalEnveloped(envelopes []envelope) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := bf.writeEnveloped(&buf, envelopes); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary restores a filter serialized by MarshalBinary, or by versions of GoCeannaithe which predate the
+// current format.  The filter is left unchanged if an error is returned.
+func (bf *BloomFilter[T]) UnmarshalBinary(data []byte) error {
+	return bf.unmarshalEnveloped(data, nil)
+}
+
+// unmarshalEnveloped restores a filter as UnmarshalBinary does, from data wrapped in envelopes outside any of its own
+func (bf *BloomFilter[T]) unmarshalEnveloped(data []byte, envelopes []envelope) error {
+	if len(bf.readEnvelopes(envelopes)) > 0 || bytes.HasPrefix(data, []byte(encryptedMagic)) ||
+		bytes.HasPrefix(data, []byte(signedMagic)) {
+		_, err := bf.readEnveloped(bytes.NewReader(data), envelopes)
+		return err
 	}
+	if bytes.HasPrefix(data, []byte(formatMagic)) {
+		return bf.readFrom(bytes.NewReader(data))
+	}
+	return bf.unmarshalGob(data)
+}
 
-	switch storage := bf.Storage.(type) {
+// WithMaxLoadBits limits the size of the filters which UnmarshalBinary, ReadFrom and persistence will load, failing
+// with ErrTooLarge rather than allocating storage for a larger one.  Filters received from untrusted sources should be
+// loaded with a limit suited to the memory available; note that ConventionalStorage takes a byte per bit.  Without a
+// limit, filters of up to 2^32 bits are loaded.
+func (bf *BloomFilter[T]) WithMaxLoadBits(bits uint64) *BloomFilter[T] {
+	bf.maxLoadBits = bits
+	return bf
+}
+
+// loadLimit returns the largest number of bits of a filter which will be loaded
+func (bf *BloomFilter[T]) loadLimit() uint64 {
+	if bf.maxLoadBits == 0 {
+		return defaultMaxLoadBits
+	}
+	return bf.maxLoadBits
+}
+
+// fileHeader describes the filter's parameters for serialization
+func (bf *BloomFilter[T]) fileHeader() (*fileHeader, payloadStorage, error) {
+	if !common.IsPersistable(bf.hashEnum) {
+		return nil, nil, errors.New("hash function can't be persisted: its seed is chosen at random per process")
+	}
+
+	header := &fileHeader{
+		hashFunction:  bf.hashEnum,
+		indexStrategy: indexStrategySeeded,
+		codec:         CodecGzip,
+		seeds:         bf.seeds,
+		filterType:    reflect.TypeOf(bf).String(),
+	}
+	if bf.codecSet {
+		header.codec = bf.codec
+		header.codecLevel = bf.codecLevel
+	}
+	if bf.secretKey != nil {
+		header.flags |= flagSecretKey
+		header.keyCheck = common.SecretKeyCheck(*bf.secretKey)
+	}
+
+	var storage payloadStorage
+	switch s := bf.Storage.(type) {
 	case *BitPackingStorage[T]:
-		data.StorageType = "BitPackingStorage"
-		bits := make([]byte, len(storage.bits)*8)
-		for i, v := range storage.bits {
-			binary.LittleEndian.PutUint64(bits[i*8:], v)
-		}
-		data.StorageData = bits
+		header.storageType = storageTypeBitPacking
+		header.numBits = s.numBits()
+		storage = s
 	case *ConventionalStorage[T]:
-		data.StorageType = "ConventionalStorage"
-		bits := make([]byte, (len(storage.bits)+7)/8)
-		for i, b := range storage.bits {
-			if b {
-				bits[i/8] |= 1 << (i % 8)
-			}
-		}
-		data.StorageData = bits
+		header.storageType = storageTypeConventional
+		header.numBits = s.numBits()
+		storage = s
+	case nil:
+		return nil, nil, ErrNoStorage
 	default:
-		return nil, errors.New("unsupported storage type")
+		return nil, nil, fmt.Errorf("%w: %T", ErrUnsupportedStorage, bf.Storage)
 	}
+	return header, storage, nil
+}
 
-	var buf bytes.Buffer
-	gzipWriter := gzip.NewWriter(&buf)
-	encoder := gob.NewEncoder(gzipWriter)
-	if err := encoder.Encode(data); err != nil {
+// readFrom reads a filter in the current binary format from r
+func (bf *BloomFilter[T]) readFrom(r io.Reader) error {
+	loaded, err := bf.decode(r)
+	if err != nil {
+		return err
+	}
+	loaded.commit()
+	return nil
+}
+
+// loadedFilter holds a filter which has been read, but not yet used to replace the BloomFilter it was read for
+type loadedFilter[T any] struct {
+	bf           *BloomFilter[T]
+	header       *fileHeader
+	storage      Storage[T]
+	hashFunction func(T, uint32) (uint64, error)
+}
+
+// decode reads a filter in the current binary format from r, without changing bf
+func (bf *BloomFilter[T]) decode(r io.Reader) (*loadedFilter[T], error) {
+	cr := &checksumReader{r: r, crc: crc32.New(castagnoli)}
+	header, err := readHeader(cr)
+	if err != nil {
 		return nil, err
 	}
-	if err := gzipWriter.Close(); err != nil {
+
+	storage, hashFunction, err := bf.storageFor(header)
+	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	if err := readPayload(cr, header.codec, storage.(payloadStorage)); err != nil {
+		return nil, err
+	}
+	return &loadedFilter[T]{bf: bf, header: header, storage: storage, hashFunction: hashFunction}, nil
 }
 
-func (bf *BloomFilter[T]) UnmarshalBinary(data []byte) error {
+// commit replaces the BloomFilter with the filter which was read
+func (lf *loadedFilter[T]) commit() {
+	lf.bf.commitLoad(lf.header, lf.storage, lf.hashFunction)
+}
+
+// storageFor validates a header read from a serialized filter, and returns empty storage and the hash function for it.
+// The storage's bits are only allocated as its payload is written, which must be done in full before it is used.
+func (bf *BloomFilter[T]) storageFor(header *fileHeader) (Storage[T], func(T, uint32) (uint64, error), error) {
+	if header.indexStrategy != indexStrategySeeded {
+		return nil, nil, corruptf("unsupported index strategy %d", header.indexStrategy)
+	}
+	if (header.flags&flagSecretKey != 0) != (header.keyCheck != nil) {
+		return nil, nil, corruptf("filter header's secret key flag doesn't match its key check")
+	}
+	if err := bf.checkCompatible(header.filterType, header.keyCheck, header.seeds); err != nil {
+		return nil, nil, err
+	}
+	hashFunction, ok := bf.hashFunctionFor(header.hashFunction)
+	if !ok || !common.IsPersistable(header.hashFunction) {
+		return nil, nil, corruptf("unsupported hash function %d", header.hashFunction)
+	}
+
+	if header.numBits == 0 {
+		return nil, nil, corruptf("invalid number of bits: 0")
+	}
+	if header.numBits > bf.loadLimit() {
+		return nil, nil, fmt.Errorf("%w: %d bits, limit is %d", ErrTooLarge, header.numBits, bf.loadLimit())
+	}
+	switch header.storageType {
+	case storageTypeBitPacking:
+		if header.numBits%64 != 0 {
+			return nil, nil, corruptf("invalid number of bits for BitPackingStorage: %d", header.numBits)
+		}
+		// the bits are allocated by writePayload as the payload is read
+		return &BitPackingStorage[T]{
+			seeds:       header.seeds,
+			bitsLength:  header.numBits / 64,
+			bloomFilter: bf,
+		}, hashFunction, nil
+	case storageTypeConventional:
+		return &ConventionalStorage[T]{
+			seeds:       header.seeds,
+			sliceLength: header.numBits,
+			bloomFilter: bf,
+		}, hashFunction, nil
+	default:
+		return nil, nil, corruptf("unsupported storage type %d", header.storageType)
+	}
+}
+
+// commitLoad replaces the filter's parameters and storage with those which have been loaded
+func (bf *BloomFilter[T]) commitLoad(header *fileHeader, storage Storage[T], hashFunction func(T, uint32) (uint64, error)) {
+	bf.numHashFunctions = len(header.seeds)
+	bf.seeds = header.seeds
+	if !bf.codecSet {
+		// keep saving with the codec the filter was loaded with
+		bf.codec = header.codec
+		bf.codecSet = true
+	}
+	bf.hashFunction = hashFunction
+	bf.hashEnum = header.hashFunction
+	bf.Storage = storage
+}
+
+// checkUnwrapped returns an error if the filter is signed or verified, which persistence writing the filter's bits
+// directly (rather than with WriteTo) can't do
+func (bf *BloomFilter[T]) checkUnwrapped() error {
+	if bf.signingKey != nil || len(bf.trustedKeys) > 0 {
+		return errors.New("persistence writes the filter's bits directly, and can't sign, verify or encrypt them")
+	}
+	return nil
+}
+
+// checkCompatible verifies that a serialized filter can be loaded into bf
+func (bf *BloomFilter[T]) checkCompatible(filterType string, keyCheck []byte, seeds []uint32) error {
+	if filterType != reflect.TypeOf(bf).String() {
+		return &TypeMismatchError{Expected: reflect.TypeOf(bf).String(), Actual: filterType}
+	}
+
+	switch {
+	case keyCheck != nil && bf.secretKey == nil:
+		return incompatiblef("filter was saved with a secret key, supply it with WithSecretKey before loading")
+	case keyCheck == nil && bf.secretKey != nil:
+		return incompatiblef("filter was saved without a secret key, but one was supplied")
+	case keyCheck != nil && !hmac.Equal(keyCheck, common.SecretKeyCheck(*bf.secretKey)):
+		return incompatiblef("secret key doesn't match the key the filter was saved with")
+	}
+
+	if bf.seedStrategy != nil {
+		if err := bf.seedStrategy.Verify(seeds); err != nil {
+			return incompatiblef("filter seeds don't match the seed strategy: %w", err)
+		}
+	}
+	return nil
+}
+
+// unmarshalGob restores a filter saved as gzip compressed gob of BloomFilterData, the format used before the current
+// binary format was introduced
+func (bf *BloomFilter[T]) unmarshalGob(data []byte) error {
 	buf := bytes.NewBuffer(data)
 	gzipReader, err := gzip.NewReader(buf)
 	if err != nil {
-		return err
+		return corruptf("%w", err)
 	}
 	defer gzipReader.Close()
 
+	// the storage data is limited to the load limit, allowing for the rest of the filter's fields
 	var bfData BloomFilterData[T]
-	decoder := gob.NewDecoder(gzipReader)
+	decoder := gob.NewDecoder(io.LimitReader(gzipReader, int64(bf.loadLimit()/8)+1<<16))
 	if err := decoder.Decode(&bfData); err != nil {
-		return err
+		return corruptf("%w", err)
 	}
 
-	if bfData.FilterType != reflect.TypeOf(bf).String() {
-		return fmt.Errorf(
-			"type mismatch: type during unmarshal (%s) doesn't match type during marshal (%s)",
-			bfData.FilterType,
-			reflect.TypeOf(bf).String(),
-		)
+	if bfData.NumHashFunctions != len(bfData.Seeds) || len(bfData.Seeds) == 0 || len(bfData.Seeds) > maxHashFunctions {
+		return corruptf("filter has %d hash functions and %d seeds", bfData.NumHashFunctions, len(bfData.Seeds))
+	}
+	if err := bf.checkCompatible(bfData.FilterType, bfData.KeyCheck, bfData.Seeds); err != nil {
+		return err
 	}
 
-	bf.numHashFunctions = bfData.NumHashFunctions
-	bf.seeds = bfData.Seeds
-
-	switch bfData.HashFunctionEnum {
-	case common.Murmur3:
-		bf.hashFunction = common.HashKeyMurmur3[T]
-	case common.Sha256:
-		bf.hashFunction = common.HashKeySha256[T]
-	case common.Sha512:
-		bf.hashFunction = common.HashKeySha512[T]
-	case common.SipHash:
-		bf.hashFunction = common.HashKeySipHash[T]
-	case common.XXhash:
-		bf.hashFunction = common.HashKeyXXhash[T]
-	default:
-		panic("unsupported hash function, this is probably a bug")
+	hashFunction, ok := bf.hashFunctionFor(bfData.HashFunctionEnum)
+	if !ok || !common.IsPersistable(bfData.HashFunctionEnum) {
+		return corruptf("unsupported hash function %d", bfData.HashFunctionEnum)
+	}
+	if len(bfData.StorageData) == 0 {
+		return corruptf("filter has no storage data")
+	}
+	if uint64(len(bfData.StorageData))*8 > bf.loadLimit() {
+		return fmt.Errorf("%w: %d bits, limit is %d", ErrTooLarge, len(bfData.StorageData)*8, bf.loadLimit())
 	}
 
+	var storage Storage[T]
 	switch bfData.StorageType {
 	case "BitPackingStorage":
+		if len(bfData.StorageData)%8 != 0 {
+			return corruptf("invalid storage data length for BitPackingStorage: %d", len(bfData.StorageData))
+		}
 		bits := make([]uint64, len(bfData.StorageData)/8)
 		for i := range bits {
 			bits[i] = binary.LittleEndian.Uint64(bfData.StorageData[i*8:])
 		}
-		bf.Storage = &BitPackingStorage[T]{
+		storage = &BitPackingStorage[T]{
 			bits:        bits,
-			seeds:       bf.seeds,
+			seeds:       bfData.Seeds,
 			bitsLength:  uint64(len(bits)),
 			bloomFilter: bf,
 		}
@@ -134,46 +378,20 @@ func (bf *BloomFilter[T]) UnmarshalBinary(data []byte) error {
 		for i := range bits {
 			bits[i] = bfData.StorageData[i/8]&(1<<(i%8)) != 0
 		}
-		bf.Storage = &ConventionalStorage[T]{
+		storage = &ConventionalStorage[T]{
 			bits:        bits,
-			seeds:       bf.seeds,
+			seeds:       bfData.Seeds,
 			sliceLength: uint64(len(bits)),
 			bloomFilter: bf,
 		}
 	default:
-		return errors.New("unsupported storage type")
+		return corruptf("unsupported storage type %q", bfData.StorageType)
 	}
 
+	bf.numHashFunctions = bfData.NumHashFunctions
+	bf.seeds = bfData.Seeds
+	bf.hashFunction = hashFunction
+	bf.hashEnum = bfData.HashFunctionEnum
+	bf.Storage = storage
 	return nil
 }
-
-func (fp *FilePersistence[T]) Save(bf *BloomFilter[T]) error {
-	data, err := bf.MarshalBinary()
-	if err != nil {
-		return err
-	}
-
-	tempfile, err := os.CreateTemp(fp.directory, fp.filename+"*")
-	if err != nil {
-		return err
-	}
-
-	_, err = tempfile.Write(data)
-	if err != nil {
-		return err
-	}
-	tempfile.Close() // manually close the tempfile so it can be renamed
-	return os.Rename(tempfile.Name(), fp.getFullPath())
-}
-
-func (fp *FilePersistence[T]) Load(bf *BloomFilter[T]) error {
-	data, err := os.ReadFile(fp.filename)
-	if err != nil {
-		return errors.New("error loading bloom filter: " + err.Error())
-	}
-	return bf.UnmarshalBinary(data)
-}
-
-func (fp *FilePersistence[T]) getFullPath() string {
-	return fp.directory + string(os.PathSeparator) + fp.filename
-}
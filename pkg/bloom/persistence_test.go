@@ -1,33 +1,120 @@
 package bloom
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
 	"github.com/dryack/GoCeannaithe/pkg/common"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
-func TestFilePersistence_getPath(t *testing.T) {
-	type testCase[T common.Hashable] struct {
-		name string
-		fp   FilePersistence[T]
-		want string
-	}
-	tests := []testCase[int]{
-		{
-			name: "base test",
-			fp: FilePersistence[int]{
-				directory: ".",
-				filename:  "test.dat",
-			},
-			want: fmt.Sprintf(".%ctest.dat", os.PathSeparator),
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := tt.fp.getFullPath(); got != tt.want {
-				t.Errorf("getFullPath() = %v, want %v", got, tt.want)
-			}
-		})
+var errInjected = errors.New("injected failure")
+
+// filePersistence returns a GenericPersistence saving filters to the file name within dir
+func filePersistence[T any](dir, name string) *GenericPersistence[T] {
+	return NewGenericPersistence[T](persist.NewFilePersistence(dir, name))
+}
+
+// withoutTypeID returns data saved by the persist package without the type ID it begins with
+func withoutTypeID(tb testing.TB, data []byte) []byte {
+	tb.Helper()
+	r := bytes.NewReader(data)
+	if _, err := persist.ReadTypeID(r); err != nil {
+		tb.Fatal(err)
 	}
+	return data[len(data)-r.Len():]
 }
+
+func TestGenericPersistence_Blob(t *testing.T) {
+	store := persist.NewFileBlobStore(t.TempDir())
+	writer := NewGenericPersistence[string](persist.NewBlobPersistence(store, "filters/tenant-a").WithConditionalWrites())
+	bf := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](4096, nil)).WithPersistence(writer)
+	_ = bf.Add("spam")
+	if err := bf.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+
+	other := NewGenericPersistence[string](persist.NewBlobPersistence(store, "filters/tenant-a").WithConditionalWrites())
+	loaded := NewBloomFilter[string]().WithPersistence(other)
+	if err := loaded.LoadPersistence(); err != nil {
+		t.Fatalf("LoadPersistence() error = %v", err)
+	}
+	if !loaded.Contains("spam") {
+		t.Errorf("LoadPersistence() lost keys")
+	}
+	_ = loaded.Add("eggs")
+	if err := loaded.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() after loading error = %v", err)
+	}
+
+	// the first writer's copy is now stale
+	_ = bf.Add("parrot")
+	if err := bf.SavePersistence(); !errors.Is(err, persist.ErrPreconditionFailed) {
+		t.Errorf("SavePersistence() of a stale filter error = %v, want persist.ErrPreconditionFailed", err)
+	}
+
+	missing := NewBloomFilter[string]().WithPersistence(NewGenericPersistence[string](persist.NewBlobPersistence(store,
+		"missing")))
+	if err := missing.LoadPersistence(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadPersistence() of a missing filter error = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestGenericPersistence(t *testing.T) {
+	fp := persist.NewFilePersistence(t.TempDir(), "filter.bin")
+	bf := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](4096, nil)).
+		WithPersistence(NewGenericPersistence[string](fp))
+	_ = bf.Add("spam")
+	if err := bf.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+
+	loaded := NewBloomFilter[string]().WithPersistence(NewGenericPersistence[string](fp))
+	if err := loaded.LoadPersistence(); err != nil {
+		t.Fatalf("LoadPersistence() error = %v", err)
+	}
+	if !loaded.Contains("spam") {
+		t.Errorf("LoadPersistence() lost keys")
+	}
+	if err := NewBloomFilter[int]().WithPersistence(NewGenericPersistence[int](fp)).LoadPersistence(); err == nil {
+		t.Errorf("LoadPersistence() into a filter of another key type succeeded, want an error")
+	}
+
+	// the same persistence saves any data structure, and won't load one kind into another
+	if err := fp.Load(&otherStructure{}); err == nil {
+		t.Errorf("Load() of a filter into another data structure succeeded, want an error")
+	}
+}
+
+func TestGenericPersistence_SaveFailure(t *testing.T) {
+	dir := t.TempDir()
+	original := []byte("previous filter")
+	if err := os.WriteFile(filepath.Join(dir, "filter.dat"), original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a filter whose storage can't be written fails part way through the save
+	fp := filePersistence[string](dir, "filter.dat")
+	bf := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](1<<20, nil))
+	bf.Storage = nil
+	if err := fp.Save(bf); err == nil {
+		t.Fatalf("Save() of a filter without storage succeeded, want an error")
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Save() left %d files behind, want only filter.dat", len(entries))
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "filter.dat")); string(data) != string(original) {
+		t.Errorf("failed Save() modified the previous filter")
+	}
+}
+
+// otherStructure stands in for a data structure other than a Bloom filter
+type otherStructure struct{}
+
+func (*otherStructure) MarshalBinary() ([]byte, error) { return nil, nil }
+func (*otherStructure) UnmarshalBinary([]byte) error   { return nil }
+func (*otherStructure) TypeID() string                 { return "other" }
@@ -0,0 +1,103 @@
+package bloom
+
+import (
+	"errors"
+	"fmt"
+)
+
+// indexStorage is implemented by storage which can set and check bits by index, bypassing key hashing
+type indexStorage interface {
+	// numBits returns the number of addressable bits
+	numBits() uint64
+	setIndex(index uint64)
+	checkIndex(index uint64) bool
+}
+
+func (b *BitPackingStorage[T]) numBits() uint64 {
+	return b.bitsLength * 64
+}
+
+func (b *BitPackingStorage[T]) setIndex(index uint64) {
+	b.bits[index/64] |= 1 << (index % 64)
+	b.markDirty(index / 64)
+}
+
+func (b *BitPackingStorage[T]) checkIndex(index uint64) bool {
+	return b.bits[index/64]&(1<<(index%64)) != 0
+}
+
+func (c *ConventionalStorage[T]) numBits() uint64 {
+	return c.sliceLength
+}
+
+func (c *ConventionalStorage[T]) setIndex(index uint64) {
+	c.bits[index] = true
+}
+
+func (c *ConventionalStorage[T]) checkIndex(index uint64) bool {
+	return c.bits[index]
+}
+
+// AddHash adds a key which has already been hashed elsewhere, for example a SHA-1 or xxHash digest, to the filter.  h1
+// and h2 should be two independent 64-bit halves of a 128-bit hash; the filter's k bit positions are derived from them
+// by enhanced double hashing, so neither the filter's hash function nor its seeds (or secret key) are used.
+//
+// Bits set by AddHash can only be found by ContainsHash, and bits set by Storage.SetBit can only be found by
+// Storage.CheckBit; the two should not be mixed on the same filter.
+func (bf *BloomFilter[T]) AddHash(h1, h2 uint64) error {
+	storage, err := bf.indexStorage()
+	if err != nil {
+		return err
+	}
+	m := storage.numBits()
+	if logger, ok := bf.persistence.(insertLogger[T]); ok {
+		indexes := make([]uint64, 0, bf.numHashFunctions)
+		for i := 0; i < bf.numHashFunctions; i++ {
+			indexes = append(indexes, h1%m)
+			h1 += h2
+			h2 += uint64(i)
+		}
+		return bf.logInsert(logger, storage, indexes)
+	}
+	for i := 0; i < bf.numHashFunctions; i++ {
+		storage.setIndex(h1 % m)
+		h1 += h2
+		h2 += uint64(i)
+	}
+	return nil
+}
+
+// ContainsHash reports whether a key added with AddHash may be present in the filter
+func (bf *BloomFilter[T]) ContainsHash(h1, h2 uint64) bool {
+	storage, err := bf.indexStorage()
+	if err != nil {
+		return false
+	}
+	m := storage.numBits()
+	for i := 0; i < bf.numHashFunctions; i++ {
+		if !storage.checkIndex(h1 % m) {
+			return false
+		}
+		h1 += h2
+		h2 += uint64(i)
+	}
+	return true
+}
+
+// indexStorage returns the filter's storage, provided the filter has been fully configured
+func (bf *BloomFilter[T]) indexStorage() (indexStorage, error) {
+	if bf.numHashFunctions <= 0 {
+		return nil, errors.New("number of hash functions not set")
+	}
+	if bf.Storage == nil {
+		return nil, ErrNoStorage
+	}
+	storage, ok := bf.Storage.(indexStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedStorage, bf.Storage)
+	}
+	if storage.numBits() == 0 {
+		return nil, ErrEmptyStorage
+	}
+	return storage, nil
+}
@@ -0,0 +1,66 @@
+package bloom
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"strconv"
+	"testing"
+)
+
+// digestHalves splits the first 16 bytes of a SHA-1 digest into the two halves expected by AddHash
+func digestHalves(s string) (uint64, uint64) {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:16])
+}
+
+func TestBloomFilter_AddHash(t *testing.T) {
+	storages := map[string]Storage[string]{
+		"BitPackingStorage":   NewBitPackingStorage[string](1<<16, nil),
+		"ConventionalStorage": NewConventionalStorage[string](1<<16, nil),
+	}
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			bf := newTestFilter(t, 7, common.Murmur3, storage)
+			for i := 0; i < 1000; i++ {
+				if err := bf.AddHash(digestHalves(strconv.Itoa(i))); err != nil {
+					t.Fatalf("AddHash() error = %v", err)
+				}
+			}
+			for i := 0; i < 1000; i++ {
+				if !bf.ContainsHash(digestHalves(strconv.Itoa(i))) {
+					t.Fatalf("ContainsHash() of added digest %d = false, want true", i)
+				}
+			}
+
+			falsePositives := 0
+			for i := 1000; i < 11000; i++ {
+				if bf.ContainsHash(digestHalves(strconv.Itoa(i))) {
+					falsePositives++
+				}
+			}
+			// with m = 65536, n = 1000 and k = 7 the expected rate is well under 0.1%
+			if falsePositives > 20 {
+				t.Errorf("%d false positives in 10000 lookups, want at most 20", falsePositives)
+			}
+		})
+	}
+}
+
+func TestBloomFilter_AddHashUnconfigured(t *testing.T) {
+	if err := NewBloomFilter[string]().AddHash(1, 2); err == nil {
+		t.Error("AddHash() on an unconfigured filter succeeded, want error")
+	}
+	if NewBloomFilter[string]().ContainsHash(1, 2) {
+		t.Error("ContainsHash() on an unconfigured filter = true, want false")
+	}
+}
+
+func BenchmarkBloomFilter_AddHash(b *testing.B) {
+	bf := newTestFilter(b, 10, common.Murmur3, NewBitPackingStorage[string](1_000_000, nil))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = bf.AddHash(uint64(i)*0x9e3779b97f4a7c15, uint64(i)*0xc2b2ae3d27d4eb4f)
+	}
+}
@@ -0,0 +1,117 @@
+package bloom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"io"
+)
+
+// RawHeader returns the header of the filter's binary format, which describes everything but its bits, so that the
+// bits can be stored uncompressed and updated in place.  Signed, verified and encrypted filters can't be stored this
+// way, nor can filters without BitPackingStorage.
+func (p *persistable[T]) RawHeader() ([]byte, error) {
+	if err := p.checkUnwrapped(); err != nil {
+		return nil, err
+	}
+	if _, ok := p.bf.Storage.(*BitPackingStorage[T]); !ok && p.bf.Storage != nil {
+		return nil, fmt.Errorf("%w: saving raw bits requires BitPackingStorage", ErrUnsupportedStorage)
+	}
+	header, _, err := p.bf.fileHeader()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeHeader(&buf, header); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// checkUnwrapped returns an error if the filter is signed, verified or encrypted, so its bits can't be stored raw
+func (p *persistable[T]) checkUnwrapped() error {
+	if len(p.envelopes) > 0 {
+		return errors.New("persistence writes the filter's bits directly, and can't encrypt them")
+	}
+	return p.bf.checkUnwrapped()
+}
+
+// RawSize returns the size in bytes of the filter's bits
+func (p *persistable[T]) RawSize() uint64 {
+	if storage, ok := p.bf.Storage.(*BitPackingStorage[T]); ok {
+		return storage.payloadSize()
+	}
+	return 0
+}
+
+// ReadRaw fills dst with the filter's bits starting at offset, in the little-endian layout of the binary format
+func (p *persistable[T]) ReadRaw(dst []byte, offset uint64) {
+	p.bf.Storage.(*BitPackingStorage[T]).readPayload(dst, offset)
+}
+
+// LoadRaw replaces the filter with the one described by header, as returned by RawHeader, whose uncompressed bits are
+// read from r.  The filter is left unchanged if an error is returned.
+func (p *persistable[T]) LoadRaw(header []byte, r io.Reader) error {
+	bf := p.bf
+	if err := p.checkUnwrapped(); err != nil {
+		return err
+	}
+	h, err := readHeader(bytes.NewReader(header))
+	if err != nil {
+		return err
+	}
+	if h.storageType != storageTypeBitPacking {
+		return corruptf("raw bits are stored for a filter without BitPackingStorage")
+	}
+	s, hashFunction, err := bf.storageFor(h)
+	if err != nil {
+		return err
+	}
+
+	storage := s.(*BitPackingStorage[T])
+	size := storage.payloadSize()
+	buf := make([]byte, min(size, payloadBlockSize))
+	for offset := uint64(0); offset < size; offset += uint64(len(buf)) {
+		buf = buf[:min(size-offset, payloadBlockSize)]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return readError("filter", err)
+		}
+		storage.writePayload(buf, offset)
+	}
+	bf.commitLoad(h, s, hashFunction)
+	return nil
+}
+
+// TrackPages starts tracking which pages of the filter's BitPackingStorage change
+func (p *persistable[T]) TrackPages() (persist.PageTracker, error) {
+	storage, ok := p.bf.Storage.(*BitPackingStorage[T])
+	if !ok {
+		return nil, fmt.Errorf("%w: tracking changes requires BitPackingStorage", ErrUnsupportedStorage)
+	}
+	return &pageTracker[T]{bf: p.bf, storage: storage, dirty: storage.trackDirty()}, nil
+}
+
+// pageTracker tracks the pages of a filter's BitPackingStorage which change, independently of any other tracker
+type pageTracker[T any] struct {
+	bf      *BloomFilter[T]
+	storage *BitPackingStorage[T]
+	dirty   *dirtyTracker
+}
+
+func (pt *pageTracker[T]) Tracks(p persist.Paged) bool {
+	fp, ok := p.(*persistable[T])
+	return ok && fp.bf == pt.bf && fp.bf.Storage == Storage[T](pt.storage) && pt.storage.tracksDirty(pt.dirty)
+}
+
+func (pt *pageTracker[T]) Changed() []uint64 {
+	return pt.dirty.pages()
+}
+
+func (pt *pageTracker[T]) Reset() {
+	pt.dirty.reset()
+}
+
+func (pt *pageTracker[T]) Stop() {
+	pt.storage.untrackDirty(pt.dirty)
+}
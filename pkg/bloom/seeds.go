@@ -0,0 +1,187 @@
+package bloom
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// SeedStrategy generates the seeds used for each of a BloomFilter's hash functions.  Two filters with the same hash
+// function and seeds set the same bits for the same keys, so services which need to share or merge filters should use
+// the same deterministic strategy.
+type SeedStrategy interface {
+	// Seeds returns num distinct seeds
+	Seeds(num int) ([]uint32, error)
+	// Verify checks that seeds, typically read back from persistence, could have been produced by this strategy
+	Verify(seeds []uint32) error
+}
+
+// SequentialSeeds produces the seeds Start, Start+1, ... Start+k-1.  It is the default strategy, starting from 0.
+type SequentialSeeds struct {
+	Start uint32
+}
+
+// RandomSeeds draws seeds from crypto/rand.  Filters using it are only compatible with copies of themselves, as the
+// seeds can't be reproduced.
+type RandomSeeds struct{}
+
+// PassphraseSeeds derives seeds from a passphrase using SHA-256, allowing separately built filters to agree on seeds
+// without coordinating a list of them.  The seeds are persisted in the clear, so the passphrase isn't a secret; use
+// WithSecretKey to defend against crafted keys.
+type PassphraseSeeds struct {
+	Passphrase string
+}
+
+// ExplicitSeeds uses exactly the seeds provided
+type ExplicitSeeds struct {
+	Values []uint32
+}
+
+// NewSequentialSeeds creates a SeedStrategy producing consecutive seeds beginning at start
+func NewSequentialSeeds(start uint32) *SequentialSeeds {
+	return &SequentialSeeds{Start: start}
+}
+
+// NewRandomSeeds creates a SeedStrategy producing random seeds
+func NewRandomSeeds() *RandomSeeds {
+	return &RandomSeeds{}
+}
+
+// NewPassphraseSeeds creates a SeedStrategy deriving seeds from passphrase
+func NewPassphraseSeeds(passphrase string) *PassphraseSeeds {
+	return &PassphraseSeeds{Passphrase: passphrase}
+}
+
+// NewExplicitSeeds creates a SeedStrategy returning the given seeds.  The number of seeds must match the number of hash
+// functions the filter is configured with.
+func NewExplicitSeeds(seeds ...uint32) *ExplicitSeeds {
+	return &ExplicitSeeds{Values: slices.Clone(seeds)}
+}
+
+// defaultSeedStrategy is used when WithSeedStrategy hasn't been called
+var defaultSeedStrategy SeedStrategy = NewSequentialSeeds(0)
+
+// checkSeedStrategy returns an error if strategy is nil, or a nil pointer to one of the strategies
+func checkSeedStrategy(strategy SeedStrategy) error {
+	if strategy == nil {
+		return errors.New("seed strategy is nil")
+	}
+	if v := reflect.ValueOf(strategy); v.Kind() == reflect.Pointer && v.IsNil() {
+		return fmt.Errorf("seed strategy is a nil %T", strategy)
+	}
+	return nil
+}
+
+func (s *SequentialSeeds) Seeds(num int) ([]uint32, error) {
+	if num < 0 {
+		return nil, fmt.Errorf("invalid number of seeds: %d", num)
+	}
+	if uint64(s.Start)+uint64(num) > 1<<32 {
+		return nil, fmt.Errorf("%d sequential seeds starting at %d overflow uint32", num, s.Start)
+	}
+	seeds := make([]uint32, num)
+	for i := range seeds {
+		seeds[i] = s.Start + uint32(i)
+	}
+	return seeds, nil
+}
+
+func (s *SequentialSeeds) Verify(seeds []uint32) error {
+	return verifyDeterministic(s, seeds)
+}
+
+func (s *RandomSeeds) Seeds(num int) ([]uint32, error) {
+	if num < 0 {
+		return nil, fmt.Errorf("invalid number of seeds: %d", num)
+	}
+	seeds := make([]uint32, 0, num)
+	var buf [4]byte
+	for len(seeds) < num {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return nil, err
+		}
+		seed := binary.BigEndian.Uint32(buf[:])
+		if !slices.Contains(seeds, seed) {
+			seeds = append(seeds, seed)
+		}
+	}
+	return seeds, nil
+}
+
+// Verify can only check that the seeds are distinct, as random seeds can't be regenerated
+func (s *RandomSeeds) Verify(seeds []uint32) error {
+	return verifyDistinct(seeds)
+}
+
+func (s *PassphraseSeeds) Seeds(num int) ([]uint32, error) {
+	if num < 0 {
+		return nil, fmt.Errorf("invalid number of seeds: %d", num)
+	}
+	if s.Passphrase == "" {
+		return nil, errors.New("passphrase must not be empty")
+	}
+
+	seeds := make([]uint32, 0, num)
+	var counter [4]byte
+	for block := uint32(0); len(seeds) < num; block++ {
+		binary.BigEndian.PutUint32(counter[:], block)
+		h := sha256.New()
+		h.Write([]byte("GoCeannaithe seeds\x00"))
+		h.Write([]byte(s.Passphrase))
+		h.Write(counter[:])
+		sum := h.Sum(nil)
+		for i := 0; i < len(sum) && len(seeds) < num; i += 4 {
+			seed := binary.BigEndian.Uint32(sum[i:])
+			if !slices.Contains(seeds, seed) {
+				seeds = append(seeds, seed)
+			}
+		}
+	}
+	return seeds, nil
+}
+
+func (s *PassphraseSeeds) Verify(seeds []uint32) error {
+	return verifyDeterministic(s, seeds)
+}
+
+func (s *ExplicitSeeds) Seeds(num int) ([]uint32, error) {
+	if num != len(s.Values) {
+		return nil, fmt.Errorf("%d explicit seeds were provided for %d hash functions", len(s.Values), num)
+	}
+	if err := verifyDistinct(s.Values); err != nil {
+		return nil, err
+	}
+	return slices.Clone(s.Values), nil
+}
+
+func (s *ExplicitSeeds) Verify(seeds []uint32) error {
+	return verifyDeterministic(s, seeds)
+}
+
+// verifyDeterministic regenerates the seeds from strategy and compares them with seeds
+func verifyDeterministic(strategy SeedStrategy, seeds []uint32) error {
+	expected, err := strategy.Seeds(len(seeds))
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(expected, seeds) {
+		return fmt.Errorf("seeds %v don't match the %v expected by the seed strategy", seeds, expected)
+	}
+	return nil
+}
+
+// verifyDistinct returns an error if any seed is repeated, as a repeated seed wastes a hash function
+func verifyDistinct(seeds []uint32) error {
+	seen := make(map[uint32]struct{}, len(seeds))
+	for _, seed := range seeds {
+		if _, ok := seen[seed]; ok {
+			return fmt.Errorf("duplicate seed %d", seed)
+		}
+		seen[seed] = struct{}{}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package bloom
+
+import (
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"slices"
+	"testing"
+)
+
+func TestSeedStrategies(t *testing.T) {
+	tests := []struct {
+		name          string
+		strategy      SeedStrategy
+		deterministic bool
+	}{
+		{name: "sequential", strategy: NewSequentialSeeds(1), deterministic: true},
+		{name: "random", strategy: NewRandomSeeds(), deterministic: false},
+		{name: "passphrase", strategy: NewPassphraseSeeds("correct horse battery staple"), deterministic: true},
+		{name: "explicit", strategy: NewExplicitSeeds(9, 3, 27, 81, 243, 729, 2187, 6561, 19683, 59049), deterministic: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seeds, err := tt.strategy.Seeds(10)
+			if err != nil {
+				t.Fatalf("Seeds() error = %v", err)
+			}
+			if len(seeds) != 10 {
+				t.Fatalf("Seeds() returned %d seeds, want 10", len(seeds))
+			}
+			if err := verifyDistinct(seeds); err != nil {
+				t.Errorf("Seeds() = %v: %v", seeds, err)
+			}
+			if err := tt.strategy.Verify(seeds); err != nil {
+				t.Errorf("Verify() of its own seeds error = %v", err)
+			}
+			again, _ := tt.strategy.Seeds(10)
+			if tt.deterministic != slices.Equal(seeds, again) {
+				t.Errorf("Seeds() deterministic = %v, want %v", !tt.deterministic, tt.deterministic)
+			}
+		})
+	}
+}
+
+func TestSeedStrategies_Errors(t *testing.T) {
+	if _, err := NewExplicitSeeds(1, 2, 3).Seeds(4); err == nil {
+		t.Error("ExplicitSeeds.Seeds() with too few seeds succeeded, want error")
+	}
+	if _, err := NewExplicitSeeds(1, 2, 2).Seeds(3); err == nil {
+		t.Error("ExplicitSeeds.Seeds() with duplicate seeds succeeded, want error")
+	}
+	if _, err := NewPassphraseSeeds("").Seeds(3); err == nil {
+		t.Error("PassphraseSeeds.Seeds() with an empty passphrase succeeded, want error")
+	}
+	if err := NewPassphraseSeeds("a").Verify([]uint32{0, 1, 2}); err == nil {
+		t.Error("PassphraseSeeds.Verify() of sequential seeds succeeded, want error")
+	}
+
+	// nil strategies are rejected rather than panicking, whether or not the hash functions are set yet
+	for _, strategy := range []SeedStrategy{nil, (*PassphraseSeeds)(nil)} {
+		bf, _ := NewBloomFilter[string]().WithHashFunctions(3, common.Murmur3)
+		if _, err := bf.WithSeedStrategy(strategy); err == nil {
+			t.Errorf("WithSeedStrategy(%#v) succeeded, want error", strategy)
+		}
+		if _, err := NewBloomFilter[string]().WithSeedStrategy(strategy); err == nil {
+			t.Errorf("WithSeedStrategy(%#v) before WithHashFunctions succeeded, want error", strategy)
+		}
+	}
+	if _, err := New[string](WithSeedStrategy((*SequentialSeeds)(nil)), WithHashFunctions(3, common.Murmur3),
+		WithStorage(NewBitPackingStorage[string](1024, nil))); err == nil {
+		t.Error("New() with a nil seed strategy succeeded, want error")
+	}
+}
+
+func TestBloomFilter_SeedStrategyPersistence(t *testing.T) {
+	passphrase := NewPassphraseSeeds("shared between services")
+	bf, err := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](4096, nil)).WithSeedStrategy(passphrase)
+	if err != nil {
+		t.Fatalf("WithSeedStrategy() error = %v", err)
+	}
+	_ = bf.Storage.SetBit("key")
+
+	// a filter built independently with the same passphrase sets the same bits
+	other, _ := NewBloomFilter[string]().WithSeedStrategy(passphrase)
+	other, _ = other.WithAutoConfigure(100, 0.03)
+	if !slices.Equal(bf.seeds, other.seeds[:5]) {
+		t.Errorf("seeds differ between filters with the same passphrase: %v and %v", bf.seeds, other.seeds)
+	}
+
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error = %v", err)
+	}
+
+	loaded, _ := NewBloomFilter[string]().WithSeedStrategy(passphrase)
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary() error = %v", err)
+	}
+	if !loaded.Storage.CheckBit("key") {
+		t.Error("CheckBit() = false after reload, want true")
+	}
+
+	mismatched, _ := NewBloomFilter[string]().WithSeedStrategy(NewSequentialSeeds(0))
+	if err := mismatched.UnmarshalBinary(data); err == nil {
+		t.Error("UnmarshalBinary() with a different seed strategy succeeded, want error")
+	}
+}
@@ -0,0 +1,229 @@
+package bloom
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+// Filters saved by a BloomFilter with a signing key wrap the binary format described in format.go as follows.  All
+// integers are big-endian.
+//
+//	magic       4 bytes    "GCBS"
+//	version     uint8      currently 1
+//	algorithm   uint8      1 = Ed25519ph (Ed25519 of the SHA-512 digest, with signingContext as the context)
+//	public key  32 bytes   of the signer
+//	content     chunks of a uint32 length followed by that many bytes, ending with a zero length chunk
+//	signature   64 bytes   of the SHA-512 digest of everything preceding it
+//
+// When a filter is also encrypted, it is signed first and the signed form is encrypted.
+
+const (
+	signedMagic      = "GCBS"
+	signedVersion    = uint8(1)
+	algorithmEd25519 = uint8(1)
+	signedChunkSize  = 64 << 10
+	signingContext   = "GoCeannaithe filter"
+)
+
+var (
+	// ErrUnsigned is returned when loading a filter which isn't signed into a BloomFilter with trusted keys
+	ErrUnsigned = errors.New("filter isn't signed")
+	// ErrUntrustedSigner is returned when loading a filter signed by a key which isn't one of the trusted keys
+	ErrUntrustedSigner = errors.New("filter is signed by an untrusted key")
+	// ErrBadSignature is returned when a filter's signature doesn't verify, because the filter has been modified
+	ErrBadSignature = errors.New("filter signature is invalid")
+)
+
+// WithSigningKey signs the filter with key whenever it is saved or marshaled, so that it can be verified by a
+// BloomFilter which trusts the matching public key
+func (bf *BloomFilter[T]) WithSigningKey(key ed25519.PrivateKey) *BloomFilter[T] {
+	bf.signingKey = key
+	return bf
+}
+
+// WithTrustedKeys requires filters loaded with LoadPersistence, UnmarshalBinary or ReadFrom to be signed by one of
+// keys; filters which are unsigned, signed by another key or modified since they were signed are rejected with
+// ErrUnsigned, ErrUntrustedSigner or ErrBadSignature.  Without trusted keys, signed filters are loaded without
+// verifying their signatures.
+func (bf *BloomFilter[T]) WithTrustedKeys(keys ...ed25519.PublicKey) *BloomFilter[T] {
+	bf.trustedKeys = keys
+	return bf
+}
+
+// signingEnvelope signs with key, and verifies against trusted keys unless skipVerify is set
+type signingEnvelope struct {
+	key        ed25519.PrivateKey
+	trusted    []ed25519.PublicKey
+	skipVerify bool
+}
+
+func signingOptions() *ed25519.Options {
+	return &ed25519.Options{Hash: crypto.SHA512, Context: signingContext}
+}
+
+func (s *signingEnvelope) wrap(w io.Writer) (io.WriteCloser, error) {
+	if len(s.key) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid Ed25519 signing key")
+	}
+	header := make([]byte, 0, 4+1+1+ed25519.PublicKeySize)
+	header = append(header, signedMagic...)
+	header = append(header, signedVersion, algorithmEd25519)
+	header = append(header, s.key.Public().(ed25519.PublicKey)...)
+
+	sw := &signWriter{w: w, key: s.key, digest: sha512.New()}
+	if err := sw.write(header); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (s *signingEnvelope) unwrap(r io.Reader) (io.Reader, error) {
+	header := make([]byte, 4+1+1+ed25519.PublicKeySize)
+	if _, err := io.ReadFull(r, header[:4]); err != nil {
+		return nil, readError("signature header", err)
+	}
+	if string(header[:4]) != signedMagic {
+		return nil, ErrUnsigned
+	}
+	if _, err := io.ReadFull(r, header[4:]); err != nil {
+		return nil, readError("signature header", err)
+	}
+	if header[4] != signedVersion {
+		return nil, incompatiblef("unsupported signature format version %d", header[4])
+	}
+	if header[5] != algorithmEd25519 {
+		return nil, incompatiblef("unsupported signature algorithm %d", header[5])
+	}
+
+	signer := ed25519.PublicKey(header[6:])
+	if !s.skipVerify && !s.trusts(signer) {
+		return nil, ErrUntrustedSigner
+	}
+	digest := sha512.New()
+	digest.Write(header)
+	return &verifyReader{r: r, signer: signer, digest: digest, skipVerify: s.skipVerify}, nil
+}
+
+func (s *signingEnvelope) trusts(signer ed25519.PublicKey) bool {
+	for _, key := range s.trusted {
+		if bytes.Equal(key, signer) {
+			return true
+		}
+	}
+	return false
+}
+
+// signWriter writes what is written to it in chunks, and signs them when closed
+type signWriter struct {
+	w      io.Writer
+	key    ed25519.PrivateKey
+	digest hash.Hash
+	buf    []byte
+}
+
+func (sw *signWriter) Write(p []byte) (int, error) {
+	sw.buf = append(sw.buf, p...)
+	for len(sw.buf) >= signedChunkSize {
+		if err := sw.chunk(sw.buf[:signedChunkSize]); err != nil {
+			return 0, err
+		}
+		sw.buf = append(sw.buf[:0], sw.buf[signedChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (sw *signWriter) Close() error {
+	if len(sw.buf) > 0 {
+		if err := sw.chunk(sw.buf); err != nil {
+			return err
+		}
+	}
+	if err := sw.chunk(nil); err != nil {
+		return err
+	}
+	signature, err := sw.key.Sign(nil, sw.digest.Sum(nil), signingOptions())
+	if err != nil {
+		return err
+	}
+	_, err = sw.w.Write(signature)
+	return err
+}
+
+// chunk writes a chunk, which is the last if it is empty
+func (sw *signWriter) chunk(p []byte) error {
+	if err := sw.write(binary.BigEndian.AppendUint32(nil, uint32(len(p)))); err != nil {
+		return err
+	}
+	return sw.write(p)
+}
+
+// write writes p, including it in the signed digest
+func (sw *signWriter) write(p []byte) error {
+	sw.digest.Write(p)
+	_, err := sw.w.Write(p)
+	return err
+}
+
+// verifyReader reads the chunks written by signWriter, returning io.EOF only once the signature has been verified
+type verifyReader struct {
+	r          io.Reader
+	signer     ed25519.PublicKey
+	digest     hash.Hash
+	skipVerify bool
+	remaining  uint32 // bytes left in the current chunk
+	done       bool
+}
+
+func (vr *verifyReader) Read(p []byte) (int, error) {
+	for vr.remaining == 0 {
+		if vr.done {
+			return 0, io.EOF
+		}
+		if err := vr.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint32(len(p)) > vr.remaining {
+		p = p[:vr.remaining]
+	}
+	n, err := vr.r.Read(p)
+	vr.digest.Write(p[:n])
+	vr.remaining -= uint32(n)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextChunk reads the length of the next chunk, and verifies the signature following the last chunk
+func (vr *verifyReader) nextChunk() error {
+	var length [4]byte
+	if _, err := io.ReadFull(vr.r, length[:]); err != nil {
+		return readError("signed filter", err)
+	}
+	vr.digest.Write(length[:])
+	vr.remaining = binary.BigEndian.Uint32(length[:])
+	if vr.remaining > 0 {
+		return nil
+	}
+
+	vr.done = true
+	signature := make([]byte, ed25519.SignatureSize)
+	if _, err := io.ReadFull(vr.r, signature); err != nil {
+		return readError("signature", err)
+	}
+	if vr.skipVerify {
+		return nil
+	}
+	if err := ed25519.VerifyWithOptions(vr.signer, vr.digest.Sum(nil), signature, signingOptions()); err != nil {
+		return ErrBadSignature
+	}
+	return nil
+}
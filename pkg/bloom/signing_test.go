@@ -0,0 +1,112 @@
+package bloom
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"testing"
+)
+
+func newSigningKey(t *testing.T, seed byte) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	return key.Public().(ed25519.PublicKey), key
+}
+
+func newSignedFilter(t *testing.T, key ed25519.PrivateKey, bits uint64) *BloomFilter[string] {
+	t.Helper()
+	bf := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](bits, nil)).WithSigningKey(key)
+	_ = bf.Add("blocked.example")
+	return bf
+}
+
+func TestSigning_RoundTrip(t *testing.T) {
+	public, private := newSigningKey(t, 1)
+	otherPublic, _ := newSigningKey(t, 2)
+
+	// a filter of several chunks, and one of less than a chunk
+	for _, bits := range []uint64{1 << 22, 1 << 10} {
+		data, err := newSignedFilter(t, private, bits).MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() error = %v", err)
+		}
+
+		loaded := NewBloomFilter[string]().WithTrustedKeys(otherPublic, public)
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary() error = %v", err)
+		}
+		if !loaded.Contains("blocked.example") {
+			t.Errorf("Contains() = false after verifying")
+		}
+
+		// without trusted keys the signature isn't checked
+		if err := NewBloomFilter[string]().UnmarshalBinary(data); err != nil {
+			t.Errorf("UnmarshalBinary() without trusted keys error = %v", err)
+		}
+	}
+}
+
+func TestSigning_Rejected(t *testing.T) {
+	public, private := newSigningKey(t, 1)
+	_, otherPrivate := newSigningKey(t, 2)
+	data, _ := newSignedFilter(t, private, 1<<16).MarshalBinary()
+
+	unsigned := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](1<<16, nil))
+	unsignedData, _ := unsigned.MarshalBinary()
+	otherData, _ := newSignedFilter(t, otherPrivate, 1<<16).MarshalBinary()
+
+	modified := append([]byte{}, data...)
+	modified[len(modified)-ed25519.SignatureSize-100] ^= 1
+	badSignature := append([]byte{}, data...)
+	badSignature[len(badSignature)-1] ^= 1
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"unsigned", unsignedData, ErrUnsigned},
+		{"untrusted signer", otherData, ErrUntrustedSigner},
+		{"modified filter", modified, ErrBadSignature},
+		{"modified signature", badSignature, ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bf := NewBloomFilter[string]().WithTrustedKeys(public)
+			if err := bf.UnmarshalBinary(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("UnmarshalBinary() error = %v, want %v", err, tt.want)
+			}
+			if bf.Storage != nil {
+				t.Errorf("UnmarshalBinary() changed the filter despite failing")
+			}
+		})
+	}
+}
+
+func TestSigning_FilePersistenceAndEncryption(t *testing.T) {
+	public, private := newSigningKey(t, 1)
+	dir := t.TempDir()
+	keys := NewStaticKey("primary", [EncryptionKeySize]byte{9})
+	ep, _ := NewEncryptedPersistence[string](filePersistence[string](dir, "filter.dat"), keys)
+
+	bf := newSignedFilter(t, private, 1<<16).WithPersistence(ep)
+	if err := bf.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+
+	loaded := NewBloomFilter[string]().WithTrustedKeys(public).WithPersistence(ep)
+	if err := loaded.LoadPersistence(); err != nil {
+		t.Fatalf("LoadPersistence() error = %v", err)
+	}
+	if !loaded.Contains("blocked.example") {
+		t.Errorf("Contains() = false after decrypting and verifying")
+	}
+
+	// a plain file saved in place of the signed one is rejected
+	unsigned := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](1<<16, nil)).WithPersistence(ep)
+	_ = unsigned.SavePersistence()
+	if err := loaded.LoadPersistence(); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("LoadPersistence() of an unsigned filter error = %v, want ErrUnsigned", err)
+	}
+}
@@ -0,0 +1,163 @@
+package bloom
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// WriteTo writes the filter to w in the binary format described in format.go.  The bits are converted and compressed
+// one block at a time, so beyond the filter itself memory use stays bounded however large the filter is.
+func (bf *BloomFilter[T]) WriteTo(w io.Writer) (int64, error) {
+	return bf.writeEnveloped(w, nil)
+}
+
+// writeEnveloped writes the filter as WriteTo does, wrapped in envelopes, innermost first, outside any of its own
+func (bf *BloomFilter[T]) writeEnveloped(w io.Writer, envelopes []envelope) (int64, error) {
+	header, storage, err := bf.fileHeader()
+	if err != nil {
+		return 0, err
+	}
+
+	cw := &countingWriter{w: w}
+	dst := io.Writer(cw)
+	var closers []io.Closer
+	envelopes = bf.writeEnvelopes(envelopes)
+	for i := len(envelopes) - 1; i >= 0; i-- {
+		wrapped, err := envelopes[i].wrap(dst)
+		if err != nil {
+			return cw.n, err
+		}
+		dst = wrapped
+		closers = append(closers, wrapped)
+	}
+
+	if err := writeFilter(dst, header, storage); err != nil {
+		return cw.n, err
+	}
+	// the innermost envelope is finished first, as its output is written to the next
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// ReadFrom replaces the filter with one read from r, which may be in the current binary format or the gob format which
+// preceded it.  Blocks are decompressed straight into the filter's storage, so only the storage itself and a single
+// block are held in memory.  The filter is left unchanged if an error is returned.
+//
+// ReadFrom doesn't read beyond the end of a filter in the current format, so r may contain further data; as it makes
+// many small reads, r should be buffered if reads are expensive.
+func (bf *BloomFilter[T]) ReadFrom(r io.Reader) (int64, error) {
+	return bf.readEnveloped(r, nil)
+}
+
+// readEnveloped replaces the filter as ReadFrom does, with one wrapped in envelopes, innermost first, outside any of its
+// own
+func (bf *BloomFilter[T]) readEnveloped(r io.Reader, envelopes []envelope) (int64, error) {
+	cr := &countingReader{r: r}
+	src := io.Reader(cr)
+	envelopes = bf.readEnvelopes(envelopes)
+	for i := len(envelopes) - 1; i >= 0; i-- {
+		unwrapped, err := envelopes[i].unwrap(src)
+		if err != nil {
+			return cr.n, err
+		}
+		src = unwrapped
+	}
+
+	wrapped := len(envelopes) > 0
+	for {
+		prefix := make([]byte, len(formatMagic))
+		if _, err := io.ReadFull(src, prefix); err != nil {
+			return cr.n, readError("filter header", err)
+		}
+		src = io.MultiReader(bytes.NewReader(prefix), src)
+
+		switch string(prefix) {
+		case formatMagic:
+			loaded, err := bf.decode(src)
+			if err != nil {
+				if wrapped {
+					// a filter modified after it was signed is reported as such, rather than as corrupt
+					if _, drainErr := io.Copy(io.Discard, src); errors.Is(drainErr, ErrBadSignature) {
+						return cr.n, drainErr
+					}
+				}
+				return cr.n, err
+			}
+			if wrapped {
+				// the rest of the envelopes, such as the signature following the filter, must be verified first
+				if _, err := io.Copy(io.Discard, src); err != nil {
+					return cr.n, err
+				}
+			}
+			loaded.commit()
+			return cr.n, nil
+		case signedMagic:
+			// without trusted keys, signed filters are loaded without verifying the signature (with them, the signature
+			// has already been verified by its envelope)
+			unwrapped, err := (&signingEnvelope{skipVerify: true}).unwrap(src)
+			if err != nil {
+				return cr.n, err
+			}
+			src, wrapped = unwrapped, true
+			continue
+		case encryptedMagic:
+			return cr.n, incompatiblef("filter is encrypted, load it with EncryptedPersistence")
+		}
+
+		// filters which predate the current format are read whole
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return cr.n, err
+		}
+		return cr.n, bf.unmarshalGob(data)
+	}
+}
+
+// writeEnvelopes returns the envelopes the filter's serialized form is wrapped in when writing, innermost first: its
+// own, followed by outer
+func (bf *BloomFilter[T]) writeEnvelopes(outer []envelope) []envelope {
+	var envelopes []envelope
+	if bf.signingKey != nil {
+		envelopes = append(envelopes, &signingEnvelope{key: bf.signingKey})
+	}
+	return append(envelopes, outer...)
+}
+
+// readEnvelopes returns the envelopes the filter's serialized form must be wrapped in when reading, innermost first:
+// its own, followed by outer
+func (bf *BloomFilter[T]) readEnvelopes(outer []envelope) []envelope {
+	var envelopes []envelope
+	if len(bf.trustedKeys) > 0 {
+		envelopes = append(envelopes, &signingEnvelope{trusted: bf.trustedKeys})
+	}
+	return append(envelopes, outer...)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
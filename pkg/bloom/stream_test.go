@@ -0,0 +1,68 @@
+package bloom
+
+import (
+	"bytes"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"io"
+	"runtime"
+	"testing"
+)
+
+func TestBloomFilter_WriteToReadFrom(t *testing.T) {
+	bf := newTestFilter(t, 4, common.WyHash, NewBitPackingStorage[int](1<<16, nil))
+	for i := 0; i < 500; i++ {
+		_ = bf.Storage.SetBit(i)
+	}
+
+	var buf bytes.Buffer
+	written, err := bf.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if written != int64(buf.Len()) {
+		t.Errorf("WriteTo() = %d, but %d bytes were written", written, buf.Len())
+	}
+
+	// a second filter, and some trailing data, follow the first in the stream
+	if _, err := bf.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	buf.WriteString("trailer")
+
+	for i := 0; i < 2; i++ {
+		loaded := NewBloomFilter[int]()
+		read, err := loaded.ReadFrom(&buf)
+		if err != nil {
+			t.Fatalf("ReadFrom() of filter %d error = %v", i, err)
+		}
+		if read != written {
+			t.Errorf("ReadFrom() = %d, want %d", read, written)
+		}
+		if !loaded.Storage.CheckBit(499) {
+			t.Errorf("CheckBit() = false after ReadFrom, want true")
+		}
+	}
+	if buf.String() != "trailer" {
+		t.Errorf("ReadFrom() consumed data after the filter, %q remains", buf.String())
+	}
+}
+
+func TestBloomFilter_WriteToBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("allocates a large filter")
+	}
+	const numBits = 1 << 30 // 128 MiB of bits
+	bf := newTestFilter(t, 4, common.WyHash, NewBitPackingStorage[int](numBits, nil))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := bf.WriteTo(io.Discard); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	runtime.ReadMemStats(&after)
+
+	// a block of raw bytes plus the compressor's state, rather than copies of the whole filter
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Errorf("WriteTo() allocated %d bytes for a %d byte filter", allocated, numBits/8)
+	}
+}
@@ -0,0 +1,559 @@
+package bloom
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The write-ahead log written by WALPersistence is laid out as follows.  All integers are big-endian.
+//
+//	magic    4 bytes   "GCBW"
+//	version  uint8     currently 1
+//	bits     uint64    number of bits (m) of the filter the log belongs to
+//	records  each a uint32 count, that many uint64 bit indexes, and a uint32 CRC-32C of the count and indexes
+//
+// Each record holds the bits set by one insert, so replaying the log doesn't need the keys, their type or the filter's
+// hash function.  Setting a bit twice is harmless, so a record may safely be replayed onto a snapshot which already
+// contains it.  A record which is truncated or fails its checksum, and isn't followed by a valid record, is the tail of
+// a write interrupted by a crash; it is discarded when the log is replayed.  One followed by a valid record means the
+// log is corrupt.
+//
+// While a compaction saves a snapshot in the background, the log it compacts is kept alongside the new one, with
+// ".old" appended to its name, and both are replayed by Load.
+
+const (
+	walMagic      = "GCBW"
+	walVersion    = uint8(1)
+	walHeaderSize = 4 + 1 + 8
+
+	// DefaultWALCompactSize is the size of the log, in bytes, beyond which WALPersistence compacts it by default
+	DefaultWALCompactSize = 64 << 20
+)
+
+// insertLogger is implemented by persistence which records every insert made with Add or AddHash
+type insertLogger[T any] interface {
+	// appendInsert records the bit indexes of an insert into bf, before they are set
+	appendInsert(bf *BloomFilter[T], indexes []uint64) error
+}
+
+// logInsert records an insert with logger, then sets its bits
+func (bf *BloomFilter[T]) logInsert(logger insertLogger[T], storage indexStorage, indexes []uint64) error {
+	if err := logger.appendInsert(bf, indexes); err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		storage.setIndex(index)
+	}
+	return nil
+}
+
+// WALOptions controls how WALPersistence writes its log
+type WALOptions struct {
+	// SyncInterval enables group commit: inserts are buffered, then written and synced to disk together this often, so
+	// up to SyncInterval's worth of inserts can be lost in a crash.  Zero writes and syncs each insert before Add
+	// returns.
+	SyncInterval time.Duration
+	// CompactSize is the size of the log, in bytes, beyond which it is compacted by saving a fresh snapshot in the
+	// background and starting a new log; zero means DefaultWALCompactSize
+	CompactSize int64
+}
+
+// WALPersistence keeps a filter durable between snapshots by appending the bits set by each Add or AddHash to a
+// write-ahead log.  Save writes a snapshot with another Persistence, such as GenericPersistence, and empties the log;
+// Load loads the snapshot and replays the log onto it.  Once the log grows beyond WALOptions.CompactSize it is
+// compacted: the insert which finds it too large starts a new log and copies the filter, and the copy is saved as a
+// snapshot in the background, so inserts don't wait for the snapshot to be written.
+//
+// Only inserts made with BloomFilter.Add and BloomFilter.AddHash are logged; Storage.SetBit bypasses the log.  The
+// first insert into a filter which hasn't been saved or loaded with the WALPersistence saves a snapshot, so that a log
+// is never left without the snapshot it applies to.  Close must be called once the filter is no longer used.
+//
+// The log is neither encrypted nor signed, so WALPersistence refuses filters with a signing key or trusted keys, and
+// snapshots saved with EncryptedPersistence.  An Add which fails to write the log isn't retried by later writes.
+type WALPersistence[T any] struct {
+	snapshot Persistence[T]
+	path     string
+	opts     WALOptions
+
+	mu      sync.Mutex
+	log     *os.File
+	numBits uint64 // of the filter the open log belongs to
+	written int64  // bytes of the log on disk
+	pending []byte // records not yet written
+	err     error  // from a background sync, returned by the next insert
+	done    chan struct{}
+
+	compaction chan error // receives the result of the background compaction, while one is running
+}
+
+// NewWALPersistence creates a WALPersistence which keeps its log at logPath, and its snapshots with snapshot
+func NewWALPersistence[T any](snapshot Persistence[T], logPath string, opts WALOptions) *WALPersistence[T] {
+	if opts.CompactSize == 0 {
+		opts.CompactSize = DefaultWALCompactSize
+	}
+	return &WALPersistence[T]{snapshot: snapshot, path: logPath, opts: opts}
+}
+
+// Save writes a snapshot of the filter, then empties the log
+func (w *WALPersistence[T]) Save(bf *BloomFilter[T]) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.checkLoggable(bf); err != nil {
+		return fmt.Errorf("error saving bloom filter: %w", err)
+	}
+	return w.compactLocked(bf)
+}
+
+// Load loads the latest snapshot, and replays the log onto it.  A record left incomplete by a crash is removed from
+// the log.
+func (w *WALPersistence[T]) Load(bf *BloomFilter[T]) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.checkLoggable(bf); err != nil {
+		return fmt.Errorf("error loading bloom filter: %w", err)
+	}
+	if err := w.closeLocked(); err != nil {
+		return err
+	}
+	if err := w.snapshot.Load(bf); err != nil {
+		return err
+	}
+	storage, err := bf.indexStorage()
+	if err != nil {
+		return err
+	}
+
+	log, err := os.OpenFile(w.path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		// a compaction may have been interrupted before it started the new log
+		if err := w.replayOldLocked(storage); err != nil {
+			return err
+		}
+		return w.resetLocked(storage.numBits())
+	}
+	if err != nil {
+		return fmt.Errorf("error opening write-ahead log: %w", err)
+	}
+	w.log = log
+	if err := w.replayOldLocked(storage); err != nil {
+		_ = w.closeLocked()
+		return err
+	}
+	if err := w.replayLocked(storage); err != nil {
+		_ = w.closeLocked()
+		return err
+	}
+	w.startLocked()
+	return nil
+}
+
+// Sync writes and syncs any inserts buffered by group commit
+func (w *WALPersistence[T]) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLocked()
+}
+
+// Close writes any buffered inserts, and closes the log
+func (w *WALPersistence[T]) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeLocked()
+}
+
+func (w *WALPersistence[T]) appendInsert(bf *BloomFilter[T], indexes []uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.err; err != nil {
+		w.err = nil
+		return err
+	}
+	if err := w.finishCompactionLocked(false); err != nil {
+		return err
+	}
+	if err := w.checkLoggable(bf); err != nil {
+		return err
+	}
+	storage, err := bf.indexStorage()
+	if err != nil {
+		return err
+	}
+	switch {
+	case w.log == nil || w.numBits != storage.numBits():
+		if err := w.compactLocked(bf); err != nil {
+			return err
+		}
+	case w.compaction == nil && w.written+int64(len(w.pending)) >= w.opts.CompactSize:
+		if err := w.startCompactionLocked(bf); err != nil {
+			return err
+		}
+	}
+
+	start := len(w.pending)
+	w.pending = binary.BigEndian.AppendUint32(w.pending, uint32(len(indexes)))
+	for _, index := range indexes {
+		w.pending = binary.BigEndian.AppendUint64(w.pending, index)
+	}
+	w.pending = binary.BigEndian.AppendUint32(w.pending, crc32.Checksum(w.pending[start:], castagnoli))
+
+	if w.opts.SyncInterval > 0 {
+		return nil
+	}
+	if err := w.flushLocked(); err != nil {
+		// the caller is told the insert failed, so it mustn't be written by a later flush
+		w.pending = w.pending[:start]
+		return err
+	}
+	return nil
+}
+
+// checkLoggable returns an error if the filter is signed, verified or encrypted.  The log records bit indexes in the
+// clear and unsigned, so it would reveal the members of an encrypted filter, and let anyone able to write the log add
+// members to a filter loaded with WithTrustedKeys.
+func (w *WALPersistence[T]) checkLoggable(bf *BloomFilter[T]) error {
+	if _, ok := w.snapshot.(*EncryptedPersistence[T]); ok {
+		return errors.New("write-ahead log can't be encrypted, so can't be used with EncryptedPersistence")
+	}
+	return bf.checkUnwrapped()
+}
+
+// compactLocked saves a snapshot of the filter, then replaces the log with an empty one
+func (w *WALPersistence[T]) compactLocked(bf *BloomFilter[T]) error {
+	storage, err := bf.indexStorage()
+	if err != nil {
+		return err
+	}
+	// the snapshot of a background compaction mustn't replace this one, which includes everything it does, so its
+	// error doesn't matter
+	_ = w.finishCompactionLocked(true)
+	if err := w.snapshot.Save(bf); err != nil {
+		return err
+	}
+	if err := w.removeOldLocked(); err != nil {
+		return err
+	}
+	return w.resetLocked(storage.numBits())
+}
+
+// startCompactionLocked moves the log aside and starts a new one, then saves a copy of the filter in the background.
+// The old log is removed once the copy has been saved.  If an earlier background compaction failed, its log is still
+// needed, so the filter is saved before returning instead.
+func (w *WALPersistence[T]) startCompactionLocked(bf *BloomFilter[T]) error {
+	if _, err := os.Stat(w.oldPath()); err == nil {
+		return w.compactLocked(bf)
+	}
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	err := w.log.Close()
+	w.log = nil
+	if err == nil {
+		err = os.Rename(w.path, w.oldPath())
+	}
+	if err != nil {
+		// the next insert saves a snapshot and starts a new log
+		return fmt.Errorf("error compacting write-ahead log: %w", err)
+	}
+	if err := w.resetLocked(w.numBits); err != nil {
+		return err
+	}
+
+	snapshot := bf.clone()
+	result := make(chan error, 1)
+	w.compaction = result
+	go func() {
+		result <- w.snapshot.Save(snapshot)
+	}()
+	return nil
+}
+
+// finishCompactionLocked removes the log kept by a background compaction once its snapshot has been saved, and returns
+// the error from saving it.  If wait is false and the snapshot is still being saved, it returns immediately.
+func (w *WALPersistence[T]) finishCompactionLocked(wait bool) error {
+	if w.compaction == nil {
+		return nil
+	}
+	var err error
+	if wait {
+		err = <-w.compaction
+	} else {
+		select {
+		case err = <-w.compaction:
+		default:
+			return nil
+		}
+	}
+	w.compaction = nil
+	if err != nil {
+		return fmt.Errorf("error compacting write-ahead log: %w", err)
+	}
+	return w.removeOldLocked()
+}
+
+// removeOldLocked removes the log kept by a compaction, if there is one
+func (w *WALPersistence[T]) removeOldLocked() error {
+	if err := os.Remove(w.oldPath()); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error removing compacted write-ahead log: %w", err)
+	}
+	if err := persist.SyncDirectory(filepath.Dir(w.path)); err != nil {
+		return fmt.Errorf("error removing compacted write-ahead log: %w", err)
+	}
+	return nil
+}
+
+// oldPath returns the path of the log kept while a compaction saves its snapshot
+func (w *WALPersistence[T]) oldPath() string {
+	return w.path + ".old"
+}
+
+// resetLocked empties the log, creating it if need be, and starts it for a filter of numBits bits
+func (w *WALPersistence[T]) resetLocked(numBits uint64) error {
+	if w.log == nil {
+		log, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE, DefaultFileMode)
+		if err != nil {
+			return fmt.Errorf("error creating write-ahead log: %w", err)
+		}
+		w.log = log
+		if err := persist.SyncDirectory(filepath.Dir(w.path)); err != nil {
+			return fmt.Errorf("error creating write-ahead log: %w", err)
+		}
+	}
+
+	header := make([]byte, 0, walHeaderSize)
+	header = append(header, walMagic...)
+	header = append(header, walVersion)
+	header = binary.BigEndian.AppendUint64(header, numBits)
+
+	w.pending = w.pending[:0]
+	w.written = 0
+	if err := w.log.Truncate(0); err != nil {
+		return fmt.Errorf("error resetting write-ahead log: %w", err)
+	}
+	if _, err := w.log.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("error resetting write-ahead log: %w", err)
+	}
+	if _, err := w.log.Seek(walHeaderSize, io.SeekStart); err != nil {
+		return fmt.Errorf("error resetting write-ahead log: %w", err)
+	}
+	if err := w.log.Sync(); err != nil {
+		return fmt.Errorf("error resetting write-ahead log: %w", err)
+	}
+	w.written = walHeaderSize
+	w.numBits = numBits
+	w.startLocked()
+	return nil
+}
+
+// replayLocked sets the bits recorded in the open log, and truncates the log after its last complete record
+func (w *WALPersistence[T]) replayLocked(storage indexStorage) error {
+	numBits := storage.numBits()
+	offset, err := replayLog(w.log, storage)
+	if err != nil {
+		return err
+	}
+	if offset == 0 {
+		// the log was being reset when it was interrupted, after the snapshot it followed was saved
+		return w.resetLocked(numBits)
+	}
+
+	if err := w.log.Truncate(offset); err != nil {
+		return fmt.Errorf("error truncating write-ahead log: %w", err)
+	}
+	if _, err := w.log.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("error truncating write-ahead log: %w", err)
+	}
+	w.written = offset
+	w.numBits = numBits
+	return nil
+}
+
+// replayOldLocked sets the bits recorded in the log kept by an interrupted or failed compaction, if there is one
+func (w *WALPersistence[T]) replayOldLocked(storage indexStorage) error {
+	old, err := os.Open(w.oldPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error opening compacted write-ahead log: %w", err)
+	}
+	defer old.Close()
+	_, err = replayLog(old, storage)
+	return err
+}
+
+// replayLog sets the bits recorded in the log read from r, and returns the offset after its last complete record, or
+// zero if the log doesn't have a complete header
+func replayLog(r io.Reader, storage indexStorage) (int64, error) {
+	numBits := storage.numBits()
+	br := bufio.NewReader(r)
+
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(br, header); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("error reading write-ahead log: %w", err)
+	}
+	if string(header[:4]) != walMagic {
+		return 0, corruptf("not a GoCeannaithe write-ahead log")
+	}
+	if header[4] != walVersion {
+		return 0, incompatiblef("unsupported write-ahead log version %d", header[4])
+	}
+	if logBits := binary.BigEndian.Uint64(header[5:]); logBits != numBits {
+		return 0, incompatiblef("write-ahead log is for a filter of %d bits, but the snapshot has %d", logBits, numBits)
+	}
+
+	offset := int64(walHeaderSize)
+	record := make([]byte, 0, 4+8*maxHashFunctions+4)
+	for {
+		indexes, n, err := readWALRecord(br, record)
+		if errors.Is(err, io.EOF) {
+			return offset, nil
+		}
+		if errors.Is(err, errTornRecord) {
+			// only the last record can have been torn by a crash
+			if _, _, err := readWALRecord(br, record); err == nil {
+				return 0, corruptf("write-ahead log record at offset %d is corrupt, but is followed by valid records",
+					offset)
+			}
+			return offset, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("error reading write-ahead log: %w", err)
+		}
+		for _, index := range indexes {
+			if index >= numBits {
+				return 0, corruptf("write-ahead log record at offset %d sets bit %d, beyond the filter's %d bits",
+					offset, index, numBits)
+			}
+		}
+		for _, index := range indexes {
+			storage.setIndex(index)
+		}
+		offset += n
+	}
+}
+
+// errTornRecord is returned by readWALRecord for a record which is incomplete or fails its checksum
+var errTornRecord = errors.New("torn write-ahead log record")
+
+// readWALRecord reads one record, using buf for its bytes.  It returns the record's indexes and size, io.EOF if the log
+// ends before it, or errTornRecord if it is incomplete or corrupt.
+func readWALRecord(r io.Reader, buf []byte) ([]uint64, int64, error) {
+	buf = buf[:4]
+	if _, err := io.ReadFull(r, buf); errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, 0, errTornRecord
+	} else if err != nil {
+		return nil, 0, err
+	}
+	count := binary.BigEndian.Uint32(buf)
+	if count > maxHashFunctions {
+		return nil, 0, errTornRecord
+	}
+	buf = buf[:4+8*int(count)+4]
+	if _, err := io.ReadFull(r, buf[4:]); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, 0, errTornRecord
+	} else if err != nil {
+		return nil, 0, err
+	}
+	body, sum := buf[:len(buf)-4], binary.BigEndian.Uint32(buf[len(buf)-4:])
+	if crc32.Checksum(body, castagnoli) != sum {
+		return nil, 0, errTornRecord
+	}
+
+	indexes := make([]uint64, count)
+	for i := range indexes {
+		indexes[i] = binary.BigEndian.Uint64(body[4+8*i:])
+	}
+	return indexes, int64(len(buf)), nil
+}
+
+// flushLocked writes and syncs the buffered records.  If the write or sync fails, the log is truncated back to its last
+// flushed record, and the records stay buffered.
+func (w *WALPersistence[T]) flushLocked() error {
+	if len(w.pending) == 0 || w.log == nil {
+		return nil
+	}
+	if _, err := w.log.Write(w.pending); err != nil {
+		_ = w.log.Truncate(w.written)
+		_, _ = w.log.Seek(w.written, io.SeekStart)
+		return fmt.Errorf("error writing write-ahead log: %w", err)
+	}
+	if err := w.log.Sync(); err != nil {
+		_ = w.log.Truncate(w.written)
+		_, _ = w.log.Seek(w.written, io.SeekStart)
+		return fmt.Errorf("error syncing write-ahead log: %w", err)
+	}
+	w.written += int64(len(w.pending))
+	w.pending = w.pending[:0]
+	return nil
+}
+
+// startLocked starts the background group commit, if it is enabled and not already running
+func (w *WALPersistence[T]) startLocked() {
+	if w.opts.SyncInterval <= 0 || w.done != nil {
+		return
+	}
+	w.done = make(chan struct{})
+	go w.run(w.done)
+}
+
+// run syncs the log every SyncInterval until done is closed
+func (w *WALPersistence[T]) run(done chan struct{}) {
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		w.mu.Lock()
+		select {
+		case <-done:
+			// stopped while waiting for the lock, so the log may since have been closed or replaced
+			w.mu.Unlock()
+			return
+		default:
+		}
+		if err := w.flushLocked(); err != nil {
+			w.err = err
+		}
+		w.mu.Unlock()
+	}
+}
+
+// closeLocked stops the background group commit, waits for any background compaction, writes any buffered records
+// and closes the log.  The lock is held throughout: the background sync checks it hasn't been stopped once it has the
+// lock, so it needn't be waited for.
+func (w *WALPersistence[T]) closeLocked() error {
+	if w.done != nil {
+		close(w.done)
+		w.done = nil
+	}
+	err := w.finishCompactionLocked(true)
+	if w.log == nil {
+		return err
+	}
+	if flushErr := w.flushLocked(); err == nil {
+		err = flushErr
+	}
+	if closeErr := w.log.Close(); err == nil {
+		err = closeErr
+	}
+	w.log = nil
+	w.pending = w.pending[:0]
+	return err
+}
@@ -0,0 +1,296 @@
+package bloom
+
+import (
+	"errors"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newWALFilter(t *testing.T, dir string, opts WALOptions) (*BloomFilter[string], *WALPersistence[string]) {
+	t.Helper()
+	wal := NewWALPersistence[string](filePersistence[string](dir, "filter.dat"), filepath.Join(dir, "filter.wal"), opts)
+	return newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](1<<16, nil)).WithPersistence(wal), wal
+}
+
+// reloadWAL loads the filter kept in dir as a fresh process would
+func reloadWAL(t *testing.T, dir string, opts WALOptions) (*BloomFilter[string], *WALPersistence[string]) {
+	t.Helper()
+	wal := NewWALPersistence[string](filePersistence[string](dir, "filter.dat"), filepath.Join(dir, "filter.wal"), opts)
+	bf := NewBloomFilter[string]().WithPersistence(wal)
+	if err := bf.LoadPersistence(); err != nil {
+		t.Fatalf("LoadPersistence() error = %v", err)
+	}
+	t.Cleanup(func() { _ = wal.Close() })
+	return bf, wal
+}
+
+func TestWALPersistence_Replay(t *testing.T) {
+	dir := t.TempDir()
+	bf, wal := newWALFilter(t, dir, WALOptions{})
+	for i := 0; i < 100; i++ {
+		if err := bf.Add(strconv.Itoa(i)); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if err := bf.AddHash(1, 2); err != nil {
+		t.Fatalf("AddHash() error = %v", err)
+	}
+	// simulate a crash: the inserts were never saved in a snapshot
+	_ = wal.log.Close()
+
+	loaded, _ := reloadWAL(t, dir, WALOptions{})
+	for i := 0; i < 100; i++ {
+		if !loaded.Contains(strconv.Itoa(i)) {
+			t.Fatalf("Contains(%d) = false after replaying the log", i)
+		}
+	}
+	if !loaded.ContainsHash(1, 2) {
+		t.Errorf("ContainsHash() = false after replaying the log")
+	}
+}
+
+func TestWALPersistence_TornRecord(t *testing.T) {
+	dir := t.TempDir()
+	bf, wal := newWALFilter(t, dir, WALOptions{})
+	_ = bf.Add("complete")
+	_ = wal.Close()
+
+	logPath := filepath.Join(dir, "filter.wal")
+	info, _ := os.Stat(logPath)
+	f, _ := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+	_, _ = f.Write([]byte{0, 0, 0, 5, 1, 2, 3}) // the start of a record which was never finished
+	_ = f.Close()
+
+	loaded, wal := reloadWAL(t, dir, WALOptions{})
+	if !loaded.Contains("complete") {
+		t.Errorf("Contains() = false for the record before the torn one")
+	}
+	if after, _ := os.Stat(logPath); after.Size() != info.Size() {
+		t.Errorf("log is %d bytes after replay, want the torn record removed (%d bytes)", after.Size(), info.Size())
+	}
+
+	// records appended after the torn one was removed are replayed
+	_ = loaded.Add("after")
+	_ = wal.Close()
+	if reloaded, _ := reloadWAL(t, dir, WALOptions{}); !reloaded.Contains("after") {
+		t.Errorf("Contains() = false for a record appended after replay")
+	}
+}
+
+// gatedPersistence holds every save after the first until gate is closed
+type gatedPersistence[T any] struct {
+	Persistence[T]
+	gate  chan struct{}
+	saves atomic.Int32
+}
+
+func (gp *gatedPersistence[T]) Save(bf *BloomFilter[T]) error {
+	if gp.saves.Add(1) > 1 {
+		<-gp.gate
+	}
+	return gp.Persistence.Save(bf)
+}
+
+func TestWALPersistence_Compaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := WALOptions{CompactSize: 1024}
+	snapshot := &gatedPersistence[string]{Persistence: filePersistence[string](dir, "filter.dat"),
+		gate: make(chan struct{})}
+	wal := NewWALPersistence[string](snapshot, filepath.Join(dir, "filter.wal"), opts)
+	bf := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](1<<16, nil)).WithPersistence(wal)
+
+	// inserts carry on while the compaction's snapshot is saved, which the gate holds up
+	for i := 0; i < 1000; i++ {
+		if err := bf.Add(strconv.Itoa(i)); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	oldPath := filepath.Join(dir, "filter.wal.old")
+	if _, err := os.Stat(oldPath); err != nil {
+		t.Fatalf("compacted log wasn't kept while its snapshot was being saved: %v", err)
+	}
+	// a crash before the snapshot is saved loses nothing, as both logs are replayed
+	crashed, _ := reloadWAL(t, dir, opts)
+	for i := 0; i < 1000; i++ {
+		if !crashed.Contains(strconv.Itoa(i)) {
+			t.Fatalf("Contains(%d) = false after replaying both logs", i)
+		}
+	}
+
+	close(snapshot.gate)
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := os.Stat(oldPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("compacted log wasn't removed once its snapshot was saved")
+	}
+	loaded, _ := reloadWAL(t, dir, opts)
+	for i := 0; i < 1000; i++ {
+		if !loaded.Contains(strconv.Itoa(i)) {
+			t.Fatalf("Contains(%d) = false after compaction", i)
+		}
+	}
+}
+
+func TestWALPersistence_CorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	bf, wal := newWALFilter(t, dir, WALOptions{})
+	for _, key := range []string{"first", "second", "third"} {
+		_ = bf.Add(key)
+	}
+	_ = wal.Close()
+	logPath := filepath.Join(dir, "filter.wal")
+	data, _ := os.ReadFile(logPath)
+	const recordSize = 4 + 8*5 + 4
+
+	// a damaged record followed by a valid one wasn't torn by a crash
+	damaged := append([]byte{}, data...)
+	damaged[walHeaderSize+recordSize+10] ^= 1
+	_ = os.WriteFile(logPath, damaged, 0o644)
+	wal = NewWALPersistence[string](filePersistence[string](dir, "filter.dat"), logPath, WALOptions{})
+	if err := NewBloomFilter[string]().WithPersistence(wal).LoadPersistence(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("LoadPersistence() of a log with a damaged record before valid ones error = %v, want ErrCorrupt", err)
+	}
+
+	// a damaged final record was, and is removed
+	damaged = append([]byte{}, data...)
+	damaged[walHeaderSize+2*recordSize+10] ^= 1
+	_ = os.WriteFile(logPath, damaged, 0o644)
+	loaded, _ := reloadWAL(t, dir, WALOptions{})
+	if !loaded.Contains("first") || !loaded.Contains("second") {
+		t.Errorf("Contains() = false for the records before a torn one")
+	}
+	if info, _ := os.Stat(logPath); info.Size() != walHeaderSize+2*recordSize {
+		t.Errorf("log is %d bytes after replay, want the torn record removed (%d bytes)", info.Size(),
+			walHeaderSize+2*recordSize)
+	}
+}
+
+func TestWALPersistence_CloseHoldsLock(t *testing.T) {
+	dir := t.TempDir()
+	bf, wal := newWALFilter(t, dir, WALOptions{SyncInterval: time.Millisecond})
+	_ = bf.Add("key")
+
+	// nothing else may take the lock while Close runs, not even the background sync it stops
+	wal.mu.Lock()
+	var acquired atomic.Bool
+	go func() {
+		wal.mu.Lock()
+		acquired.Store(true)
+		wal.mu.Unlock()
+	}()
+	time.Sleep(5 * time.Millisecond)
+	err := wal.closeLocked()
+	if acquired.Load() {
+		t.Errorf("the lock was released during closeLocked()")
+	}
+	wal.mu.Unlock()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if loaded, _ := reloadWAL(t, dir, WALOptions{}); !loaded.Contains("key") {
+		t.Errorf("Contains() = false for an insert buffered when the log was closed")
+	}
+}
+
+func TestWALPersistence_GroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	opts := WALOptions{SyncInterval: time.Millisecond}
+	bf, wal := newWALFilter(t, dir, opts)
+	_ = bf.Add("first")
+
+	logPath := filepath.Join(dir, "filter.wal")
+	waitFor(t, "the background sync", func() bool {
+		info, err := os.Stat(logPath)
+		return err == nil && info.Size() > walHeaderSize
+	})
+	_ = bf.Add("second")
+	if err := wal.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	_ = wal.Close()
+
+	loaded, _ := reloadWAL(t, dir, opts)
+	if !loaded.Contains("first") || !loaded.Contains("second") {
+		t.Errorf("Contains() = false for an insert written by group commit")
+	}
+}
+
+func TestWALPersistence_SaveEmptiesLog(t *testing.T) {
+	dir := t.TempDir()
+	bf, wal := newWALFilter(t, dir, WALOptions{})
+	defer wal.Close()
+	_ = bf.Add("saved")
+	if err := bf.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "filter.wal")); info.Size() != walHeaderSize {
+		t.Errorf("log is %d bytes after Save(), want only its header", info.Size())
+	}
+
+	if _, err := NewAutoPersist(bf, AutoPersistOptions{Inserts: 1}); err == nil {
+		t.Errorf("NewAutoPersist() of a filter with a WAL succeeded, want error")
+	}
+}
+
+func TestWALPersistence_RejectsEnvelopes(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "filter.wal")
+	public, private := newSigningKey(t, 1)
+	ep, err := NewEncryptedPersistence[string](filePersistence[string](dir, "filter.enc"),
+		NewStaticKey("k", [EncryptionKeySize]byte{1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an encrypted snapshot would have its members logged in the clear
+	encrypted := NewWALPersistence[string](ep, logPath, WALOptions{})
+	bf := newTestFilter(t, 5, common.Murmur3, NewBitPackingStorage[string](1<<16, nil)).WithPersistence(encrypted)
+	if err := bf.Add("secret"); err == nil {
+		t.Errorf("Add() with an encrypted snapshot succeeded, want error")
+	}
+	if err := bf.SavePersistence(); err == nil {
+		t.Errorf("SavePersistence() with an encrypted snapshot succeeded, want error")
+	}
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Errorf("log was created for an encrypted snapshot")
+	}
+
+	// the unsigned log would be replayed onto a verified snapshot
+	signed := newSignedFilter(t, private, 1<<16)
+	if err := filePersistence[string](dir, "filter.dat").Save(signed); err != nil {
+		t.Fatal(err)
+	}
+	wal := NewWALPersistence[string](filePersistence[string](dir, "filter.dat"), logPath, WALOptions{})
+	verified := NewBloomFilter[string]().WithTrustedKeys(public).WithPersistence(wal)
+	if err := verified.LoadPersistence(); err == nil {
+		t.Errorf("LoadPersistence() with trusted keys succeeded, want error")
+	}
+	if err := signed.WithPersistence(wal).Add("key"); err == nil {
+		t.Errorf("Add() to a signed filter succeeded, want error")
+	}
+}
+
+func TestWALPersistence_FailedAddNotRetried(t *testing.T) {
+	dir := t.TempDir()
+	bf, wal := newWALFilter(t, dir, WALOptions{})
+	if err := bf.Add("first"); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	// closing the log behind the WALPersistence's back makes the next write fail
+	_ = wal.log.Close()
+	if err := bf.Add("failed"); err == nil {
+		t.Fatalf("Add() with a closed log succeeded, want error")
+	}
+	if len(wal.pending) != 0 {
+		t.Errorf("failed Add() left %d bytes buffered, want none", len(wal.pending))
+	}
+	if bf.Contains("failed") {
+		t.Errorf("Contains() = true for a failed Add()")
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/binary"
+	"fmt"
 	"github.com/dchest/siphash"
 	"github.com/twmb/murmur3"
 	"github.com/zeebo/xxh3"
+	"hash/crc32"
+	"hash/maphash"
 )
 
 const (
@@ -16,17 +19,100 @@ const (
 	Sha512      = uint8(3)
 	SipHash     = uint8(4)
 	XXhash      = uint8(5)
+	WyHash      = uint8(6)
+	FNV1a       = uint8(7)
+	CRC32C      = uint8(8)
+	MapHash     = uint8(9)
 )
 
+// HashFunc computes the hash of an already encoded key with the given seed
+type HashFunc func(keyBytes []byte, seed uint32) uint64
+
+// FNV-1a 64-bit parameters, as used by hash/fnv
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// castagnoliTable is used by HashBytesCRC32C; hash/crc32 uses the SSE4.2/ARMv8 CRC instructions for this polynomial
+// where they are available.
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// mapHashSeed is chosen at random when the process starts, so values produced by HashBytesMapHash are only meaningful
+// within a single process.
+var mapHashSeed = maphash.MakeSeed()
+
+// IsPersistable reports whether filters built with the given hash function may be saved and reloaded.  Hash functions
+// whose output depends on per-process state (currently only MapHash) can't be persisted.
+func IsPersistable(hashFunc uint8) bool {
+	return hashFunc != MapHash
+}
+
+// HashName returns the name of one of the hash enums above, as used in this package, such as "Murmur3"
+func HashName(hashFunc uint8) string {
+	switch hashFunc {
+	case Murmur3:
+		return "Murmur3"
+	case Sha256:
+		return "Sha256"
+	case Sha512:
+		return "Sha512"
+	case SipHash:
+		return "SipHash"
+	case XXhash:
+		return "XXhash"
+	case WyHash:
+		return "WyHash"
+	case FNV1a:
+		return "FNV1a"
+	case CRC32C:
+		return "CRC32C"
+	case MapHash:
+		return "MapHash"
+	default:
+		return fmt.Sprintf("unknown hash %d", hashFunc)
+	}
+}
+
+// HashFuncFor returns the HashFunc matching one of the hash enums above
+func HashFuncFor(hashFunc uint8) (HashFunc, bool) {
+	switch hashFunc {
+	case Murmur3:
+		return HashBytesMurmur3, true
+	case Sha256:
+		return HashBytesSha256, true
+	case Sha512:
+		return HashBytesSha512, true
+	case SipHash:
+		return HashBytesSipHash, true
+	case XXhash:
+		return HashBytesXXhash, true
+	case WyHash:
+		return HashBytesWyHash, true
+	case FNV1a:
+		return HashBytesFNV1a, true
+	case CRC32C:
+		return HashBytesCRC32C, true
+	case MapHash:
+		return HashBytesMapHash, true
+	default:
+		return nil, false
+	}
+}
+
 // HashKeyMurmur3 uses NumToBytes to convert a numeric type to bytes and computes the hash value using Murmur3.
 func HashKeyMurmur3[T Hashable](key T, seed uint32) (uint64, error) {
 	keyBytes, err := NumToBytes[T](key) // Directly using NumToBytes
 	if err != nil {
 		return 0, err // Properly handle errors from NumToBytes
 	}
+	return HashBytesMurmur3(keyBytes, seed), nil
+}
 
+// HashBytesMurmur3 computes the hash value of keyBytes using Murmur3
+func HashBytesMurmur3(keyBytes []byte, seed uint32) uint64 {
 	h1, h2 := murmur3.SeedSum128(uint64(seed), uint64(seed), keyBytes)
-	return h1 ^ h2, nil
+	return h1 ^ h2
 }
 
 // HashKeySha256 uses NumToBytes to convert a numeric type to bytes and computes the hash value using SHA-256
@@ -35,7 +121,11 @@ func HashKeySha256[T Hashable](key T, seed uint32) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
+	return HashBytesSha256(keyBytes, seed), nil
+}
 
+// HashBytesSha256 computes the hash value of keyBytes using SHA-256
+func HashBytesSha256(keyBytes []byte, seed uint32) uint64 {
 	// Prepare buffer and write seed and key to it
 	buffer := make([]byte, 4+len(keyBytes))
 	binary.BigEndian.PutUint32(buffer[:4], seed)
@@ -47,7 +137,7 @@ func HashKeySha256[T Hashable](key T, seed uint32) (uint64, error) {
 	h1 := binary.BigEndian.Uint64(sum[:8])
 	h2 := binary.BigEndian.Uint64(sum[8:16])
 
-	return h1 ^ h2, nil
+	return h1 ^ h2
 }
 
 // HashKeySha512 uses NumToBytes to convert a numeric type to bytes and computes the hash value using SHA-512
@@ -56,7 +146,11 @@ func HashKeySha512[T Hashable](key T, seed uint32) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
+	return HashBytesSha512(keyBytes, seed), nil
+}
 
+// HashBytesSha512 computes the hash value of keyBytes using SHA-512
+func HashBytesSha512(keyBytes []byte, seed uint32) uint64 {
 	// Prepare buffer and write seed and key to it
 	buffer := make([]byte, 4+len(keyBytes))
 	binary.BigEndian.PutUint32(buffer[:4], seed)
@@ -65,9 +159,7 @@ func HashKeySha512[T Hashable](key T, seed uint32) (uint64, error) {
 	sum := sha512.Sum512(buffer)
 
 	// Convert the first 8 bytes of hash output to uint64
-	value := binary.BigEndian.Uint64(sum[:8])
-
-	return value, nil
+	return binary.BigEndian.Uint64(sum[:8])
 }
 
 // HashKeySipHash uses NumToBytes to convert a numeric type to bytes and computes the hash value using SipHash
@@ -76,10 +168,13 @@ func HashKeySipHash[T Hashable](key T, seed uint32) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
+	return HashBytesSipHash(keyBytes, seed), nil
+}
 
+// HashBytesSipHash computes the hash value of keyBytes using SipHash, with the seed as its key
+func HashBytesSipHash(keyBytes []byte, seed uint32) uint64 {
 	h1, h2 := siphash.Hash128(uint64(seed), uint64(seed), keyBytes)
-
-	return h1 ^ h2, nil
+	return h1 ^ h2
 }
 
 // HashKeyXXhash uses NumToBytes to convert a numeric type to bytes and computes the hash value using XX Hash
@@ -88,8 +183,101 @@ func HashKeyXXhash[T Hashable](key T, seed uint32) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
+	return HashBytesXXhash(keyBytes, seed), nil
+}
 
+// HashBytesXXhash computes the hash value of keyBytes using XX Hash
+func HashBytesXXhash(keyBytes []byte, seed uint32) uint64 {
 	h := xxh3.Hash128Seed(keyBytes, uint64(seed))
+	return h.Hi ^ h.Lo
+}
+
+// HashKeyWyHash uses NumToBytes to convert a numeric type to bytes and computes the hash value using wyhash
+func HashKeyWyHash[T Hashable](key T, seed uint32) (uint64, error) {
+	keyBytes, err := NumToBytes[T](key)
+	if err != nil {
+		return 0, err
+	}
+	return HashBytesWyHash(keyBytes, seed), nil
+}
+
+// HashBytesWyHash computes the hash value of keyBytes using wyhash
+func HashBytesWyHash(keyBytes []byte, seed uint32) uint64 {
+	return wyhash(keyBytes, uint64(seed))
+}
+
+// HashKeyFNV1a uses NumToBytes to convert a numeric type to bytes and computes the hash value using 64-bit FNV-1a
+func HashKeyFNV1a[T Hashable](key T, seed uint32) (uint64, error) {
+	keyBytes, err := NumToBytes[T](key)
+	if err != nil {
+		return 0, err
+	}
+	return HashBytesFNV1a(keyBytes, seed), nil
+}
+
+// HashBytesFNV1a computes the hash value of keyBytes using 64-bit FNV-1a
+func HashBytesFNV1a(keyBytes []byte, seed uint32) uint64 {
+	// FNV-1a, inlined rather than using hash/fnv to avoid allocating a hash.Hash64 per call
+	h := uint64(fnvOffset64)
+	for shift := 24; shift >= 0; shift -= 8 {
+		h ^= uint64(byte(seed >> shift))
+		h *= fnvPrime64
+	}
+	for _, c := range keyBytes {
+		h ^= uint64(c)
+		h *= fnvPrime64
+	}
+
+	// FNV-1a has weak avalanche in its high bits, so finish with a 64-bit mix before the value is reduced to an index
+	return fmix64(h)
+}
+
+// HashKeyCRC32C uses NumToBytes to convert a numeric type to bytes and computes the hash value using CRC-32C
+// (Castagnoli).  As CRC-32C only produces 32 bits, the checksum is combined with the seed and mixed out to 64 bits; keys
+// whose checksums collide will therefore collide for every seed.
+func HashKeyCRC32C[T Hashable](key T, seed uint32) (uint64, error) {
+	keyBytes, err := NumToBytes[T](key)
+	if err != nil {
+		return 0, err
+	}
+	return HashBytesCRC32C(keyBytes, seed), nil
+}
+
+// HashBytesCRC32C computes the hash value of keyBytes using CRC-32C; see HashKeyCRC32C
+func HashBytesCRC32C(keyBytes []byte, seed uint32) uint64 {
+	crc := crc32.Checksum(keyBytes, castagnoliTable)
+	return fmix64(uint64(seed)<<32 | uint64(crc))
+}
+
+// HashKeyMapHash uses NumToBytes to convert a numeric type to bytes and computes the hash value using hash/maphash.
+// The maphash seed is random per process, so filters using this hash function can't be persisted.
+func HashKeyMapHash[T Hashable](key T, seed uint32) (uint64, error) {
+	keyBytes, err := NumToBytes[T](key)
+	if err != nil {
+		return 0, err
+	}
+	return HashBytesMapHash(keyBytes, seed), nil
+}
+
+// HashBytesMapHash computes the hash value of keyBytes using hash/maphash; see HashKeyMapHash
+func HashBytesMapHash(keyBytes []byte, seed uint32) uint64 {
+	var seedBytes [4]byte
+	binary.BigEndian.PutUint32(seedBytes[:], seed)
+
+	var h maphash.Hash
+	h.SetSeed(mapHashSeed)
+	h.Write(seedBytes[:])
+	h.Write(keyBytes)
+
+	return h.Sum64()
+}
 
-	return h.Hi ^ h.Lo, nil
+// fmix64 is the 64-bit finalizer from MurmurHash3
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
 }
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestHashKeyFunctions(t *testing.T) {
+	testCases := []struct {
+		name     string
+		hashFunc func(string, uint32) (uint64, error)
+	}{
+		{name: "Murmur3", hashFunc: HashKeyMurmur3[string]},
+		{name: "Sha256", hashFunc: HashKeySha256[string]},
+		{name: "Sha512", hashFunc: HashKeySha512[string]},
+		{name: "SipHash", hashFunc: HashKeySipHash[string]},
+		{name: "XXhash", hashFunc: HashKeyXXhash[string]},
+		{name: "WyHash", hashFunc: HashKeyWyHash[string]},
+		{name: "FNV1a", hashFunc: HashKeyFNV1a[string]},
+		{name: "CRC32C", hashFunc: HashKeyCRC32C[string]},
+		{name: "MapHash", hashFunc: HashKeyMapHash[string]},
+	}
+
+	// cover every length branch of wyhash, including the 48 byte bulk loop
+	keys := []string{"", "a", "abc", "abcd", "abcdefghijklmnop", "abcdefghijklmnopq", string(make([]byte, 100))}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			seen := make(map[uint64]string)
+			for _, key := range keys {
+				first, err := tc.hashFunc(key, 1)
+				if err != nil {
+					t.Fatalf("hashing %q failed: %v", key, err)
+				}
+				second, _ := tc.hashFunc(key, 1)
+				if first != second {
+					t.Errorf("hash of %q isn't deterministic: %d != %d", key, first, second)
+				}
+				otherSeed, _ := tc.hashFunc(key, 2)
+				if first == otherSeed {
+					t.Errorf("hash of %q doesn't depend on the seed", key)
+				}
+				if prev, ok := seen[first]; ok {
+					t.Errorf("hash of %q collides with %q", key, prev)
+				}
+				seen[first] = key
+			}
+		})
+	}
+}
+
+func TestIsPersistable(t *testing.T) {
+	for _, hashFunc := range []uint8{Murmur3, Sha256, Sha512, SipHash, XXhash, WyHash, FNV1a, CRC32C} {
+		if !IsPersistable(hashFunc) {
+			t.Errorf("IsPersistable(%d) = false, want true", hashFunc)
+		}
+	}
+	if IsPersistable(MapHash) {
+		t.Error("IsPersistable(MapHash) = true, want false")
+	}
+}
@@ -0,0 +1,157 @@
+package common
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// KeyEncoder converts keys of type T into the bytes which are hashed.  Encodings must be deterministic, and two keys
+// should only produce the same bytes if they are meant to be treated as the same key.
+type KeyEncoder[T any] interface {
+	// AppendKey appends the encoding of key to dst and returns the extended slice
+	AppendKey(dst []byte, key T) ([]byte, error)
+}
+
+// KeyEncoderFunc allows an ordinary function to be used as a KeyEncoder
+type KeyEncoderFunc[T any] func(dst []byte, key T) ([]byte, error)
+
+// AppendKey calls f(dst, key)
+func (f KeyEncoderFunc[T]) AppendKey(dst []byte, key T) ([]byte, error) {
+	return f(dst, key)
+}
+
+// KeyAppender may be implemented by key types which know how to encode themselves.  It takes precedence over
+// encoding.BinaryMarshaler when both are implemented.
+type KeyAppender interface {
+	AppendBytes(dst []byte) ([]byte, error)
+}
+
+// EncodeKey converts any key into bytes: keys implementing KeyAppender or encoding.BinaryMarshaler are encoded using
+// those methods, and everything else is encoded as NumToBytes would, including types derived from those in Hashable.
+func EncodeKey[T any](key T) ([]byte, error) {
+	switch m := any(key).(type) {
+	case KeyAppender:
+		return m.AppendBytes(nil)
+	case encoding.BinaryMarshaler:
+		return m.MarshalBinary()
+	default:
+		return scalarToBytes(key)
+	}
+}
+
+// DefaultKeyEncoder returns a KeyEncoder which encodes keys as EncodeKey does; it is used by filters which haven't been
+// given a KeyEncoder.  Which encoding applies is decided once, from T, so keys needn't be converted to interfaces.
+func DefaultKeyEncoder[T any]() KeyEncoder[T] {
+	var zero T
+	switch any(zero).(type) {
+	case KeyAppender:
+		return KeyEncoderFunc[T](func(dst []byte, key T) ([]byte, error) {
+			return any(key).(KeyAppender).AppendBytes(dst)
+		})
+	case encoding.BinaryMarshaler:
+		return KeyEncoderFunc[T](func(dst []byte, key T) ([]byte, error) {
+			return appendNonEmpty(dst, any(key).(encoding.BinaryMarshaler).MarshalBinary)
+		})
+	default:
+		return KeyEncoderFunc[T](func(dst []byte, key T) ([]byte, error) {
+			return appendNonEmpty(dst, func() ([]byte, error) { return scalarToBytes(key) })
+		})
+	}
+}
+
+// appendNonEmpty appends the output of encode to dst, avoiding the copy when dst is empty
+func appendNonEmpty(dst []byte, encode func() ([]byte, error)) ([]byte, error) {
+	keyBytes, err := encode()
+	if err != nil || len(dst) == 0 {
+		return keyBytes, err
+	}
+	return append(dst, keyBytes...), nil
+}
+
+// AddrKeyEncoder returns a KeyEncoder for IP addresses, using netip.Addr's binary encoding (4 bytes for IPv4, 16 for
+// IPv6 followed by any zone).  An IPv4 address and its IPv4-mapped IPv6 form are distinct keys.
+func AddrKeyEncoder() KeyEncoder[netip.Addr] {
+	return KeyEncoderFunc[netip.Addr](func(dst []byte, addr netip.Addr) ([]byte, error) {
+		addrBytes, err := addr.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return append(dst, addrBytes...), nil
+	})
+}
+
+// TimeKeyEncoder returns a KeyEncoder for instants in time, encoded as 8 bytes of Unix seconds followed by 4 bytes of
+// nanoseconds.  The location and monotonic clock reading are ignored, so the same instant in different time zones is
+// the same key.  Truncate times first (e.g. to the day) if a coarser key is wanted.
+func TimeKeyEncoder() KeyEncoder[time.Time] {
+	return KeyEncoderFunc[time.Time](func(dst []byte, t time.Time) ([]byte, error) {
+		dst = binary.BigEndian.AppendUint64(dst, uint64(t.Unix()))
+		return binary.BigEndian.AppendUint32(dst, uint32(t.Nanosecond())), nil
+	})
+}
+
+// UUIDKeyEncoder returns a KeyEncoder for UUIDs, or any other key held as 16 raw bytes
+func UUIDKeyEncoder() KeyEncoder[[16]byte] {
+	return KeyEncoderFunc[[16]byte](func(dst []byte, uuid [16]byte) ([]byte, error) {
+		return append(dst, uuid[:]...), nil
+	})
+}
+
+// Tuple2 is a composite key of two fields
+type Tuple2[A, B any] struct {
+	First  A
+	Second B
+}
+
+// Tuple3 is a composite key of three fields, such as (tenant, user, day)
+type Tuple3[A, B, C any] struct {
+	First  A
+	Second B
+	Third  C
+}
+
+// Tuple2KeyEncoder returns a KeyEncoder for Tuple2 keys.  Each field is length prefixed, so ("ab", "c") and ("a", "bc")
+// are different keys.
+func Tuple2KeyEncoder[A, B any](first KeyEncoder[A], second KeyEncoder[B]) KeyEncoder[Tuple2[A, B]] {
+	return KeyEncoderFunc[Tuple2[A, B]](func(dst []byte, key Tuple2[A, B]) ([]byte, error) {
+		dst, err := appendField(dst, first, key.First)
+		if err != nil {
+			return nil, err
+		}
+		return appendField(dst, second, key.Second)
+	})
+}
+
+// Tuple3KeyEncoder returns a KeyEncoder for Tuple3 keys, with each field length prefixed as in Tuple2KeyEncoder
+func Tuple3KeyEncoder[A, B, C any](first KeyEncoder[A], second KeyEncoder[B], third KeyEncoder[C]) KeyEncoder[Tuple3[A, B, C]] {
+	return KeyEncoderFunc[Tuple3[A, B, C]](func(dst []byte, key Tuple3[A, B, C]) ([]byte, error) {
+		dst, err := appendField(dst, first, key.First)
+		if err != nil {
+			return nil, err
+		}
+		dst, err = appendField(dst, second, key.Second)
+		if err != nil {
+			return nil, err
+		}
+		return appendField(dst, third, key.Third)
+	})
+}
+
+// appendField appends a 4 byte length followed by the encoding of field
+func appendField[F any](dst []byte, encoder KeyEncoder[F], field F) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	dst, err := encoder.AppendKey(dst, field)
+	if err != nil {
+		return nil, err
+	}
+	fieldLen := len(dst) - start - 4
+	if uint64(fieldLen) > 1<<32-1 {
+		return nil, errors.New("tuple field is too long to encode")
+	}
+	binary.BigEndian.PutUint32(dst[start:], uint32(fieldLen))
+	return dst, nil
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type appenderKey struct{ id uint16 }
+
+func (k appenderKey) AppendBytes(dst []byte) ([]byte, error) {
+	return append(dst, 'a', byte(k.id>>8), byte(k.id)), nil
+}
+
+type unsupportedKey struct{ id int }
+
+func TestDefaultKeyEncoder(t *testing.T) {
+	got, err := DefaultKeyEncoder[appenderKey]().AppendKey(nil, appenderKey{id: 258})
+	if err != nil || !bytes.Equal(got, []byte{'a', 1, 2}) {
+		t.Errorf("AppendKey() with a KeyAppender = %v, %v, want %v", got, err, []byte{'a', 1, 2})
+	}
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	got, err = DefaultKeyEncoder[netip.Addr]().AppendKey(nil, addr)
+	if err != nil || !bytes.Equal(got, []byte{192, 0, 2, 1}) {
+		t.Errorf("AppendKey() with a BinaryMarshaler = %v, %v, want %v", got, err, []byte{192, 0, 2, 1})
+	}
+
+	got, err = DefaultKeyEncoder[int32]().AppendKey([]byte{9}, 300)
+	if err != nil || !bytes.Equal(got, []byte{9, 0, 0, 1, 44}) {
+		t.Errorf("AppendKey() with a scalar = %v, %v, want %v", got, err, []byte{9, 0, 0, 1, 44})
+	}
+
+	if _, err := DefaultKeyEncoder[unsupportedKey]().AppendKey(nil, unsupportedKey{}); !errors.Is(err, ErrUnsupportedKey) {
+		t.Errorf("AppendKey() with an unsupported struct error = %v, want ErrUnsupportedKey", err)
+	}
+}
+
+func TestTimeKeyEncoder(t *testing.T) {
+	utc := time.Date(2024, 5, 1, 12, 0, 0, 5, time.UTC)
+	local := utc.In(time.FixedZone("UTC+2", 2*60*60))
+
+	a, _ := TimeKeyEncoder().AppendKey(nil, utc)
+	b, _ := TimeKeyEncoder().AppendKey(nil, local)
+	if !bytes.Equal(a, b) {
+		t.Errorf("the same instant in different zones encoded differently: %v and %v", a, b)
+	}
+	if len(a) != 12 {
+		t.Errorf("encoded time is %d bytes, want 12", len(a))
+	}
+}
+
+func TestAddrKeyEncoder(t *testing.T) {
+	v4, _ := AddrKeyEncoder().AppendKey(nil, netip.MustParseAddr("192.0.2.1"))
+	mapped, _ := AddrKeyEncoder().AppendKey(nil, netip.MustParseAddr("::ffff:192.0.2.1"))
+	if bytes.Equal(v4, mapped) {
+		t.Errorf("IPv4 and IPv4-mapped IPv6 addresses encoded the same: %v", v4)
+	}
+}
+
+func TestUUIDKeyEncoder(t *testing.T) {
+	uuid := [16]byte{0: 0xde, 15: 0xad}
+	got, _ := UUIDKeyEncoder().AppendKey([]byte{1}, uuid)
+	if !bytes.Equal(got[1:], uuid[:]) || got[0] != 1 {
+		t.Errorf("AppendKey() = %v, want %v appended to [1]", got, uuid)
+	}
+}
+
+func TestTupleKeyEncoders(t *testing.T) {
+	pair := Tuple2KeyEncoder(DefaultKeyEncoder[string](), DefaultKeyEncoder[string]())
+	a, _ := pair.AppendKey(nil, Tuple2[string, string]{"ab", "c"})
+	b, _ := pair.AppendKey(nil, Tuple2[string, string]{"a", "bc"})
+	if bytes.Equal(a, b) {
+		t.Errorf("(ab, c) and (a, bc) encoded the same: %v", a)
+	}
+	want := []byte{0, 0, 0, 2, 'a', 'b', 0, 0, 0, 1, 'c'}
+	if !bytes.Equal(a, want) {
+		t.Errorf("AppendKey() = %v, want %v", a, want)
+	}
+
+	triple := Tuple3KeyEncoder(DefaultKeyEncoder[string](), UUIDKeyEncoder(), TimeKeyEncoder())
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	got, err := triple.AppendKey(nil, Tuple3[string, [16]byte, time.Time]{"tenant", [16]byte{1}, day})
+	if err != nil {
+		t.Fatalf("AppendKey() error = %v", err)
+	}
+	if len(got) != 4+6+4+16+4+12 {
+		t.Errorf("encoded tuple is %d bytes, want %d", len(got), 4+6+4+16+4+12)
+	}
+
+	failing := Tuple2KeyEncoder(DefaultKeyEncoder[string](), DefaultKeyEncoder[unsupportedKey]())
+	if _, err := failing.AppendKey(nil, Tuple2[string, unsupportedKey]{"a", unsupportedKey{}}); err == nil {
+		t.Error("AppendKey() with an unsupported field succeeded, want error")
+	}
+}
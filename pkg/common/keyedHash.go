@@ -0,0 +1,125 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"github.com/dchest/siphash"
+)
+
+// SecretKeySize is the size in bytes of the secret key used for keyed hashing
+const SecretKeySize = 16
+
+// keyCheckLabel is the message MACed by SecretKeyCheck
+const keyCheckLabel = "GoCeannaithe secret key check"
+
+// SupportsSecretKey reports whether the given hash function has a keyed variant.  Only the cryptographic hash functions
+// do; the others are fast but offer no protection from an attacker who knows the key.
+func SupportsSecretKey(hashFunc uint8) bool {
+	switch hashFunc {
+	case SipHash, Sha256, Sha512:
+		return true
+	default:
+		return false
+	}
+}
+
+// KeyedHashFuncFor returns the keyed variant of one of the hash enums, using secret as the key
+func KeyedHashFuncFor(hashFunc uint8, secret [SecretKeySize]byte) (HashFunc, bool) {
+	switch hashFunc {
+	case SipHash:
+		return HashBytesSipHashKeyed(secret), true
+	case Sha256:
+		return HashBytesHmacSha256(secret), true
+	case Sha512:
+		return HashBytesHmacSha512(secret), true
+	default:
+		return nil, false
+	}
+}
+
+// SecretKeyCheck returns a short value derived from the secret key, which may be stored alongside a filter so that a
+// later load can detect the wrong key being supplied without the key itself being written anywhere.
+func SecretKeyCheck(secret [SecretKeySize]byte) []byte {
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte(keyCheckLabel))
+	return mac.Sum(nil)[:16]
+}
+
+// HashKeySipHashKeyed returns a hash function which uses NumToBytes to convert a numeric type to bytes and computes the
+// hash value using SipHash keyed with secret.  The seed is hashed along with the key, so the bit positions of a key
+// can't be predicted without knowing the secret.
+func HashKeySipHashKeyed[T Hashable](secret [SecretKeySize]byte) func(T, uint32) (uint64, error) {
+	return hashKeyWith[T](HashBytesSipHashKeyed(secret))
+}
+
+// HashBytesSipHashKeyed returns a HashFunc computing SipHash keyed with secret; see HashKeySipHashKeyed
+func HashBytesSipHashKeyed(secret [SecretKeySize]byte) HashFunc {
+	k0 := binary.LittleEndian.Uint64(secret[:8])
+	k1 := binary.LittleEndian.Uint64(secret[8:])
+	return func(keyBytes []byte, seed uint32) uint64 {
+		buffer := make([]byte, 4+len(keyBytes))
+		binary.BigEndian.PutUint32(buffer[:4], seed)
+		copy(buffer[4:], keyBytes)
+
+		h1, h2 := siphash.Hash128(k0, k1, buffer)
+		return h1 ^ h2
+	}
+}
+
+// HashKeyHmacSha256 returns a hash function which uses NumToBytes to convert a numeric type to bytes and computes the
+// hash value using HMAC-SHA-256 keyed with secret
+func HashKeyHmacSha256[T Hashable](secret [SecretKeySize]byte) func(T, uint32) (uint64, error) {
+	return hashKeyWith[T](HashBytesHmacSha256(secret))
+}
+
+// HashBytesHmacSha256 returns a HashFunc computing HMAC-SHA-256 keyed with secret
+func HashBytesHmacSha256(secret [SecretKeySize]byte) HashFunc {
+	return func(keyBytes []byte, seed uint32) uint64 {
+		var seedBytes [4]byte
+		binary.BigEndian.PutUint32(seedBytes[:], seed)
+
+		mac := hmac.New(sha256.New, secret[:])
+		mac.Write(seedBytes[:])
+		mac.Write(keyBytes)
+		sum := mac.Sum(nil)
+
+		h1 := binary.BigEndian.Uint64(sum[:8])
+		h2 := binary.BigEndian.Uint64(sum[8:16])
+
+		return h1 ^ h2
+	}
+}
+
+// HashKeyHmacSha512 returns a hash function which uses NumToBytes to convert a numeric type to bytes and computes the
+// hash value using HMAC-SHA-512 keyed with secret
+func HashKeyHmacSha512[T Hashable](secret [SecretKeySize]byte) func(T, uint32) (uint64, error) {
+	return hashKeyWith[T](HashBytesHmacSha512(secret))
+}
+
+// HashBytesHmacSha512 returns a HashFunc computing HMAC-SHA-512 keyed with secret
+func HashBytesHmacSha512(secret [SecretKeySize]byte) HashFunc {
+	return func(keyBytes []byte, seed uint32) uint64 {
+		var seedBytes [4]byte
+		binary.BigEndian.PutUint32(seedBytes[:], seed)
+
+		mac := hmac.New(sha512.New, secret[:])
+		mac.Write(seedBytes[:])
+		mac.Write(keyBytes)
+		sum := mac.Sum(nil)
+
+		return binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+// hashKeyWith adapts a HashFunc into a hash function over Hashable keys, using NumToBytes to encode them
+func hashKeyWith[T Hashable](hashFunc HashFunc) func(T, uint32) (uint64, error) {
+	return func(key T, seed uint32) (uint64, error) {
+		keyBytes, err := NumToBytes[T](key)
+		if err != nil {
+			return 0, err
+		}
+		return hashFunc(keyBytes, seed), nil
+	}
+}
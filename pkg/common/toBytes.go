@@ -0,0 +1,149 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// ErrUnsupportedKey is wrapped by the errors returned for keys which can't be encoded: those whose type isn't one of the
+// types in Hashable or derived from one, and which don't implement KeyAppender or encoding.BinaryMarshaler
+var ErrUnsupportedKey = errors.New("unsupported key type")
+
+// canonicalNaN32 and canonicalNaN64 are the bit patterns every NaN is encoded as, so that all NaN keys hash alike
+// regardless of sign or payload
+const (
+	canonicalNaN32 = uint32(0x7fc00000)
+	canonicalNaN64 = uint64(0x7ff8000000000000)
+)
+
+// NumToBytes takes a numeric value and returns a slice of bytes representing that value in BigEndian format.
+//
+// The encoding is the same on every architecture, so that a filter persisted on one platform may be loaded on another:
+// int and uint are always encoded in 8 bytes (sign- and zero-extended respectively), every NaN is encoded as a single
+// canonical quiet NaN, and -0 is encoded as +0.
+func NumToBytes[T Hashable](num T) ([]byte, error) {
+	return scalarToBytes(num)
+}
+
+// scalarToBytes implements NumToBytes without restricting T to Hashable, so that it can also be used by EncodeKey
+func scalarToBytes[T any](num T) ([]byte, error) {
+	switch k := any(num).(type) {
+	case int:
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(int64(k)))
+		return buf, nil
+	case uint:
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(k))
+		return buf, nil
+	case int8:
+		return []byte{byte(k)}, nil
+	case uint8:
+		return []byte{k}, nil
+	case int16:
+		buf := make([]byte, 2)
+		binary.BigEndian.PutUint16(buf, uint16(k))
+		return buf, nil
+	case uint16:
+		buf := make([]byte, 2)
+		binary.BigEndian.PutUint16(buf, k)
+		return buf, nil
+	case int32:
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, uint32(k))
+		return buf, nil
+	case uint32:
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, k)
+		return buf, nil
+	case int64:
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(k))
+		return buf, nil
+	case uint64:
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, k)
+		return buf, nil
+	case float32:
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, canonicalFloat32bits(k))
+		return buf, nil
+	case float64:
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, canonicalFloat64bits(k))
+		return buf, nil
+	case string:
+		return []byte(k), nil
+	case []byte:
+		return k, nil
+	default:
+		return derivedToBytes(any(num))
+	}
+}
+
+// canonicalFloat32bits returns the IEEE 754 representation of f, with all NaNs mapped to canonicalNaN32 and -0 to +0
+func canonicalFloat32bits(f float32) uint32 {
+	switch {
+	case math.IsNaN(float64(f)):
+		return canonicalNaN32
+	case f == 0:
+		return 0
+	default:
+		return math.Float32bits(f)
+	}
+}
+
+// canonicalFloat64bits returns the IEEE 754 representation of f, with all NaNs mapped to canonicalNaN64 and -0 to +0
+func canonicalFloat64bits(f float64) uint64 {
+	switch {
+	case math.IsNaN(f):
+		return canonicalNaN64
+	case f == 0:
+		return 0
+	default:
+		return math.Float64bits(f)
+	}
+}
+
+// derivedToBytes handles keys whose type is derived from one of the types in Hashable, such as `type UserID string`,
+// which NumToBytes' type switch doesn't match.  The key is converted to its underlying type and encoded exactly as a
+// key of that type would be.
+func derivedToBytes(num any) ([]byte, error) {
+	v := reflect.ValueOf(num)
+	switch v.Kind() {
+	case reflect.Int:
+		return NumToBytes[int](int(v.Int()))
+	case reflect.Int8:
+		return NumToBytes[int8](int8(v.Int()))
+	case reflect.Int16:
+		return NumToBytes[int16](int16(v.Int()))
+	case reflect.Int32:
+		return NumToBytes[int32](int32(v.Int()))
+	case reflect.Int64:
+		return NumToBytes[int64](v.Int())
+	case reflect.Uint:
+		return NumToBytes[uint](uint(v.Uint()))
+	case reflect.Uint8:
+		return NumToBytes[uint8](uint8(v.Uint()))
+	case reflect.Uint16:
+		return NumToBytes[uint16](uint16(v.Uint()))
+	case reflect.Uint32:
+		return NumToBytes[uint32](uint32(v.Uint()))
+	case reflect.Uint64:
+		return NumToBytes[uint64](v.Uint())
+	case reflect.Float32:
+		return NumToBytes[float32](float32(v.Float()))
+	case reflect.Float64:
+		return NumToBytes[float64](v.Float())
+	case reflect.String:
+		return []byte(v.String()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Bytes(), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, num)
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// TestNumToBytes pins the encoding of every key type.  These vectors must hold on every GOARCH; a filter persisted on
+// one platform relies on them to be usable on another.
+func TestNumToBytes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		got      func() ([]byte, error)
+		expected []byte
+	}{
+		{"int", func() ([]byte, error) { return NumToBytes(int(300)) }, []byte{0, 0, 0, 0, 0, 0, 1, 44}},
+		{"negative int", func() ([]byte, error) { return NumToBytes(int(-2)) }, []byte{255, 255, 255, 255, 255, 255, 255, 254}},
+		{"uint", func() ([]byte, error) { return NumToBytes(uint(300)) }, []byte{0, 0, 0, 0, 0, 0, 1, 44}},
+		{"int8", func() ([]byte, error) { return NumToBytes(int8(-2)) }, []byte{254}},
+		{"uint8", func() ([]byte, error) { return NumToBytes(uint8(200)) }, []byte{200}},
+		{"int16", func() ([]byte, error) { return NumToBytes(int16(300)) }, []byte{1, 44}},
+		{"uint16", func() ([]byte, error) { return NumToBytes(uint16(300)) }, []byte{1, 44}},
+		{"int32", func() ([]byte, error) { return NumToBytes(int32(300)) }, []byte{0, 0, 1, 44}},
+		{"uint32", func() ([]byte, error) { return NumToBytes(uint32(300)) }, []byte{0, 0, 1, 44}},
+		{"int64", func() ([]byte, error) { return NumToBytes(int64(-300)) }, []byte{255, 255, 255, 255, 255, 255, 254, 212}},
+		{"uint64", func() ([]byte, error) { return NumToBytes(uint64(300)) }, []byte{0, 0, 0, 0, 0, 0, 1, 44}},
+		{"float32", func() ([]byte, error) { return NumToBytes(float32(300.5)) }, []byte{67, 150, 64, 0}},
+		{"float64", func() ([]byte, error) { return NumToBytes(float64(300.5)) }, []byte{64, 114, 200, 0, 0, 0, 0, 0}},
+		{"float32 -0", func() ([]byte, error) { return NumToBytes(float32(math.Copysign(0, -1))) }, []byte{0, 0, 0, 0}},
+		{"float64 -0", func() ([]byte, error) { return NumToBytes(math.Copysign(0, -1)) }, []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		{"float32 NaN", func() ([]byte, error) { return NumToBytes(math.Float32frombits(0xffc00001)) }, []byte{127, 192, 0, 0}},
+		{"float64 NaN", func() ([]byte, error) { return NumToBytes(-math.NaN()) }, []byte{127, 248, 0, 0, 0, 0, 0, 0}},
+		{"float64 NaN payload", func() ([]byte, error) { return NumToBytes(math.Float64frombits(0x7ff0000000000001)) }, []byte{127, 248, 0, 0, 0, 0, 0, 0}},
+		{"string", func() ([]byte, error) { return NumToBytes("abc") }, []byte{97, 98, 99}},
+		{"[]byte", func() ([]byte, error) { return NumToBytes([]byte{1, 2}) }, []byte{1, 2}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := tc.got()
+			if err != nil {
+				t.Fatalf("Failed converting number to bytes: %v", err)
+			}
+			if !bytes.Equal(result, tc.expected) {
+				t.Errorf("Test %s failed. Expected %v, got %v", tc.name, tc.expected, result)
+			}
+		})
+	}
+}
+
+// TestHashKey_CrossArchVectors pins hash values for int keys, whose encoding used to differ between 32 and 64-bit
+// platforms.
+func TestHashKey_CrossArchVectors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		hashFunc func(int, uint32) (uint64, error)
+		expected uint64
+	}{
+		{"Murmur3", HashKeyMurmur3[int], 0x3184fbc4363a0661},
+		{"XXhash", HashKeyXXhash[int], 0x5dbf56cc2275f751},
+		{"WyHash", HashKeyWyHash[int], 0x2b040292d51a3a6c},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := tc.hashFunc(-300, 7)
+			if err != nil {
+				t.Fatalf("hashing failed: %v", err)
+			}
+			if result != tc.expected {
+				t.Errorf("Test %s failed. Expected %#x, got %#x", tc.name, tc.expected, result)
+			}
+		})
+	}
+}
+
+type (
+	derivedInt     int
+	derivedInt8    int8
+	derivedInt16   int16
+	derivedInt32   int32
+	derivedInt64   int64
+	derivedUint    uint
+	derivedUint8   uint8
+	derivedUint16  uint16
+	derivedUint32  uint32
+	derivedUint64  uint64
+	derivedFloat32 float32
+	derivedFloat64 float64
+	derivedString  string
+	derivedBytes   []byte
+)
+
+// TestNumToBytes_DerivedTypes checks that a key of a derived type is encoded exactly like a key of its underlying type
+func TestNumToBytes_DerivedTypes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		derived func() ([]byte, error)
+		base    func() ([]byte, error)
+	}{
+		{"int", func() ([]byte, error) { return NumToBytes(derivedInt(-300)) }, func() ([]byte, error) { return NumToBytes(int(-300)) }},
+		{"int8", func() ([]byte, error) { return NumToBytes(derivedInt8(-3)) }, func() ([]byte, error) { return NumToBytes(int8(-3)) }},
+		{"int16", func() ([]byte, error) { return NumToBytes(derivedInt16(-300)) }, func() ([]byte, error) { return NumToBytes(int16(-300)) }},
+		{"int32", func() ([]byte, error) { return NumToBytes(derivedInt32(-300)) }, func() ([]byte, error) { return NumToBytes(int32(-300)) }},
+		{"int64", func() ([]byte, error) { return NumToBytes(derivedInt64(-300)) }, func() ([]byte, error) { return NumToBytes(int64(-300)) }},
+		{"uint", func() ([]byte, error) { return NumToBytes(derivedUint(300)) }, func() ([]byte, error) { return NumToBytes(uint(300)) }},
+		{"uint8", func() ([]byte, error) { return NumToBytes(derivedUint8(3)) }, func() ([]byte, error) { return NumToBytes(uint8(3)) }},
+		{"uint16", func() ([]byte, error) { return NumToBytes(derivedUint16(8080)) }, func() ([]byte, error) { return NumToBytes(uint16(8080)) }},
+		{"uint32", func() ([]byte, error) { return NumToBytes(derivedUint32(300)) }, func() ([]byte, error) { return NumToBytes(uint32(300)) }},
+		{"uint64", func() ([]byte, error) { return NumToBytes(derivedUint64(300)) }, func() ([]byte, error) { return NumToBytes(uint64(300)) }},
+		{"float32", func() ([]byte, error) { return NumToBytes(derivedFloat32(3.14)) }, func() ([]byte, error) { return NumToBytes(float32(3.14)) }},
+		{"float64", func() ([]byte, error) { return NumToBytes(derivedFloat64(3.14)) }, func() ([]byte, error) { return NumToBytes(float64(3.14)) }},
+		{"string", func() ([]byte, error) { return NumToBytes(derivedString("user-42")) }, func() ([]byte, error) { return NumToBytes("user-42") }},
+		{"[]byte", func() ([]byte, error) { return NumToBytes(derivedBytes{1, 2, 3}) }, func() ([]byte, error) { return NumToBytes([]byte{1, 2, 3}) }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.derived()
+			if err != nil {
+				t.Fatalf("NumToBytes() on derived %s error = %v", tc.name, err)
+			}
+			want, _ := tc.base()
+			if !bytes.Equal(got, want) {
+				t.Errorf("NumToBytes() on derived %s = %v, want %v", tc.name, got, want)
+			}
+		})
+	}
+}
+
+func TestHashKey_DerivedTypes(t *testing.T) {
+	got, err := HashKeyMurmur3(derivedString("user-42"), 1)
+	if err != nil {
+		t.Fatalf("HashKeyMurmur3() on a derived string error = %v", err)
+	}
+	want, _ := HashKeyMurmur3("user-42", 1)
+	if got != want {
+		t.Errorf("HashKeyMurmur3() on a derived string = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// wyp holds the default secret used by wyhash (final version 4)
+var wyp = [4]uint64{0x2d358dccaa6c78a5, 0x8bb84b93962eacc9, 0x4b33a62ed433d4a3, 0x4d5a2da51de1aa47}
+
+// wymum multiplies a and b, returning the low and high 64 bits of the 128-bit product
+func wymum(a, b uint64) (uint64, uint64) {
+	hi, lo := bits.Mul64(a, b)
+	return lo, hi
+}
+
+// wymix folds the 128-bit product of a and b into 64 bits
+func wymix(a, b uint64) uint64 {
+	lo, hi := wymum(a, b)
+	return lo ^ hi
+}
+
+func wyr8(p []byte) uint64 {
+	return binary.LittleEndian.Uint64(p)
+}
+
+func wyr4(p []byte) uint64 {
+	return uint64(binary.LittleEndian.Uint32(p))
+}
+
+func wyr3(p []byte, k int) uint64 {
+	return uint64(p[0])<<16 | uint64(p[k>>1])<<8 | uint64(p[k-1])
+}
+
+// wyhash is a pure Go port of wyhash (final version 4) using the default secret.
+func wyhash(p []byte, seed uint64) uint64 {
+	length := len(p)
+	seed ^= wymix(seed^wyp[0], wyp[1])
+
+	var a, b uint64
+	if length <= 16 {
+		if length >= 4 {
+			a = wyr4(p)<<32 | wyr4(p[(length>>3)<<2:])
+			b = wyr4(p[length-4:])<<32 | wyr4(p[length-4-((length>>3)<<2):])
+		} else if length > 0 {
+			a = wyr3(p, length)
+		}
+	} else {
+		// off tracks the read position; the final two words may overlap bytes already consumed by the loops
+		off, i := 0, length
+		if i >= 48 {
+			see1, see2 := seed, seed
+			for i >= 48 {
+				seed = wymix(wyr8(p[off:])^wyp[1], wyr8(p[off+8:])^seed)
+				see1 = wymix(wyr8(p[off+16:])^wyp[2], wyr8(p[off+24:])^see1)
+				see2 = wymix(wyr8(p[off+32:])^wyp[3], wyr8(p[off+40:])^see2)
+				off += 48
+				i -= 48
+			}
+			seed ^= see1 ^ see2
+		}
+		for i > 16 {
+			seed = wymix(wyr8(p[off:])^wyp[1], wyr8(p[off+8:])^seed)
+			off += 16
+			i -= 16
+		}
+		a = wyr8(p[off+i-16:])
+		b = wyr8(p[off+i-8:])
+	}
+
+	a ^= wyp[1]
+	b ^= seed
+	a, b = wymum(a, b)
+	return wymix(a^wyp[0]^uint64(length), b^wyp[1])
+}
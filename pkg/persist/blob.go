@@ -0,0 +1,259 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrPreconditionFailed is returned by a BlobStore when a conditional write finds the blob has changed, and by
+// BlobPersistence when another writer has saved the data structure since it was last loaded or saved
+var ErrPreconditionFailed = errors.New("blob has been modified by another writer")
+
+// PutOptions makes a BlobStore write conditional
+type PutOptions struct {
+	// IfMatch, when set, makes the write fail with ErrPreconditionFailed unless the blob exists and has this ETag
+	IfMatch string
+	// IfNoneMatch makes the write fail with ErrPreconditionFailed if the blob already exists
+	IfNoneMatch bool
+}
+
+// BlobInfo describes a blob in a BlobStore
+type BlobInfo struct {
+	Name     string
+	Size     int64
+	ETag     string
+	Modified time.Time
+}
+
+// BlobStore is a minimal object store, such as S3 or a directory.  Each version of a blob has an ETag which changes
+// whenever the blob is written, allowing writes to be made conditional on the blob being unchanged.
+type BlobStore interface {
+	// Put replaces the blob called name with what is read from r, returning its new ETag.  size is the number of bytes
+	// which will be read from r, or -1 if it isn't known.
+	Put(ctx context.Context, name string, r io.Reader, size int64, opts PutOptions) (etag string, err error)
+	// Get opens the blob called name, returning its ETag.  If there is no such blob the error wraps os.ErrNotExist.
+	Get(ctx context.Context, name string) (rc io.ReadCloser, etag string, err error)
+	// List returns the blobs whose names start with prefix, sorted by name
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+}
+
+// BlobPersistence saves a data structure as a blob in a BlobStore
+type BlobPersistence struct {
+	store       BlobStore
+	name        string
+	conditional bool
+	etag        string // of the blob last loaded or saved
+}
+
+// NewBlobPersistence creates a BlobPersistence saving data structures as the blob called name in store
+func NewBlobPersistence(store BlobStore, name string) *BlobPersistence {
+	return &BlobPersistence{store: store, name: name}
+}
+
+// WithConditionalWrites makes Save fail with an error wrapping ErrPreconditionFailed if the blob has been written by
+// someone else since this BlobPersistence last loaded or saved it, or, if it hasn't yet, if the blob already exists
+func (bp *BlobPersistence) WithConditionalWrites() *BlobPersistence {
+	bp.conditional = true
+	return bp
+}
+
+// Save streams p into the blob
+func (bp *BlobPersistence) Save(p Persistable) error {
+	etag, err := PutBlob(bp.store, bp.name, bp.conditional, bp.etag, func(w io.Writer) error {
+		_, err := Write(w, p)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error saving %s: %w", p.TypeID(), err)
+	}
+	bp.etag = etag
+	return nil
+}
+
+// Load streams p from the blob
+func (bp *BlobPersistence) Load(p Persistable) error {
+	rc, etag, err := bp.store.Get(context.Background(), bp.name)
+	if err != nil {
+		return fmt.Errorf("error loading %s: %w", p.TypeID(), err)
+	}
+	defer rc.Close()
+
+	if err := Read(rc, p); err != nil {
+		return fmt.Errorf("error loading %s: %w", p.TypeID(), err)
+	}
+	bp.etag = etag
+	return nil
+}
+
+// PutBlob streams what write writes into the blob called name in store, returning its new ETag.  When conditional is
+// set, the write only succeeds if the blob's ETag is still etag, or, if etag is empty, if the blob doesn't exist.
+func PutBlob(store BlobStore, name string, conditional bool, etag string, write func(io.Writer) error) (string, error) {
+	var opts PutOptions
+	if conditional {
+		if etag == "" {
+			opts.IfNoneMatch = true
+		} else {
+			opts.IfMatch = etag
+		}
+	}
+
+	pr, pw := io.Pipe()
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		_ = pw.CloseWithError(write(pw))
+	}()
+	etag, err := store.Put(context.Background(), name, pr, -1, opts)
+	// unblock write if Put stopped reading early, and don't return while it is still running
+	_ = pr.CloseWithError(errors.New("blob store stopped reading"))
+	<-written
+	return etag, err
+}
+
+// FileBlobStore is a BlobStore keeping each blob as a file within a directory; a "/" in a blob's name places it in a
+// subdirectory.  Writes are crash safe, as with FilePersistence.  An ETag is derived from the file's size and
+// modification time.  Conditional writes are atomic between users of the same FileBlobStore, but not between
+// processes.
+type FileBlobStore struct {
+	directory string
+	fileMode  os.FileMode
+	mu        sync.Mutex // serializes conditional writes
+}
+
+// NewFileBlobStore creates a FileBlobStore keeping blobs within directory
+func NewFileBlobStore(directory string) *FileBlobStore {
+	return &FileBlobStore{directory: directory, fileMode: DefaultFileMode}
+}
+
+// WithFileMode sets the permissions given to blobs
+func (s *FileBlobStore) WithFileMode(mode os.FileMode) *FileBlobStore {
+	s.fileMode = mode
+	return s
+}
+
+// Put durably writes the blob to a temporary file, then renames it over the blob
+func (s *FileBlobStore) Put(ctx context.Context, name string, r io.Reader, _ int64, opts PutOptions) (string, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	write := func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	// the condition is checked, and the blob replaced, under the lock
+	locked := false
+	defer func() {
+		if locked {
+			s.mu.Unlock()
+		}
+	}()
+	commit := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		locked = true
+		if opts.IfMatch == "" && !opts.IfNoneMatch {
+			return nil
+		}
+		current := ""
+		if info, err := os.Stat(path); err == nil {
+			current = fileETag(info)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if (opts.IfNoneMatch && current != "") || (opts.IfMatch != "" && opts.IfMatch != current) {
+			return ErrPreconditionFailed
+		}
+		return nil
+	}
+
+	info, err := writeFile(osFileSystem{}, path, s.fileMode, write, commit)
+	if err != nil {
+		return "", err
+	}
+	return fileETag(info), nil
+}
+
+// Get opens the blob's file
+func (s *FileBlobStore) Get(_ context.Context, name string) (io.ReadCloser, string, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, "", err
+	}
+	return f, fileETag(info), nil
+}
+
+// List walks the directory for blobs whose names start with prefix, ignoring temporary files
+func (s *FileBlobStore) List(_ context.Context, prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	err := filepath.WalkDir(s.directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && path == s.directory {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.directory, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, BlobInfo{Name: name, Size: info.Size(), ETag: fileETag(info), Modified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Name < blobs[j].Name })
+	return blobs, nil
+}
+
+// path returns the file holding the blob called name, rejecting names which would escape the directory or clash with
+// temporary files
+func (s *FileBlobStore) path(name string) (string, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") || strings.ContainsRune(part, filepath.Separator) {
+			return "", fmt.Errorf("invalid blob name %q", name)
+		}
+	}
+	return filepath.Join(s.directory, filepath.FromSlash(name)), nil
+}
+
+// fileETag derives an ETag from a file's size and modification time, as web servers commonly do
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size())
+}
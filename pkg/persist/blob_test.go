@@ -0,0 +1,30 @@
+package persist_test
+
+import (
+	"context"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"github.com/dryack/GoCeannaithe/pkg/persist/internal/blobtest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	store := persist.NewFileBlobStore(dir)
+	blobtest.TestBlobStore(t, store)
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "sketches"))
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp") {
+			t.Errorf("temporary file %s was left behind", entry.Name())
+		}
+	}
+	if _, _, err := store.Get(context.Background(), "../escape"); err == nil {
+		t.Errorf("Get() of a name outside the directory succeeded, want an error")
+	}
+	if blobs, err := persist.NewFileBlobStore(filepath.Join(dir, "missing")).List(context.Background(), ""); err != nil || len(blobs) != 0 {
+		t.Errorf("List() of a missing directory = %v, %v, want no blobs", blobs, err)
+	}
+}
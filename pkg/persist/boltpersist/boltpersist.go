@@ -0,0 +1,81 @@
+// Package boltpersist saves GoCeannaithe's data structures as values in an embedded bbolt database, so that many of
+// them can be kept in a single file.  It is a separate package so that only programs using it depend on bbolt.
+package boltpersist
+
+import (
+	"fmt"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"go.etcd.io/bbolt"
+	"os"
+)
+
+// Persistence saves a data structure as a value in a bucket of a bbolt database, keyed by the data structure's name.
+// Each save replaces the value atomically, in a single transaction.
+type Persistence struct {
+	db     *bbolt.DB
+	bucket []byte
+	name   []byte
+}
+
+// New creates a Persistence for the data structure called name, within bucket of db.  The bucket is created when the
+// first data structure is saved.
+func New(db *bbolt.DB, bucket, name string) *Persistence {
+	return &Persistence{db: db, bucket: []byte(bucket), name: []byte(name)}
+}
+
+// Save serializes p with persist.Marshal, and stores it under its name
+func (bp *Persistence) Save(p persist.Persistable) error {
+	data, err := persist.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("error saving %s: %w", p.TypeID(), err)
+	}
+	err = bp.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bp.bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(bp.name, data)
+	})
+	if err != nil {
+		return fmt.Errorf("error saving %s: %w", p.TypeID(), err)
+	}
+	return nil
+}
+
+// Load restores p from the value stored under its name.  If there is no such value the error wraps os.ErrNotExist.
+func (bp *Persistence) Load(p persist.Persistable) error {
+	err := bp.db.View(func(tx *bbolt.Tx) error {
+		var data []byte
+		if b := tx.Bucket(bp.bucket); b != nil {
+			data = b.Get(bp.name)
+		}
+		if data == nil {
+			return fmt.Errorf("%q: %w", bp.name, os.ErrNotExist)
+		}
+		// data is only valid during the transaction, but UnmarshalBinary must copy any data it retains
+		return persist.Unmarshal(data, p)
+	})
+	if err != nil {
+		return fmt.Errorf("error loading %s: %w", p.TypeID(), err)
+	}
+	return nil
+}
+
+// List returns the names of the data structures saved in bucket of db, in byte order
+func List(db *bbolt.DB, bucket string) ([]string, error) {
+	var names []string
+	err := db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", bucket, err)
+	}
+	return names, nil
+}
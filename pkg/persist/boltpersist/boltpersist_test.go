@@ -0,0 +1,25 @@
+package boltpersist
+
+import (
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"github.com/dryack/GoCeannaithe/pkg/persist/internal/persisttest"
+	"go.etcd.io/bbolt"
+	"path/filepath"
+	"testing"
+)
+
+func TestPersistence(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "sketches.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if names, err := List(db, "sketches"); err != nil || len(names) != 0 {
+		t.Errorf("List() of a missing bucket = %v, %v, want no data structures", names, err)
+	}
+	persisttest.TestNamedPersistence(t,
+		func(name string) persist.Persistence { return New(db, "sketches", name) },
+		func() ([]string, error) { return List(db, "sketches") },
+	)
+}
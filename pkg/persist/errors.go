@@ -0,0 +1,35 @@
+package persist
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrCorrupt is wrapped by the errors returned when saved data is truncated or malformed
+	ErrCorrupt = errors.New("corrupt data")
+	// ErrIncompatible is wrapped by the errors returned when valid data can't be loaded, such as data saved by a newer
+	// version of the format, or in a data structure's own format rather than through this package
+	ErrIncompatible = errors.New("incompatible data")
+	// ErrTypeMismatch is matched by every TypeMismatchError
+	ErrTypeMismatch = errors.New("type mismatch")
+	// ErrInvalidTypeID is wrapped by the errors returned when saving a data structure whose type ID is empty, or longer
+	// than 255 bytes
+	ErrInvalidTypeID = errors.New("invalid type ID")
+)
+
+// TypeMismatchError is returned when data, or a value given for a data structure, isn't of the type required, for
+// example when loading data saved from a cuckoo filter into a Bloom filter.  It matches ErrTypeMismatch.
+type TypeMismatchError struct {
+	Expected string // the type required, such as "bloom"
+	Actual   string // the type found
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("type mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// Is reports whether target is ErrTypeMismatch
+func (e *TypeMismatchError) Is(target error) bool {
+	return target == ErrTypeMismatch
+}
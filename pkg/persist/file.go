@@ -0,0 +1,241 @@
+package persist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// DefaultFileMode is the permission given to files written by FilePersistence and FileBlobStore unless WithFileMode is
+// used
+const DefaultFileMode os.FileMode = 0o644
+
+// FilePersistence saves a data structure to a single file.  Saves are crash safe: the data is written to a temporary
+// file in the same directory, which is synced to disk before being renamed over the previous file, and the directory
+// is then synced so the rename itself is durable.  A failed save leaves the previous file intact.
+type FilePersistence struct {
+	directory string
+	filename  string
+	fileMode  os.FileMode
+
+	snapshots bool
+	keep      int
+	maxAge    time.Duration
+	now       func() time.Time
+}
+
+// NewFilePersistence creates a FilePersistence for the file filename within directory; an empty directory means the
+// current directory
+func NewFilePersistence(directory, filename string) *FilePersistence {
+	if directory == "" {
+		directory = "."
+	}
+	return &FilePersistence{directory: directory, filename: filename, fileMode: DefaultFileMode, now: time.Now}
+}
+
+// WithFileMode sets the permissions given to the saved file
+func (fp *FilePersistence) WithFileMode(mode os.FileMode) *FilePersistence {
+	fp.fileMode = mode
+	return fp
+}
+
+// Save streams p to a temporary file, then atomically replaces the file with it.  When snapshots are enabled with
+// WithSnapshots, p is saved as a new snapshot, which is hard linked (or, where links aren't supported, copied) over the
+// file, and old snapshots are pruned; an error from pruning is returned even though p itself was saved.
+func (fp *FilePersistence) Save(p Persistable) error {
+	if !fp.snapshots {
+		return fp.writeFile(p, fp.filename)
+	}
+
+	// p is serialized once, as the snapshot, which then becomes the file too
+	now := fp.now()
+	snapshot := fp.snapshotName(now)
+	if err := fp.writeFile(p, snapshot); err != nil {
+		return err
+	}
+	if err := fp.replaceWith(snapshot); err != nil {
+		return fmt.Errorf("error saving %s: %w", p.TypeID(), err)
+	}
+	return fp.prune(now)
+}
+
+// writeFile durably writes p to name within the directory
+func (fp *FilePersistence) writeFile(p Persistable, name string) error {
+	write := func(w io.Writer) error {
+		_, err := Write(w, p)
+		return err
+	}
+	if _, err := writeFile(osFileSystem{}, filepath.Join(fp.directory, name), fp.fileMode, write, nil); err != nil {
+		return fmt.Errorf("error saving %s: %w", p.TypeID(), err)
+	}
+	return nil
+}
+
+// replaceWith atomically replaces the file with the file name within the directory, by hard linking it to a temporary
+// name which is renamed over the file.  If the file system doesn't support hard links, the file is copied instead.
+func (fp *FilePersistence) replaceWith(name string) error {
+	source := filepath.Join(fp.directory, name)
+	target := filepath.Join(fp.directory, fp.filename)
+	temp := filepath.Join(fp.directory, "."+fp.filename+".link."+name)
+	if err := os.Link(source, temp); err == nil {
+		if err := os.Rename(temp, target); err != nil {
+			_ = os.Remove(temp)
+			return err
+		}
+		return SyncDirectory(fp.directory)
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return WriteFile(target, fp.fileMode, func(w io.Writer) error {
+		_, err := io.Copy(w, file)
+		return err
+	})
+}
+
+// Load streams p from the file
+func (fp *FilePersistence) Load(p Persistable) error {
+	return fp.readFile(p, fp.filename)
+}
+
+// readFile streams p from name within the directory
+func (fp *FilePersistence) readFile(p Persistable, name string) error {
+	file, err := os.Open(filepath.Join(fp.directory, name))
+	if err != nil {
+		return fmt.Errorf("error loading %s: %w", p.TypeID(), err)
+	}
+	defer file.Close()
+
+	if err := Read(bufio.NewReader(file), p); err != nil {
+		return fmt.Errorf("error loading %s: %w", p.TypeID(), err)
+	}
+	return nil
+}
+
+// WriteFile durably writes the file at path with write, by way of a temporary file in the same directory which is
+// synced to disk before being renamed over it; the directory is then synced so the rename itself is durable.  If write
+// or any step before the rename fails, the temporary file is removed and any previous file at path is left intact.
+func WriteFile(path string, mode os.FileMode, write func(io.Writer) error) error {
+	_, err := writeFile(osFileSystem{}, path, mode, write, nil)
+	return err
+}
+
+// writeFile is WriteFile using fs.  If commit isn't nil it is called just before the rename, and an error from it
+// abandons the write.  It returns the file's information as written.
+func writeFile(fs fileSystem, path string, mode os.FileMode, write func(io.Writer) error,
+	commit func() error) (info os.FileInfo, err error) {
+	dir := filepath.Dir(path)
+	tempfile, err := fs.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	closed := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		if !closed {
+			_ = tempfile.Close()
+		}
+		_ = fs.Remove(tempfile.Name())
+	}()
+
+	if err = tempfile.Chmod(mode); err != nil {
+		return nil, err
+	}
+	if err = write(tempfile); err != nil {
+		return nil, err
+	}
+	if err = tempfile.Sync(); err != nil {
+		return nil, err
+	}
+	if info, err = tempfile.Stat(); err != nil {
+		return nil, err
+	}
+	closed = true
+	if err = tempfile.Close(); err != nil {
+		return nil, err
+	}
+	if commit != nil {
+		if err = commit(); err != nil {
+			return nil, err
+		}
+	}
+	if err = fs.Rename(tempfile.Name(), path); err != nil {
+		return nil, err
+	}
+	return info, syncDirectory(fs, dir)
+}
+
+// SyncDirectory makes the creation, removal or renaming of files within dir durable.  Windows doesn't support syncing
+// directories, and makes these durable without it.
+func SyncDirectory(dir string) error {
+	return syncDirectory(osFileSystem{}, dir)
+}
+
+func syncDirectory(fs fileSystem, dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := fs.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// file is the subset of *os.File used by writeFile
+type file interface {
+	io.ReadWriteCloser
+	Name() string
+	Sync() error
+	Chmod(mode os.FileMode) error
+	Stat() (os.FileInfo, error)
+}
+
+// fileSystem is the subset of the os package used by writeFile, allowing tests to simulate failures
+type fileSystem interface {
+	CreateTemp(dir, pattern string) (file, error)
+	Open(name string) (file, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+}
+
+// osFileSystem implements fileSystem using the os package
+type osFileSystem struct{}
+
+func (osFileSystem) CreateTemp(dir, pattern string) (file, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		// avoid returning a non-nil interface holding a nil *os.File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFileSystem) Open(name string) (file, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
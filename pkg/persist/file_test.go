@@ -0,0 +1,114 @@
+package persist
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var errInjected = errors.New("injected failure")
+
+// failingFileSystem wraps the real file system, failing the operation named by failAt
+type failingFileSystem struct {
+	osFileSystem
+	failAt string
+}
+
+type failingFile struct {
+	*os.File
+	failAt string
+}
+
+func (fs failingFileSystem) CreateTemp(dir, pattern string) (file, error) {
+	if fs.failAt == "create" {
+		return nil, errInjected
+	}
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &failingFile{File: f, failAt: fs.failAt}, nil
+}
+
+func (fs failingFileSystem) Open(name string) (file, error) {
+	if fs.failAt == "open" {
+		return nil, errInjected
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &failingFile{File: f, failAt: fs.failAt}, nil
+}
+
+func (fs failingFileSystem) Rename(oldpath, newpath string) error {
+	if fs.failAt == "rename" {
+		return errInjected
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.failAt == "write" {
+		return 0, errInjected
+	}
+	return f.File.Write(p)
+}
+
+func (f *failingFile) Sync() error {
+	if f.failAt == "sync" {
+		return errInjected
+	}
+	return f.File.Sync()
+}
+
+func (f *failingFile) Chmod(mode os.FileMode) error {
+	if f.failAt == "chmod" {
+		return errInjected
+	}
+	return f.File.Chmod(mode)
+}
+
+func (f *failingFile) Close() error {
+	err := f.File.Close()
+	if f.failAt == "close" {
+		return errInjected
+	}
+	return err
+}
+
+func TestWriteFile_Failures(t *testing.T) {
+	for _, failAt := range []string{"create", "chmod", "write", "sync", "close", "rename", "open"} {
+		t.Run(failAt, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "filter.dat")
+			original := []byte("previous filter")
+			if err := os.WriteFile(path, original, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			write := func(w io.Writer) error {
+				_, err := w.Write(make([]byte, 1<<20))
+				return err
+			}
+			_, err := writeFile(failingFileSystem{failAt: failAt}, path, DefaultFileMode, write, nil)
+			if !errors.Is(err, errInjected) {
+				t.Fatalf("writeFile() error = %v, want the injected failure", err)
+			}
+
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 1 {
+				t.Errorf("writeFile() left %d files behind, want only filter.dat", len(entries))
+			}
+			if failAt == "open" {
+				// the directory sync failed after the rename, so the new file is in place
+				return
+			}
+			if data, _ := os.ReadFile(path); string(data) != string(original) {
+				t.Errorf("failed writeFile() modified the previous file")
+			}
+		})
+	}
+}
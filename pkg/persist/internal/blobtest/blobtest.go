@@ -0,0 +1,74 @@
+// Package blobtest holds tests shared by the BlobStore implementations in persist and its subpackages
+package blobtest
+
+import (
+	"context"
+	"errors"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"github.com/dryack/GoCeannaithe/pkg/persist/internal/persisttest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestBlobStore saves and loads data structures through store, checking conditional writes and listing
+func TestBlobStore(t *testing.T, store persist.BlobStore) {
+	t.Helper()
+	writer := persist.NewBlobPersistence(store, "sketches/tenant-a").WithConditionalWrites()
+	saved := &persisttest.Structure{ID: "test", Data: []byte("spam")}
+	if err := writer.Save(saved); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	saved.Data = []byte("spam and eggs")
+	if err := writer.Save(saved); err != nil {
+		t.Fatalf("Save() of the writer's own data error = %v", err)
+	}
+
+	// a second writer which hasn't loaded the blob can't overwrite it
+	other := persist.NewBlobPersistence(store, "sketches/tenant-a").WithConditionalWrites()
+	if err := other.Save(&persisttest.Structure{ID: "test"}); !errors.Is(err, persist.ErrPreconditionFailed) {
+		t.Errorf("Save() over an existing blob error = %v, want ErrPreconditionFailed", err)
+	}
+
+	// once loaded it can, after which the first writer's copy is stale
+	loaded := &persisttest.Structure{ID: "test"}
+	if err := other.Load(loaded); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if string(loaded.Data) != "spam and eggs" {
+		t.Errorf("Load() = %q, want %q", loaded.Data, "spam and eggs")
+	}
+	loaded.Data = append(loaded.Data, " and ham"...)
+	if err := other.Save(loaded); err != nil {
+		t.Fatalf("Save() after loading error = %v", err)
+	}
+	if err := writer.Save(saved); !errors.Is(err, persist.ErrPreconditionFailed) {
+		t.Errorf("Save() of stale data error = %v, want ErrPreconditionFailed", err)
+	}
+
+	// without conditional writes the last save wins
+	if err := persist.NewBlobPersistence(store, "sketches/tenant-a").Save(saved); err != nil {
+		t.Errorf("Save() without conditional writes error = %v", err)
+	}
+	_ = persist.NewBlobPersistence(store, "sketches/tenant-b").Save(saved)
+	_ = persist.NewBlobPersistence(store, "other").Save(saved)
+
+	blobs, err := store.List(context.Background(), "sketches/")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	var names []string
+	for _, blob := range blobs {
+		names = append(names, blob.Name)
+		if blob.Size == 0 || blob.ETag == "" {
+			t.Errorf("List() = %+v, want a size and ETag", blob)
+		}
+	}
+	if want := []string{"sketches/tenant-a", "sketches/tenant-b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("List() = %v, want %v", names, want)
+	}
+
+	if err := persist.NewBlobPersistence(store, "missing").Load(loaded); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Load() of a missing blob error = %v, want os.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,71 @@
+// Package persisttest holds tests shared by the persistence backends in persist's subpackages
+package persisttest
+
+import (
+	"errors"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Structure is a persist.Persistable holding arbitrary data
+type Structure struct {
+	ID   string
+	Data []byte
+}
+
+func (s *Structure) MarshalBinary() ([]byte, error) {
+	return s.Data, nil
+}
+
+func (s *Structure) UnmarshalBinary(data []byte) error {
+	s.Data = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *Structure) TypeID() string {
+	return s.ID
+}
+
+// TestNamedPersistence saves a data structure per tenant with newPersistence, and checks that each loads back with its
+// own data, and that list, unless it is nil, returns the tenants' names
+func TestNamedPersistence(t *testing.T, newPersistence func(name string) persist.Persistence,
+	list func() ([]string, error)) {
+	t.Helper()
+	for _, tenant := range []string{"tenant-b", "tenant-a"} {
+		p := newPersistence(tenant)
+		if err := p.Save(&Structure{ID: "test", Data: []byte(tenant + "-first")}); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+		// saving again replaces the data structure
+		if err := p.Save(&Structure{ID: "test", Data: []byte(tenant + "-second")}); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+
+	loaded := &Structure{ID: "test"}
+	if err := newPersistence("tenant-a").Load(loaded); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if string(loaded.Data) != "tenant-a-second" {
+		t.Errorf("Load() = %q, want %q", loaded.Data, "tenant-a-second")
+	}
+	if err := newPersistence("tenant-a").Load(&Structure{ID: "other"}); !errors.Is(err, persist.ErrTypeMismatch) {
+		t.Errorf("Load() into another type of data structure error = %v, want ErrTypeMismatch", err)
+	}
+
+	if list != nil {
+		names, err := list()
+		if err != nil {
+			t.Fatalf("listing data structures error = %v", err)
+		}
+		if want := []string{"tenant-a", "tenant-b"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("listing data structures = %v, want %v", names, want)
+		}
+	}
+
+	if err := newPersistence("missing").Load(&Structure{ID: "test"}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Load() of a missing data structure error = %v, want os.ErrNotExist", err)
+	}
+}
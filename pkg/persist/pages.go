@@ -0,0 +1,37 @@
+package persist
+
+import "io"
+
+// PageSize is the size in bytes of the pages into which a Paged data structure's raw data is divided
+const PageSize = 4 << 10
+
+// Paged is implemented by data structures which can also be saved raw: as a header describing the data structure,
+// followed by its bulk data uncompressed, so that persistence can update in place only the pages of the data which have
+// changed.  The Incremental mode of the redispersist package saves data structures this way.
+type Paged interface {
+	Persistable
+	// RawHeader returns the header, or an error if the data structure can't be saved raw
+	RawHeader() ([]byte, error)
+	// RawSize returns the size of the raw data in bytes
+	RawSize() uint64
+	// ReadRaw fills dst with the raw data starting at offset, which must be a multiple of PageSize
+	ReadRaw(dst []byte, offset uint64)
+	// LoadRaw replaces the data structure with the one described by header, whose raw data is read from r.  The data
+	// structure is left unchanged if an error is returned.
+	LoadRaw(header []byte, r io.Reader) error
+	// TrackPages starts tracking which pages of the raw data change
+	TrackPages() (PageTracker, error)
+}
+
+// PageTracker records which pages of a Paged data structure's raw data have changed
+type PageTracker interface {
+	// Tracks reports whether the tracker is tracking p's current raw data, rather than another data structure's, or
+	// raw data p has since replaced
+	Tracks(p Paged) bool
+	// Changed returns the pages changed since tracking started or Reset was last called, in ascending order
+	Changed() []uint64
+	// Reset forgets the pages changed so far, continuing to track changes
+	Reset()
+	// Stop ends the tracking
+	Stop()
+}
@@ -0,0 +1,132 @@
+// Package persist saves and loads any of GoCeannaithe's data structures, through backends which are shared by all of
+// them.  A data structure takes part by implementing Persistable.
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Data saved through this package is wrapped as follows, so that it is never loaded into the wrong kind of data
+// structure:
+//
+//	magic     4 bytes   "GCPS"
+//	version   uint8     currently 1
+//	type ID   uint8     length, followed by the type ID of the data structure
+//	data      the data structure's own serialization, to the end
+const (
+	// Magic begins all data written by Write, allowing it to be told apart from the data structures' own formats
+	Magic   = "GCPS"
+	version = uint8(1)
+)
+
+// Persistable is implemented by the data structures which can be saved by this package.  If a data structure also
+// implements io.WriterTo or io.ReaderFrom, producing and consuming the same data as MarshalBinary and UnmarshalBinary,
+// they are used to stream it rather than holding it all in memory.
+type Persistable interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+	// TypeID identifies the kind of data structure, such as "bloom"; data is only loaded into a data structure with the
+	// same type ID as the one it was saved from
+	TypeID() string
+}
+
+// Persistence saves and loads any Persistable
+type Persistence interface {
+	Save(Persistable) error
+	Load(Persistable) error
+}
+
+// Marshal serializes p along with its type ID
+func Marshal(p Persistable) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := Write(&buf, p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal restores p from data produced by Marshal, failing if data holds a different type of data structure
+func Unmarshal(data []byte, p Persistable) error {
+	return Read(bytes.NewReader(data), p)
+}
+
+// Write streams p, along with its type ID, to w
+func Write(w io.Writer, p Persistable) (int64, error) {
+	typeID := p.TypeID()
+	if len(typeID) == 0 || len(typeID) > 1<<8-1 {
+		return 0, fmt.Errorf("%w %q", ErrInvalidTypeID, typeID)
+	}
+	header := append([]byte(Magic), version, uint8(len(typeID)))
+	header = append(header, typeID...)
+	n, err := w.Write(header)
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+
+	if wt, ok := p.(io.WriterTo); ok {
+		n, err := wt.WriteTo(w)
+		return written + n, err
+	}
+	data, err := p.MarshalBinary()
+	if err != nil {
+		return written, err
+	}
+	n, err = w.Write(data)
+	return written + int64(n), err
+}
+
+// Read restores p from r, which must hold data written by Write for a data structure of the same type
+func Read(r io.Reader, p Persistable) error {
+	br := bufio.NewReader(r)
+	typeID, err := ReadTypeID(br)
+	if err != nil {
+		return err
+	}
+	if typeID != p.TypeID() {
+		return &TypeMismatchError{Expected: p.TypeID(), Actual: typeID}
+	}
+
+	if rf, ok := p.(io.ReaderFrom); ok {
+		_, err := rf.ReadFrom(br)
+		return err
+	}
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return err
+	}
+	return p.UnmarshalBinary(data)
+}
+
+// ReadTypeID reads the header written by Write, returning the type ID of the data structure which follows it
+func ReadTypeID(r io.Reader) (string, error) {
+	var fixed [6]byte
+	n, err := io.ReadFull(r, fixed[:])
+	if string(fixed[:min(n, 4)]) != Magic[:min(n, 4)] {
+		return "", fmt.Errorf("%w: data wasn't saved by the persist package", ErrIncompatible)
+	}
+	if err != nil {
+		return "", headerError(err)
+	}
+	if fixed[4] != version {
+		return "", fmt.Errorf("%w: unsupported format version %d", ErrIncompatible, fixed[4])
+	}
+	typeID := make([]byte, fixed[5])
+	if _, err := io.ReadFull(r, typeID); err != nil {
+		return "", headerError(err)
+	}
+	return string(typeID), nil
+}
+
+// headerError describes an error reading the header written by Write; running out of data means it is truncated
+func headerError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: reading header: %w", ErrCorrupt, io.ErrUnexpectedEOF)
+	}
+	return fmt.Errorf("reading header: %w", err)
+}
@@ -0,0 +1,87 @@
+package persist
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testStructure is a Persistable holding arbitrary data
+type testStructure struct {
+	typeID string
+	data   []byte
+}
+
+func (ts *testStructure) MarshalBinary() ([]byte, error) {
+	return ts.data, nil
+}
+
+func (ts *testStructure) UnmarshalBinary(data []byte) error {
+	ts.data = append([]byte(nil), data...)
+	return nil
+}
+
+func (ts *testStructure) TypeID() string {
+	return ts.typeID
+}
+
+func TestMarshal(t *testing.T) {
+	data, err := Marshal(&testStructure{typeID: "test", data: []byte("spam")})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if typeID, err := ReadTypeID(bytes.NewReader(data)); err != nil || typeID != "test" {
+		t.Errorf("ReadTypeID() = %q, %v, want %q", typeID, err, "test")
+	}
+
+	restored := &testStructure{typeID: "test"}
+	if err := Unmarshal(data, restored); err != nil || string(restored.data) != "spam" {
+		t.Errorf("Unmarshal() = %q, %v, want %q", restored.data, err, "spam")
+	}
+	var mismatch *TypeMismatchError
+	err = Unmarshal(data, &testStructure{typeID: "other"})
+	if !errors.Is(err, ErrTypeMismatch) || !errors.As(err, &mismatch) || mismatch.Expected != "other" ||
+		mismatch.Actual != "test" {
+		t.Errorf("Unmarshal() into another type error = %v, want a TypeMismatchError", err)
+	}
+	if err := Unmarshal([]byte("spam"), restored); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("Unmarshal() of unwrapped data error = %v, want ErrIncompatible", err)
+	}
+	future := append([]byte(nil), data...)
+	future[4]++
+	if err := Unmarshal(future, restored); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("Unmarshal() of a newer format error = %v, want ErrIncompatible", err)
+	}
+	for _, n := range []int{3, 7} {
+		if err := Unmarshal(data[:n], restored); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Unmarshal() of a header truncated to %d bytes error = %v, want ErrCorrupt", n, err)
+		}
+	}
+	if _, err := Marshal(&testStructure{}); !errors.Is(err, ErrInvalidTypeID) {
+		t.Errorf("Marshal() without a type ID error = %v, want ErrInvalidTypeID", err)
+	}
+}
+
+func TestFilePersistence(t *testing.T) {
+	dir := t.TempDir()
+	fp := NewFilePersistence(dir, "sketch.bin").WithFileMode(0o600)
+	if err := fp.Save(&testStructure{typeID: "test", data: []byte("spam")}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "sketch.bin")); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("saved file = %v, %v, want mode 0600", info, err)
+	}
+
+	restored := &testStructure{typeID: "test"}
+	if err := fp.Load(restored); err != nil || string(restored.data) != "spam" {
+		t.Errorf("Load() = %q, %v, want %q", restored.data, err, "spam")
+	}
+	if err := fp.Load(&testStructure{typeID: "other"}); err == nil {
+		t.Errorf("Load() into another type succeeded, want an error")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the saved file", len(entries))
+	}
+}
@@ -0,0 +1,566 @@
+// Package redispersist saves GoCeannaithe's data structures in Redis, through any go-redis client.  It is a separate
+// package so that only programs using it depend on go-redis.
+package redispersist
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"github.com/redis/go-redis/v9"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Mode selects how Persistence stores a data structure
+type Mode uint8
+
+const (
+	// Whole stores the serialized data structure as a single string value, which Redis limits to 512 MB
+	Whole Mode = iota
+	// Chunked splits the serialized data structure across several string values, so it may be of any size
+	Chunked
+	// Incremental stores a persist.Paged data structure's raw data across several string values, and after the first
+	// save updates only the pages which have changed, using SETRANGE.  Bloom filters with BitPackingStorage, saved with
+	// bloom.GenericPersistence, can be stored this way.
+	Incremental
+)
+
+const (
+	// DefaultChunkSize is the size of each value holding part of a data structure in the chunked and incremental modes
+	DefaultChunkSize = 64 << 20
+	// maxRedisValueSize is the largest string value Redis accepts
+	maxRedisValueSize = 512 << 20
+
+	// maxAttempts bounds the attempts to replace a data structure while other writers keep replacing it
+	maxAttempts = 10
+	// sumsPart names the part holding the incremental mode's page checksums
+	sumsPart = "sums"
+
+	redisFormatStream = "stream"
+	redisFormatRaw    = "raw"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Options controls how Persistence stores a data structure
+type Options struct {
+	Mode Mode
+	// ChunkSize is the size in bytes of each value in the chunked and incremental modes; zero means DefaultChunkSize.
+	// In the incremental mode it must be a multiple of persist.PageSize.
+	ChunkSize int
+}
+
+// Persistence saves a data structure in Redis under a key.  In Whole mode the key holds the output of persist.Marshal.
+// In the other modes the key holds a hash describing the data structure, whose parts are held by the keys
+// <key>:<generation>:<n>; a save writes a new generation and switches the hash to it atomically, then deletes the
+// previous generation.  With Redis Cluster, the key should contain a hash tag, such as "{filters}:tenant", so that all
+// of its parts are kept in the same slot.
+//
+// In Incremental mode, changes are tracked for the data structure last saved or loaded, and are applied in a single
+// transaction which fails if another writer has replaced the data structure in the meantime.  Each page has a CRC-32C
+// checksum, kept in the part <key>:<generation>:sums, which is verified when loading.  Loading detects how the data
+// structure was stored, so it doesn't depend on the mode.
+type Persistence struct {
+	client    redis.UniversalClient
+	key       string
+	mode      Mode
+	chunkSize int
+	ctx       context.Context
+
+	tracker    persist.PageTracker // of the data structure last saved or loaded, in Incremental mode
+	generation string              // of the parts holding the tracked data structure
+	lastPages  int                 // pages written by the last incremental save
+}
+
+// New creates a Persistence keeping the data structure under key
+func New(client redis.UniversalClient, key string, opts Options) (*Persistence, error) {
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.ChunkSize < 0 || opts.ChunkSize > maxRedisValueSize {
+		return nil, fmt.Errorf("invalid Redis chunk size %d", opts.ChunkSize)
+	}
+	if opts.Mode == Incremental && opts.ChunkSize%persist.PageSize != 0 {
+		return nil, fmt.Errorf("chunk size must be a multiple of %d in the incremental mode", persist.PageSize)
+	}
+	if opts.Mode > Incremental {
+		return nil, fmt.Errorf("unknown Redis mode %d", opts.Mode)
+	}
+	return &Persistence{client: client, key: key, mode: opts.Mode, chunkSize: opts.ChunkSize,
+		ctx: context.Background()}, nil
+}
+
+// WithContext sets the context used for the Redis commands of later saves and loads, which by default is
+// context.Background()
+func (rp *Persistence) WithContext(ctx context.Context) *Persistence {
+	rp.ctx = ctx
+	return rp
+}
+
+// Save stores p according to the mode
+func (rp *Persistence) Save(p persist.Persistable) error {
+	var err error
+	switch rp.mode {
+	case Whole:
+		err = rp.saveWhole(p)
+	case Chunked:
+		err = rp.saveChunked(p)
+	case Incremental:
+		paged, ok := p.(persist.Paged)
+		if !ok {
+			err = fmt.Errorf("the incremental mode requires a persist.Paged data structure, not %T", p)
+			break
+		}
+		err = rp.saveIncremental(paged)
+	}
+	if err != nil {
+		return fmt.Errorf("error saving %s: %w", p.TypeID(), err)
+	}
+	return nil
+}
+
+// Load restores p, however it was stored.  If there is nothing under the key the error wraps os.ErrNotExist.
+func (rp *Persistence) Load(p persist.Persistable) error {
+	if err := rp.load(p); err != nil {
+		return fmt.Errorf("error loading %s: %w", p.TypeID(), err)
+	}
+	return nil
+}
+
+func (rp *Persistence) load(p persist.Persistable) error {
+	ctx := rp.ctx
+	keyType, err := rp.client.Type(ctx, rp.key).Result()
+	if err != nil {
+		return err
+	}
+	switch keyType {
+	case "none":
+		return fmt.Errorf("%q: %w", rp.key, os.ErrNotExist)
+	case "string":
+		data, err := rp.client.Get(ctx, rp.key).Bytes()
+		if err != nil {
+			return err
+		}
+		if err := persist.Unmarshal(data, p); err != nil {
+			return err
+		}
+		rp.stopTracking()
+		return nil
+	case "hash":
+	default:
+		return fmt.Errorf("key %q holds a %s, not a data structure", rp.key, keyType)
+	}
+
+	manifest, err := rp.client.HGetAll(ctx, rp.key).Result()
+	if err != nil {
+		return err
+	}
+	generation := manifest["generation"]
+	chunks, err := strconv.Atoi(manifest["chunks"])
+	if err != nil || generation == "" {
+		return fmt.Errorf("%w: key %q holds an invalid description", persist.ErrCorrupt, rp.key)
+	}
+	r := &redisChunkReader{ctx: ctx, client: rp.client, prefix: rp.chunkPrefix(generation), chunks: chunks}
+
+	switch manifest["format"] {
+	case redisFormatStream:
+		if err := persist.Read(r, p); err != nil {
+			return err
+		}
+		rp.stopTracking()
+		return nil
+	case redisFormatRaw:
+		if typeID := manifest["type"]; typeID != p.TypeID() {
+			return &persist.TypeMismatchError{Expected: p.TypeID(), Actual: typeID}
+		}
+		paged, ok := p.(persist.Paged)
+		if !ok {
+			return fmt.Errorf("key %q holds raw data, which only a persist.Paged data structure can load, not %T",
+				rp.key, p)
+		}
+		sums, err := rp.client.Get(ctx, rp.chunkPrefix(generation)+sumsPart).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return fmt.Errorf("%w: key %q has no page checksums", persist.ErrCorrupt, rp.key)
+		}
+		if err != nil {
+			return err
+		}
+		verifier := &pageVerifier{r: r, sums: sums, page: make([]byte, persist.PageSize)}
+		return rp.loadRaw(paged, []byte(manifest["header"]), verifier, generation)
+	default:
+		return fmt.Errorf("%w: key %q holds data in an unknown format %q", persist.ErrIncompatible, rp.key,
+			manifest["format"])
+	}
+}
+
+// loadRaw reads a data structure stored by the incremental mode, and starts tracking its changes
+func (rp *Persistence) loadRaw(p persist.Paged, header []byte, r io.Reader, generation string) error {
+	if err := p.LoadRaw(header, r); err != nil {
+		return err
+	}
+	return rp.track(p, generation)
+}
+
+// track starts tracking the changes to p, which is stored as generation
+func (rp *Persistence) track(p persist.Paged, generation string) error {
+	tracker, err := p.TrackPages()
+	if err != nil {
+		return err
+	}
+	rp.stopTracking()
+	rp.tracker = tracker
+	rp.generation = generation
+	return nil
+}
+
+// stopTracking stops tracking the changes to the data structure last saved or loaded
+func (rp *Persistence) stopTracking() {
+	if rp.tracker != nil {
+		rp.tracker.Stop()
+		rp.tracker = nil
+	}
+}
+
+func (rp *Persistence) saveWhole(p persist.Persistable) error {
+	data, err := persist.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxRedisValueSize {
+		return errors.New("data structure is too large for a single Redis value, use Chunked")
+	}
+
+	ctx := rp.ctx
+	err = rp.replace(ctx, func(pipe redis.Pipeliner) {
+		pipe.Set(ctx, rp.key, data, 0)
+	})
+	if err != nil {
+		return err
+	}
+	rp.stopTracking()
+	return nil
+}
+
+func (rp *Persistence) saveChunked(p persist.Persistable) error {
+	ctx := rp.ctx
+	generation, err := newRedisGeneration()
+	if err != nil {
+		return err
+	}
+	w := &redisChunkWriter{ctx: ctx, client: rp.client, prefix: rp.chunkPrefix(generation), chunkSize: rp.chunkSize}
+	if _, err := persist.Write(w, p); err != nil {
+		_ = rp.deleteParts(ctx, rp.parts(generation, w.chunks))
+		return err
+	}
+	if err := w.Close(); err != nil {
+		_ = rp.deleteParts(ctx, rp.parts(generation, w.chunks))
+		return err
+	}
+	if err := rp.publish(ctx, generation, w.chunks, redisFormatStream, p.TypeID(), nil); err != nil {
+		return err
+	}
+	rp.stopTracking()
+	return nil
+}
+
+func (rp *Persistence) saveIncremental(p persist.Paged) error {
+	header, err := p.RawHeader()
+	if err != nil {
+		return err
+	}
+	if rp.tracker != nil && rp.tracker.Tracks(p) {
+		return rp.saveDirty(p)
+	}
+
+	ctx := rp.ctx
+	generation, err := newRedisGeneration()
+	if err != nil {
+		return err
+	}
+	w := &redisChunkWriter{ctx: ctx, client: rp.client, prefix: rp.chunkPrefix(generation), chunkSize: rp.chunkSize}
+	size := p.RawSize()
+	buf := make([]byte, min(size, uint64(rp.chunkSize)))
+	sums := make([]byte, 0, 4*((size+persist.PageSize-1)/persist.PageSize))
+	for offset := uint64(0); offset < size; offset += uint64(len(buf)) {
+		buf = buf[:min(size-offset, uint64(rp.chunkSize))]
+		p.ReadRaw(buf, offset)
+		// chunks are a whole number of pages, so only the last page of the last chunk can be partial
+		for page := 0; page < len(buf); page += persist.PageSize {
+			sums = binary.BigEndian.AppendUint32(sums, crc32.Checksum(buf[page:min(page+persist.PageSize, len(buf))],
+				castagnoli))
+		}
+		if _, err := w.Write(buf); err != nil {
+			_ = rp.deleteParts(ctx, rp.parts(generation, w.chunks))
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		_ = rp.deleteParts(ctx, rp.parts(generation, w.chunks))
+		return err
+	}
+	if err := rp.client.Set(ctx, rp.chunkPrefix(generation)+sumsPart, sums, 0).Err(); err != nil {
+		_ = rp.deleteParts(ctx, rp.parts(generation, w.chunks))
+		return err
+	}
+
+	if err := rp.publish(ctx, generation, w.chunks, redisFormatRaw, p.TypeID(), header); err != nil {
+		return err
+	}
+	if err := rp.track(p, generation); err != nil {
+		return err
+	}
+	rp.lastPages = int((size + persist.PageSize - 1) / persist.PageSize)
+	return nil
+}
+
+// saveDirty writes the pages changed since the last save with SETRANGE, in a transaction which fails if the data
+// structure has been replaced since
+func (rp *Persistence) saveDirty(p persist.Paged) error {
+	pages := rp.tracker.Changed()
+	rp.lastPages = 0
+	if len(pages) == 0 {
+		return nil
+	}
+
+	ctx := rp.ctx
+	prefix := rp.chunkPrefix(rp.generation)
+	size := p.RawSize()
+	err := rp.client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.HGet(ctx, rp.key, "generation").Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		if current != rp.generation {
+			return errors.New("data structure has been replaced by another writer since it was loaded")
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, page := range pages {
+				offset := page * persist.PageSize
+				buf := make([]byte, min(persist.PageSize, size-offset))
+				p.ReadRaw(buf, offset)
+				chunk := offset / uint64(rp.chunkSize)
+				pipe.SetRange(ctx, prefix+strconv.FormatUint(chunk, 10), int64(offset%uint64(rp.chunkSize)), string(buf))
+				sum := binary.BigEndian.AppendUint32(nil, crc32.Checksum(buf, castagnoli))
+				pipe.SetRange(ctx, prefix+sumsPart, int64(4*page), string(sum))
+			}
+			return nil
+		})
+		return err
+	}, rp.key)
+	if err != nil {
+		return err
+	}
+
+	rp.tracker.Reset()
+	rp.lastPages = len(pages)
+	return nil
+}
+
+// publish switches the key to a new generation of parts, then deletes the parts of the previous generation
+func (rp *Persistence) publish(ctx context.Context, generation string, chunks int, format, typeID string,
+	header []byte) error {
+	fields := []any{"format", format, "type", typeID, "generation", generation, "chunks", chunks}
+	if header != nil {
+		fields = append(fields, "header", header)
+	}
+	err := rp.replace(ctx, func(pipe redis.Pipeliner) {
+		pipe.Del(ctx, rp.key)
+		pipe.HSet(ctx, rp.key, fields...)
+	})
+	if err != nil {
+		_ = rp.deleteParts(ctx, rp.parts(generation, chunks))
+		return err
+	}
+	return nil
+}
+
+// replace replaces the data structure under the key with the commands queued by update, in a transaction, then deletes
+// parts of the data structure it replaced.  Those parts are found within the transaction, which is retried if another
+// writer replaces it first, so that the parts are never left behind.
+func (rp *Persistence) replace(ctx context.Context, update func(pipe redis.Pipeliner)) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		var previous []string
+		err := rp.client.Watch(ctx, func(tx *redis.Tx) error {
+			var err error
+			if previous, err = rp.previousParts(ctx, tx); err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				update(pipe)
+				return nil
+			})
+			return err
+		}, rp.key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return rp.deleteParts(ctx, previous)
+	}
+	return errors.New("data structure is being replaced by other writers")
+}
+
+// previousParts returns the keys of the parts of the data structure currently stored, if it is stored in parts
+func (rp *Persistence) previousParts(ctx context.Context, c redis.Cmdable) ([]string, error) {
+	keyType, err := c.Type(ctx, rp.key).Result()
+	if err != nil || keyType != "hash" {
+		return nil, err
+	}
+	manifest, err := c.HMGet(ctx, rp.key, "generation", "chunks").Result()
+	if err != nil {
+		return nil, err
+	}
+	generation, _ := manifest[0].(string)
+	chunksField, _ := manifest[1].(string)
+	chunks, err := strconv.Atoi(chunksField)
+	if generation == "" || err != nil {
+		return nil, nil
+	}
+	return rp.parts(generation, chunks), nil
+}
+
+// parts returns the keys of the parts of a generation with the given number of chunks, including its page checksums
+func (rp *Persistence) parts(generation string, chunks int) []string {
+	parts := make([]string, chunks, chunks+1)
+	for i := range parts {
+		parts[i] = rp.chunkPrefix(generation) + strconv.Itoa(i)
+	}
+	return append(parts, rp.chunkPrefix(generation)+sumsPart)
+}
+
+// deleteParts deletes the given parts of a data structure
+func (rp *Persistence) deleteParts(ctx context.Context, parts []string) error {
+	for len(parts) > 0 {
+		batch := parts[:min(len(parts), 1000)]
+		parts = parts[len(batch):]
+		if err := rp.client.Del(ctx, batch...).Err(); err != nil {
+			return fmt.Errorf("deleting the previous data structure: %w", err)
+		}
+	}
+	return nil
+}
+
+func (rp *Persistence) chunkPrefix(generation string) string {
+	return rp.key + ":" + generation + ":"
+}
+
+// newRedisGeneration returns a random identifier for a new generation of a data structure's parts
+func newRedisGeneration() (string, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// redisChunkWriter stores what is written to it in values of chunkSize bytes, named prefix followed by their index
+type redisChunkWriter struct {
+	ctx       context.Context
+	client    redis.UniversalClient
+	prefix    string
+	chunkSize int
+	chunks    int
+	buf       []byte
+}
+
+func (w *redisChunkWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := min(len(p), w.chunkSize-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		if len(w.buf) == w.chunkSize {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close stores the final, partial chunk
+func (w *redisChunkWriter) Close() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *redisChunkWriter) flush() error {
+	if err := w.client.Set(w.ctx, w.prefix+strconv.Itoa(w.chunks), w.buf, 0).Err(); err != nil {
+		return err
+	}
+	w.chunks++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// redisChunkReader reads the values written by redisChunkWriter, one at a time
+type redisChunkReader struct {
+	ctx    context.Context
+	client redis.UniversalClient
+	prefix string
+	chunks int
+	next   int
+	buf    []byte
+}
+
+func (r *redisChunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.next == r.chunks {
+			return 0, io.EOF
+		}
+		chunk, err := r.client.Get(r.ctx, r.prefix+strconv.Itoa(r.next)).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return 0, errors.New("data structure was replaced while it was being loaded")
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.buf = chunk
+		r.next++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// pageVerifier passes through the pages of raw data read from r, failing if a page doesn't match its CRC-32C
+// checksum in sums
+type pageVerifier struct {
+	r    io.Reader
+	sums []byte
+	page []byte
+	buf  []byte
+	next int
+}
+
+func (v *pageVerifier) Read(p []byte) (int, error) {
+	if len(v.buf) == 0 {
+		if 4*(v.next+1) > len(v.sums) {
+			return 0, io.EOF
+		}
+		// only the last page can be partial
+		n, err := io.ReadFull(v.r, v.page)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, err
+		}
+		if crc32.Checksum(v.page[:n], castagnoli) != binary.BigEndian.Uint32(v.sums[4*v.next:]) {
+			return 0, fmt.Errorf("%w: page %d fails its checksum", persist.ErrCorrupt, v.next)
+		}
+		v.buf = v.page[:n]
+		v.next++
+	}
+	n := copy(p, v.buf)
+	v.buf = v.buf[n:]
+	return n, nil
+}
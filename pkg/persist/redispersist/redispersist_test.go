@@ -0,0 +1,302 @@
+package redispersist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dryack/GoCeannaithe/pkg/bloom"
+	"github.com/dryack/GoCeannaithe/pkg/common"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"github.com/dryack/GoCeannaithe/pkg/persist/internal/persisttest"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return server, client
+}
+
+// newTestFilter returns a filter of numBits bits saved by rp
+func newTestFilter(t *testing.T, rp *Persistence, numBits uint64) *bloom.BloomFilter[string] {
+	t.Helper()
+	bf, err := bloom.New[string](bloom.WithHashFunctions(5, common.Murmur3),
+		bloom.WithPersistence(bloom.NewGenericPersistence[string](rp)),
+		bloom.WithStorage(bloom.NewBitPackingStorage[string](numBits, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bf
+}
+
+// loadFilter returns a filter loaded by rp
+func loadFilter(rp *Persistence) (*bloom.BloomFilter[string], error) {
+	bf := bloom.NewBloomFilter[string]().WithPersistence(bloom.NewGenericPersistence[string](rp))
+	return bf, bf.LoadPersistence()
+}
+
+func TestPersistence_Modes(t *testing.T) {
+	server, client := newTestRedis(t)
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"whole", Options{Mode: Whole}},
+		{"chunked", Options{Mode: Chunked, ChunkSize: 1000}},
+		{"incremental", Options{Mode: Incremental, ChunkSize: 8192}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp, err := New(client, "{filters}:"+tt.name, tt.opts)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			bf := newTestFilter(t, rp, 1<<17)
+			for i := 0; i < 100; i++ {
+				_ = bf.Add("key-" + strconv.Itoa(i))
+			}
+			// the second save replaces the first, and the parts of the first are deleted
+			for i := 0; i < 2; i++ {
+				if err := bf.SavePersistence(); err != nil {
+					t.Fatalf("SavePersistence() error = %v", err)
+				}
+			}
+
+			other, _ := New(client, "{filters}:"+tt.name, Options{})
+			loaded, err := loadFilter(other)
+			if err != nil {
+				t.Fatalf("LoadPersistence() error = %v", err)
+			}
+			for i := 0; i < 100; i++ {
+				if !loaded.Contains("key-" + strconv.Itoa(i)) {
+					t.Fatalf("Contains(key-%d) = false after loading", i)
+				}
+			}
+		})
+	}
+
+	// only the parts of the last save remain, with the incremental mode's page checksums
+	want := 2
+	for _, name := range []string{"chunked", "incremental"} {
+		chunks, _ := strconv.Atoi(server.HGet("{filters}:"+name, "chunks"))
+		want += 1 + chunks
+	}
+	if keys := len(server.Keys()); keys != want {
+		t.Errorf("Redis holds %d keys, want %d; previous parts weren't deleted", keys, want)
+	}
+}
+
+func TestPersistence_Incremental(t *testing.T) {
+	_, client := newTestRedis(t)
+	rp, _ := New(client, "filter", Options{Mode: Incremental})
+	bf := newTestFilter(t, rp, 1<<24)
+
+	if err := bf.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+	if rp.lastPages != 512 {
+		t.Errorf("first save wrote %d pages, want all 512", rp.lastPages)
+	}
+	for _, key := range []string{"spam", "eggs", "ham"} {
+		_ = bf.Add(key)
+	}
+	if err := bf.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+	if rp.lastPages == 0 || rp.lastPages > 15 {
+		t.Errorf("incremental save wrote %d pages, want between 1 and 15 for 3 keys", rp.lastPages)
+	}
+
+	other, _ := New(client, "filter", Options{Mode: Incremental})
+	loaded, err := loadFilter(other)
+	if err != nil {
+		t.Fatalf("LoadPersistence() error = %v", err)
+	}
+	for _, key := range []string{"spam", "eggs", "ham"} {
+		if !loaded.Contains(key) {
+			t.Errorf("Contains(%q) = false after loading", key)
+		}
+	}
+
+	// changes to a loaded filter are also saved incrementally
+	_ = loaded.Add("spanish inquisition")
+	if err := loaded.SavePersistence(); err != nil || other.lastPages == 0 || other.lastPages > 5 {
+		t.Errorf("save after loading wrote %d pages (error %v), want between 1 and 5", other.lastPages, err)
+	}
+
+	// the first writer's filter has since been replaced by a full save, so its incremental save is refused
+	if _, err := loaded.WithStorage(bloom.NewBitPackingStorage[string](1<<24, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+	_ = bf.Add("parrot")
+	if err := bf.SavePersistence(); err == nil {
+		t.Errorf("SavePersistence() of a replaced filter succeeded, want an error")
+	}
+}
+
+func TestPersistence_IncrementalWithCheckpoints(t *testing.T) {
+	_, client := newTestRedis(t)
+	rp, _ := New(client, "filter", Options{Mode: Incremental})
+	bf := newTestFilter(t, rp, 1<<20)
+	path := filepath.Join(t.TempDir(), "filter.ckpt")
+	cp := bloom.NewCheckpointPersistence[string](path)
+	defer cp.Close()
+	for _, p := range []bloom.Persistence[string]{bloom.NewGenericPersistence[string](rp), cp} {
+		if err := p.Save(bf); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+
+	// each persistence tracks the filter's changes itself, so a save by one doesn't hide them from the other
+	_ = bf.Add("spam")
+	if err := cp.Save(bf); err != nil {
+		t.Fatalf("checkpoint Save() error = %v", err)
+	}
+	if err := bf.SavePersistence(); err != nil || rp.lastPages == 0 {
+		t.Fatalf("incremental save after a checkpoint wrote %d pages (error %v), want some", rp.lastPages, err)
+	}
+	_ = bf.Add("eggs")
+	if err := bf.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+	if err := cp.Save(bf); err != nil {
+		t.Fatalf("checkpoint Save() error = %v", err)
+	}
+
+	other, _ := New(client, "filter", Options{})
+	fromRedis, err := loadFilter(other)
+	if err != nil {
+		t.Fatalf("LoadPersistence() from Redis error = %v", err)
+	}
+	fromCheckpoint := bloom.NewBloomFilter[string]().WithPersistence(bloom.NewCheckpointPersistence[string](path))
+	if err := fromCheckpoint.LoadPersistence(); err != nil {
+		t.Fatalf("LoadPersistence() from the checkpoint error = %v", err)
+	}
+	for _, key := range []string{"spam", "eggs"} {
+		if !fromRedis.Contains(key) || !fromCheckpoint.Contains(key) {
+			t.Errorf("Contains(%q) = %v from Redis and %v from the checkpoint, want both true", key,
+				fromRedis.Contains(key), fromCheckpoint.Contains(key))
+		}
+	}
+}
+
+func TestPersistence_Corrupt(t *testing.T) {
+	server, client := newTestRedis(t)
+	rp, _ := New(client, "filter", Options{Mode: Incremental})
+	bf := newTestFilter(t, rp, 1<<20)
+	_ = bf.Add("spam")
+	if err := bf.SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+
+	// a page overwritten without its checksum, as by a partial SETRANGE
+	chunk := "filter:" + server.HGet("filter", "generation") + ":0"
+	if err := client.SetRange(context.Background(), chunk, 5000, "garbage").Err(); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := New(client, "filter", Options{})
+	if _, err := loadFilter(other); !errors.Is(err, persist.ErrCorrupt) {
+		t.Errorf("LoadPersistence() of a corrupted page error = %v, want ErrCorrupt", err)
+	}
+
+	server.Del("filter:" + server.HGet("filter", "generation") + ":sums")
+	if _, err := loadFilter(other); !errors.Is(err, persist.ErrCorrupt) {
+		t.Errorf("LoadPersistence() without checksums error = %v, want ErrCorrupt", err)
+	}
+}
+
+func TestPersistence_Concurrent(t *testing.T) {
+	server, client := newTestRedis(t)
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rp, _ := New(client, "filter", Options{Mode: Chunked, ChunkSize: 1000})
+			bf := newTestFilter(t, rp, 1<<16)
+			_ = bf.Add(fmt.Sprint("writer-", i))
+			errs[i] = bf.SavePersistence()
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("writer %d SavePersistence() error = %v", i, err)
+		}
+	}
+
+	// only the parts of the filter that was saved last remain
+	chunks, _ := strconv.Atoi(server.HGet("filter", "chunks"))
+	if keys := len(server.Keys()); keys != 1+chunks {
+		t.Errorf("Redis holds %d keys, want %d; replaced parts weren't deleted", keys, 1+chunks)
+	}
+}
+
+func TestPersistence_Context(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rp, _ := New(client, "filter", Options{})
+	bf := newTestFilter(t, rp.WithContext(ctx), 1<<10)
+	if err := bf.SavePersistence(); !errors.Is(err, context.Canceled) {
+		t.Errorf("SavePersistence() with a cancelled context error = %v, want context.Canceled", err)
+	}
+	if err := bf.LoadPersistence(); !errors.Is(err, context.Canceled) {
+		t.Errorf("LoadPersistence() with a cancelled context error = %v, want context.Canceled", err)
+	}
+}
+
+func TestPersistence_Missing(t *testing.T) {
+	_, client := newTestRedis(t)
+	rp, _ := New(client, "missing", Options{})
+	if _, err := loadFilter(rp); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadPersistence() of a missing filter error = %v, want os.ErrNotExist", err)
+	}
+
+	_ = client.LPush(context.Background(), "list", "x")
+	rp, _ = New(client, "list", Options{})
+	if _, err := loadFilter(rp); err == nil {
+		t.Errorf("LoadPersistence() of a list succeeded, want an error")
+	}
+
+	if _, err := New(client, "filter", Options{Mode: Incremental, ChunkSize: 1000}); err == nil {
+		t.Errorf("New() with an unaligned chunk size succeeded, want an error")
+	}
+}
+
+func TestPersistence_DataStructures(t *testing.T) {
+	_, client := newTestRedis(t)
+	for _, mode := range []Mode{Whole, Chunked} {
+		persisttest.TestNamedPersistence(t,
+			func(name string) persist.Persistence {
+				rp, _ := New(client, fmt.Sprint(mode, ":", name), Options{Mode: mode, ChunkSize: 4})
+				return rp
+			},
+			nil,
+		)
+	}
+
+	// only persist.Paged data structures can be saved incrementally, and raw data is only loaded into the same type
+	rp, _ := New(client, "incremental", Options{Mode: Incremental})
+	if err := rp.Save(&persisttest.Structure{ID: "test"}); err == nil {
+		t.Errorf("Save() of a data structure which isn't persist.Paged succeeded, want an error")
+	}
+	if err := newTestFilter(t, rp, 1<<12).SavePersistence(); err != nil {
+		t.Fatalf("SavePersistence() error = %v", err)
+	}
+	if err := rp.Load(&persisttest.Structure{ID: "test"}); !errors.Is(err, persist.ErrTypeMismatch) {
+		t.Errorf("Load() of a filter into another type error = %v, want ErrTypeMismatch", err)
+	}
+}
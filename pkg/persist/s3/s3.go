@@ -0,0 +1,145 @@
+// Package s3 keeps blobs for persist.BlobPersistence in S3, or any S3-compatible service
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"github.com/minio/minio-go/v7"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	// DefaultPartSize is the size of each part of a multipart upload made by BlobStore
+	DefaultPartSize = 64 << 20
+	// MinPartSize is the smallest part size S3 accepts for all but the last part of a multipart upload
+	MinPartSize = 5 << 20
+)
+
+// BlobStore is a persist.BlobStore keeping blobs as objects in a bucket of S3, or any S3-compatible service, through a
+// minio-go client.  Blobs larger than the part size are uploaded in parts, buffering one part in memory at a time, so
+// their size needn't be known in advance.  Conditional writes use the If-Match and If-None-Match headers, which the
+// service must support.
+type BlobStore struct {
+	client   *minio.Client
+	bucket   string
+	partSize uint64
+}
+
+// NewBlobStore creates a BlobStore keeping blobs in bucket
+func NewBlobStore(client *minio.Client, bucket string) *BlobStore {
+	return &BlobStore{client: client, bucket: bucket, partSize: DefaultPartSize}
+}
+
+// WithPartSize sets the size of each part of a multipart upload, which S3 requires to be at least MinPartSize
+func (s *BlobStore) WithPartSize(size uint64) (*BlobStore, error) {
+	if size < MinPartSize {
+		return nil, fmt.Errorf("part size %d is below S3's minimum of %d", size, MinPartSize)
+	}
+	s.partSize = size
+	return s, nil
+}
+
+// Put uploads the blob.  A blob larger than one part is uploaded in parts, and the condition is applied when the parts
+// are combined, which is when S3 checks it.
+func (s *BlobStore) Put(ctx context.Context, name string, r io.Reader, size int64, opts persist.PutOptions) (string, error) {
+	putOpts := minio.PutObjectOptions{ContentType: "application/octet-stream"}
+	if opts.IfMatch != "" {
+		putOpts.SetMatchETag(opts.IfMatch)
+	}
+	if opts.IfNoneMatch {
+		putOpts.SetMatchETagExcept("*")
+	}
+
+	core := minio.Core{Client: s.client}
+	buf := make([]byte, s.partSize)
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		info, err := core.PutObject(ctx, s.bucket, name, bytes.NewReader(buf[:n]), int64(n), "", "", putOpts)
+		if err != nil {
+			return "", s3Error(name, err)
+		}
+		return info.ETag, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	uploadID, err := core.NewMultipartUpload(ctx, s.bucket, name, minio.PutObjectOptions{ContentType: putOpts.ContentType})
+	if err != nil {
+		return "", s3Error(name, err)
+	}
+	etag, err := s.putParts(ctx, core, name, uploadID, r, buf, putOpts)
+	if err != nil {
+		_ = core.AbortMultipartUpload(context.WithoutCancel(ctx), s.bucket, name, uploadID)
+		return "", s3Error(name, err)
+	}
+	return etag, nil
+}
+
+// putParts uploads the first part, which is in buf, and the rest of r, then combines them
+func (s *BlobStore) putParts(ctx context.Context, core minio.Core, name, uploadID string, r io.Reader, buf []byte,
+	opts minio.PutObjectOptions) (string, error) {
+	var parts []minio.CompletePart
+	for n := len(buf); n > 0; {
+		part, err := core.PutObjectPart(ctx, s.bucket, name, uploadID, len(parts)+1, bytes.NewReader(buf[:n]), int64(n),
+			minio.PutObjectPartOptions{})
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", err
+		}
+	}
+	info, err := core.CompleteMultipartUpload(ctx, s.bucket, name, uploadID, parts, opts)
+	if err != nil {
+		return "", err
+	}
+	return info.ETag, nil
+}
+
+// Get downloads the blob
+func (s *BlobStore) Get(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, "", s3Error(name, err)
+	}
+	// the request is made by the first call on the object
+	info, err := object.Stat()
+	if err != nil {
+		_ = object.Close()
+		return nil, "", s3Error(name, err)
+	}
+	return object, info.ETag, nil
+}
+
+// List lists the objects whose names start with prefix
+func (s *BlobStore) List(ctx context.Context, prefix string) ([]persist.BlobInfo, error) {
+	var blobs []persist.BlobInfo
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, s3Error(prefix, object.Err)
+		}
+		blobs = append(blobs, persist.BlobInfo{Name: object.Key, Size: object.Size, ETag: object.ETag, Modified: object.LastModified})
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Name < blobs[j].Name })
+	return blobs, nil
+}
+
+// s3Error translates the errors S3 returns for a missing object or a failed condition
+func s3Error(name string, err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey":
+		return fmt.Errorf("blob %q: %w", name, os.ErrNotExist)
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return fmt.Errorf("blob %q: %w", name, persist.ErrPreconditionFailed)
+	}
+	return err
+}
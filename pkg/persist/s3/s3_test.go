@@ -0,0 +1,205 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"github.com/dryack/GoCeannaithe/pkg/persist/internal/blobtest"
+	"github.com/dryack/GoCeannaithe/pkg/persist/internal/persisttest"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a stand-in for S3, implementing just the requests BlobStore makes of a single bucket: PutObject,
+// HeadObject, GetObject, ListObjectsV2 and multipart uploads, with If-Match and If-None-Match on writes
+type fakeS3 struct {
+	mu       sync.Mutex
+	bucket   string
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	nextID   int
+	parts    int // uploaded, in total
+	modified time.Time
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *minio.Client) {
+	t.Helper()
+	fake := &fakeS3{bucket: bucket, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}, modified: time.Now().UTC()}
+	server := httptest.NewServer(http.StripPrefix("/"+bucket, fake))
+	t.Cleanup(server.Close)
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("", "", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, client
+}
+
+func s3ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, query.Get("prefix"))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			s3ErrorResponse(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"`+s3ETag(data)+`"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", f.modified.Format(http.TimeFormat))
+		_, _ = w.Write(data)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][number] = body
+		f.parts++
+		w.Header().Set("ETag", `"`+s3ETag(body)+`"`)
+	case r.Method == http.MethodPut:
+		if f.failsCondition(w, r, key) {
+			return
+		}
+		f.objects[key] = body
+		w.Header().Set("ETag", `"`+s3ETag(body)+`"`)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: f.bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		if f.failsCondition(w, r, key) {
+			return
+		}
+		var complete struct {
+			Parts []struct{ PartNumber int } `xml:"Part"`
+		}
+		_ = xml.Unmarshal(body, &complete)
+		var data []byte
+		for _, part := range complete.Parts {
+			data = append(data, f.uploads[query.Get("uploadId")][part.PartNumber]...)
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		f.objects[key] = data
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: f.bucket, Key: key, ETag: `"` + s3ETag(data) + `"`})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3ErrorResponse(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// failsCondition responds with an error if the request's If-Match or If-None-Match header isn't met
+func (f *fakeS3) failsCondition(w http.ResponseWriter, r *http.Request, key string) bool {
+	data, exists := f.objects[key]
+	ifMatch := r.Header.Get("If-Match")
+	if (r.Header.Get("If-None-Match") == "*" && exists) ||
+		(ifMatch != "" && (!exists || strings.Trim(ifMatch, `"`) != s3ETag(data))) {
+		s3ErrorResponse(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return true
+	}
+	return false
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		Size         int
+		ETag         string
+		LastModified string
+	}
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Name     string
+		Prefix   string
+		Contents []content
+	}{Name: f.bucket, Prefix: prefix}
+	for key, data := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{Key: key, Size: len(data), ETag: `"` + s3ETag(data) + `"`,
+				LastModified: f.modified.Format(time.RFC3339)})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	writeXML(w, result)
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func s3ErrorResponse(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func TestBlobStore(t *testing.T) {
+	_, client := newFakeS3(t, "sketches")
+	blobtest.TestBlobStore(t, NewBlobStore(client, "sketches"))
+}
+
+func TestBlobStore_Multipart(t *testing.T) {
+	fake, client := newFakeS3(t, "sketches")
+	store, err := NewBlobStore(client, "sketches").WithPartSize(MinPartSize)
+	if err != nil {
+		t.Fatalf("WithPartSize() error = %v", err)
+	}
+	saved := &persisttest.Structure{ID: "test", Data: bytes.Repeat([]byte("spam"), 2<<20)}
+	if err := persist.NewBlobPersistence(store, "large").Save(saved); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if fake.parts != 2 {
+		t.Errorf("uploaded %d parts, want 2 for 8 MiB in 5 MiB parts", fake.parts)
+	}
+
+	restored := &persisttest.Structure{ID: "test"}
+	if err := persist.NewBlobPersistence(store, "large").Load(restored); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !bytes.Equal(restored.Data, saved.Data) {
+		t.Errorf("Load() of a multipart upload didn't restore the data")
+	}
+}
+
+func TestBlobStore_PartSize(t *testing.T) {
+	_, client := newFakeS3(t, "sketches")
+	if _, err := NewBlobStore(client, "sketches").WithPartSize(MinPartSize - 1); err == nil {
+		t.Errorf("WithPartSize() below the minimum succeeded, want an error")
+	}
+}
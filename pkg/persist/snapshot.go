@@ -0,0 +1,108 @@
+package persist
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotTimeLayout formats a snapshot's time into its ID; IDs sort lexically in time order
+const snapshotTimeLayout = "20060102T150405.000000000Z"
+
+// Snapshot describes one saved generation of a data structure kept by FilePersistence
+type Snapshot struct {
+	// ID identifies the snapshot to LoadSnapshot
+	ID string
+	// Time is when the snapshot was saved, in UTC
+	Time time.Time
+	// Size is the size of the snapshot's file in bytes
+	Size int64
+}
+
+// WithSnapshots makes every Save also keep the data structure as a timestamped snapshot alongside its file, named
+// <filename>.<ID>.  After each save, snapshots beyond the newest keep are removed, as are snapshots older than maxAge;
+// a keep or maxAge of zero disables that limit.
+func (fp *FilePersistence) WithSnapshots(keep int, maxAge time.Duration) *FilePersistence {
+	fp.snapshots = true
+	fp.keep = keep
+	fp.maxAge = maxAge
+	return fp
+}
+
+// ListSnapshots returns the snapshots, newest first.  Temporary files from saves in progress, and files whose names
+// don't parse as a snapshot, are ignored.
+func (fp *FilePersistence) ListSnapshots() ([]Snapshot, error) {
+	entries, err := os.ReadDir(fp.directory)
+	if err != nil {
+		return nil, fmt.Errorf("error listing snapshots: %w", err)
+	}
+
+	prefix := fp.filename + "."
+	var snapshots []Snapshot
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		id := strings.TrimPrefix(name, prefix)
+		when, err := time.Parse(snapshotTimeLayout, id)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// removed since the directory was read
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{ID: id, Time: when, Size: info.Size()})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID > snapshots[j].ID })
+	return snapshots, nil
+}
+
+// LoadSnapshot loads the snapshot with the given ID into p, in the same way as Load
+func (fp *FilePersistence) LoadSnapshot(p Persistable, id string) error {
+	if _, err := time.Parse(snapshotTimeLayout, id); err != nil {
+		return fmt.Errorf("invalid snapshot ID %q", id)
+	}
+	return fp.readFile(p, fp.filename+"."+id)
+}
+
+// Prune removes the snapshots exceeding the limits given to WithSnapshots.  Save calls it after each save.
+func (fp *FilePersistence) Prune() error {
+	return fp.prune(fp.now())
+}
+
+func (fp *FilePersistence) prune(now time.Time) error {
+	snapshots, err := fp.ListSnapshots()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Time{}
+	if fp.maxAge > 0 {
+		cutoff = now.Add(-fp.maxAge)
+	}
+	var errs []error
+	for i, snapshot := range snapshots {
+		if (fp.keep > 0 && i >= fp.keep) || snapshot.Time.Before(cutoff) {
+			if err := os.Remove(filepath.Join(fp.directory, fp.filename+"."+snapshot.ID)); err != nil &&
+				!errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("error pruning snapshots: %w", err)
+	}
+	return nil
+}
+
+func (fp *FilePersistence) snapshotName(when time.Time) string {
+	return fp.filename + "." + when.UTC().Format(snapshotTimeLayout)
+}
@@ -0,0 +1,88 @@
+package persist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// steppingClock returns times an hour apart, starting at start
+func steppingClock(start time.Time) func() time.Time {
+	now := start.Add(-time.Hour)
+	return func() time.Time {
+		now = now.Add(time.Hour)
+		return now
+	}
+}
+
+func TestFilePersistence_Snapshots(t *testing.T) {
+	dir := t.TempDir()
+	fp := NewFilePersistence(dir, "sketch.bin").WithSnapshots(3, 0)
+	fp.now = steppingClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	for _, data := range []string{"first", "second", "third", "fourth", "fifth"} {
+		if err := fp.Save(&testStructure{typeID: "test", data: []byte(data)}); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+	// a save in progress must not be listed
+	if err := os.WriteFile(filepath.Join(dir, ".sketch.bin.tmp123"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := fp.ListSnapshots()
+	if err != nil {
+		t.Fatalf("ListSnapshots() error = %v", err)
+	}
+	if len(snapshots) != 3 {
+		t.Fatalf("ListSnapshots() returned %d snapshots, want 3", len(snapshots))
+	}
+	if want := time.Date(2024, 1, 1, 4, 0, 0, 0, time.UTC); !snapshots[0].Time.Equal(want) {
+		t.Errorf("newest snapshot time = %v, want %v", snapshots[0].Time, want)
+	}
+
+	// the file is the newest snapshot, rather than a second serialization of the data structure
+	newest, _ := os.Stat(filepath.Join(dir, "sketch.bin."+snapshots[0].ID))
+	current, _ := os.Stat(filepath.Join(dir, "sketch.bin"))
+	if newest == nil || current == nil || !os.SameFile(newest, current) {
+		t.Errorf("sketch.bin isn't linked to the newest snapshot")
+	}
+
+	// the oldest remaining snapshot is the third save
+	old := &testStructure{typeID: "test"}
+	if err := fp.LoadSnapshot(old, snapshots[2].ID); err != nil {
+		t.Fatalf("LoadSnapshot() error = %v", err)
+	}
+	if string(old.data) != "third" {
+		t.Errorf("LoadSnapshot() = %q, want %q", old.data, "third")
+	}
+
+	if err := fp.LoadSnapshot(&testStructure{typeID: "test"}, "../sketch.bin"); err == nil {
+		t.Errorf("LoadSnapshot() with an invalid ID succeeded, want error")
+	}
+}
+
+func TestFilePersistence_SnapshotsMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	fp := NewFilePersistence(dir, "sketch.bin").WithSnapshots(0, 90*time.Minute)
+	fp.now = steppingClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	for i := 0; i < 4; i++ {
+		if err := fp.Save(&testStructure{typeID: "test", data: []byte("spam")}); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+
+	// saves at 00:00, 01:00, 02:00 and 03:00, so only the last two are within 90 minutes of the last save
+	snapshots, err := fp.ListSnapshots()
+	if err != nil {
+		t.Fatalf("ListSnapshots() error = %v", err)
+	}
+	if len(snapshots) != 2 {
+		t.Errorf("ListSnapshots() returned %d snapshots, want 2", len(snapshots))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sketch.bin")); err != nil {
+		t.Errorf("saved file is missing: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+// Package sqlpersist saves GoCeannaithe's data structures as rows of a SQLite table, through database/sql.  It doesn't
+// depend on any SQLite driver; the caller chooses and registers one.
+package sqlpersist
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"os"
+	"regexp"
+)
+
+// sqlIdentifier matches the table names accepted by New, which can't be passed as query parameters
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Persistence saves a data structure as a row of a SQLite table, keyed by the data structure's name.  Each save replaces
+// the row atomically, with a single upsert.
+//
+// The table has the columns name (TEXT PRIMARY KEY) and data (BLOB), and is created if it doesn't exist.
+type Persistence struct {
+	db    *sql.DB
+	table string
+	name  string
+}
+
+// New creates a Persistence for the data structure called name, within table of db, creating the table if need be
+func New(db *sql.DB, table, name string) (*Persistence, error) {
+	if !sqlIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	query := `CREATE TABLE IF NOT EXISTS "` + table + `" (name TEXT PRIMARY KEY, data BLOB NOT NULL)`
+	if _, err := db.Exec(query); err != nil {
+		return nil, fmt.Errorf("error creating table %s: %w", table, err)
+	}
+	return &Persistence{db: db, table: table, name: name}, nil
+}
+
+// Save serializes p with persist.Marshal, and stores it under its name
+func (sp *Persistence) Save(p persist.Persistable) error {
+	data, err := persist.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("error saving %s: %w", p.TypeID(), err)
+	}
+	query := `INSERT INTO "` + sp.table + `" (name, data) VALUES (?, ?) ` +
+		`ON CONFLICT (name) DO UPDATE SET data = excluded.data`
+	if _, err := sp.db.Exec(query, sp.name, data); err != nil {
+		return fmt.Errorf("error saving %s: %w", p.TypeID(), err)
+	}
+	return nil
+}
+
+// Load restores p from the row stored under its name.  If there is no such row the error wraps os.ErrNotExist.
+func (sp *Persistence) Load(p persist.Persistable) error {
+	var data []byte
+	err := sp.db.QueryRow(`SELECT data FROM "`+sp.table+`" WHERE name = ?`, sp.name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("%q: %w", sp.name, os.ErrNotExist)
+	}
+	if err == nil {
+		err = persist.Unmarshal(data, p)
+	}
+	if err != nil {
+		return fmt.Errorf("error loading %s: %w", p.TypeID(), err)
+	}
+	return nil
+}
+
+// List returns the names of the data structures saved in table of db, in order
+func List(db *sql.DB, table string) ([]string, error) {
+	if !sqlIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	rows, err := db.Query(`SELECT name FROM "` + table + `" ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("error listing %s: %w", table, err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", table, err)
+	}
+	return names, nil
+}
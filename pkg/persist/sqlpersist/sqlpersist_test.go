@@ -0,0 +1,36 @@
+package sqlpersist
+
+import (
+	"database/sql"
+	"github.com/dryack/GoCeannaithe/pkg/persist"
+	"github.com/dryack/GoCeannaithe/pkg/persist/internal/persisttest"
+	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"testing"
+)
+
+func TestPersistence(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "sketches.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Skipf("SQLite isn't available: %v", err)
+	}
+
+	persisttest.TestNamedPersistence(t,
+		func(name string) persist.Persistence {
+			sp, err := New(db, "sketches", name)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			return sp
+		},
+		func() ([]string, error) { return List(db, "sketches") },
+	)
+
+	if _, err := New(db, `sketches"; DROP TABLE sketches; --`, "x"); err == nil {
+		t.Errorf("New() with an invalid table name succeeded, want error")
+	}
+}